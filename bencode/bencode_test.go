@@ -0,0 +1,174 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package bencode
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testPeer struct {
+	IP     string `bencode:"ip"`
+	PeerID string `bencode:"peer id"`
+	Port   uint   `bencode:"port"`
+}
+
+type testResponse struct {
+	Interval int64       `bencode:"interval"`
+	Complete int         `bencode:"complete"`
+	Peers    []testPeer  `bencode:"peers,omitempty"`
+	Warning  string      `bencode:"warning message,omitempty"`
+	Extra    interface{} `bencode:"extra,omitempty"`
+	Ignored  string      `bencode:"-"`
+	internal string
+}
+
+var marshalTests = []struct {
+	value    interface{}
+	expected string
+}{
+	{"spam", "4:spam"},
+	{"", "0:"},
+	{[]byte{0, 1, 2}, "3:\x00\x01\x02"},
+	{42, "i42e"},
+	{-42, "i-42e"},
+	{uint64(1) << 63, "i9223372036854775808e"},
+	{int8(-1), "i-1e"},
+	{[]string{"a", "bc"}, "l1:a2:bce"},
+	{[]interface{}{"a", 1, []int{2}}, "l1:ai1eli2eee"},
+	{[2]int{1, 2}, "li1ei2ee"},
+	{map[string]int{"zz": 1, "a": 2, "m": 3}, "d1:ai2e1:mi3e2:zzi1ee"},
+	{map[string]interface{}{"list": []interface{}{}, "dict": map[string]interface{}{}}, "d4:dictde4:listlee"},
+	{testResponse{Interval: 1800, Complete: 3, Ignored: "x", internal: "x"}, "d8:completei3e8:intervali1800ee"},
+	{&testResponse{Peers: []testPeer{{"10.0.0.1", "-TR2820-000000000001", 6881}}, Warning: "hi"},
+		"d8:completei0e8:intervali0e5:peersld2:ip8:10.0.0.17:peer id20:-TR2820-0000000000014:porti6881eee15:warning message2:hie"},
+	{testResponse{Extra: []byte{}}, "d8:completei0e5:extra0:8:intervali0ee"},
+}
+
+func TestMarshal(t *testing.T) {
+	for _, tt := range marshalTests {
+		data, err := Marshal(tt.value)
+		if err != nil {
+			t.Errorf("Marshal(%#v) error: %v", tt.value, err)
+			continue
+		}
+		if string(data) != tt.expected {
+			t.Errorf("Marshal(%#v) = %q, want %q", tt.value, data, tt.expected)
+		}
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	for _, value := range []interface{}{nil, 1.5, true, map[int]int{1: 1}, []interface{}{nil}, (*testPeer)(nil)} {
+		if data, err := Marshal(value); err == nil {
+			t.Errorf("Marshal(%#v) = %q, want an error", value, data)
+		}
+	}
+}
+
+func TestEncoderLeavesBufferOnError(t *testing.T) {
+	buf := bytes.NewBufferString("prefix")
+	if err := NewEncoder(buf).Encode([]interface{}{"a", 1.5}); err == nil {
+		t.Fatal("Encoding a float succeeded")
+	}
+	if buf.String() != "prefix" {
+		t.Errorf("Buffer changed by a failed encode: %q", buf.String())
+	}
+}
+
+func TestUnmarshalInterface(t *testing.T) {
+	var value interface{}
+	err := Unmarshal([]byte("d4:listli1e3:twoe3:numi-7e6:nestedd1:ad1:b0:eee"), &value)
+	if err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"list":   []interface{}{int64(1), "two"},
+		"num":    int64(-7),
+		"nested": map[string]interface{}{"a": map[string]interface{}{"b": ""}},
+	}
+	if !reflect.DeepEqual(value, expected) {
+		t.Errorf("Unmarshal = %#v, want %#v", value, expected)
+	}
+}
+
+func TestUnmarshalStruct(t *testing.T) {
+	var resp testResponse
+	data := "d8:completei3e7:unknownli1ee8:intervali1800e5:peersld2:ip8:10.0.0.17:peer id2:ab4:porti6881eeee"
+	if err := Unmarshal([]byte(data), &resp); err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+
+	expected := testResponse{Interval: 1800, Complete: 3, Peers: []testPeer{{"10.0.0.1", "ab", 6881}}}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Errorf("Unmarshal = %+v, want %+v", resp, expected)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	files := map[string]map[string][]byte{"hash": {"peers": []byte{10, 0, 0, 1, 0x1a, 0xe1}}}
+	data, err := Marshal(files)
+	if err != nil {
+		t.Fatalf("Marshal error: %v", err)
+	}
+
+	var decoded map[string]map[string][]byte
+	if err = Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, files) {
+		t.Errorf("Round trip gave %#v, want %#v", decoded, files)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	for _, data := range []string{
+		"", "i", "i12", "ie", "i-e", "i03e", "i-0e", "5:abc", "-1:a", "l", "d1:a", "di1ei2ee", "x", "i1ei2e",
+		strings.Repeat("l", maxDepth+1) + strings.Repeat("e", maxDepth+1),
+	} {
+		var value interface{}
+		if err := Unmarshal([]byte(data), &value); err == nil {
+			t.Errorf("Unmarshal(%q) = %#v, want an error", data, value)
+		}
+	}
+
+	var i uint8
+	if err := Unmarshal([]byte("i256e"), &i); err == nil {
+		t.Errorf("Overflowing integer decoded as %d", i)
+	}
+	var s string
+	if err := Unmarshal([]byte("li1ee"), &s); err == nil {
+		t.Errorf("List decoded into a string: %q", s)
+	}
+	if err := Unmarshal([]byte("0:"), s); err == nil {
+		t.Error("Decoded into a non-pointer")
+	}
+}
+
+func TestDecoderStream(t *testing.T) {
+	d := NewDecoder(strings.NewReader("i1e3:twoli3ee"))
+
+	var values []interface{}
+	for {
+		var value interface{}
+		err := d.Decode(&value)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Decode error: %v", err)
+		}
+		values = append(values, value)
+	}
+
+	expected := []interface{}{int64(1), "two", []interface{}{int64(3)}}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Decoded %#v, want %#v", values, expected)
+	}
+}
@@ -0,0 +1,396 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+type SyntaxError struct {
+	Offset int64 // Bytes read before the error occurred
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.msg, e.Offset)
+}
+
+type UnmarshalTypeError struct {
+	Value string // Bencode value type, "integer", "string", "list" or "dictionary"
+	Type  reflect.Type
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return "bencode: cannot decode " + e.Value + " into " + e.Type.String()
+}
+
+var errNonPointer = errors.New("bencode: Decode needs a non-nil pointer")
+
+// maxDepth limits the nesting of lists and dictionaries, so malicious input can't exhaust the stack.
+const maxDepth = 100
+
+// Unmarshal decodes the bencoded value in data into v, which must be a non-nil pointer.
+// Data following the value is an error.
+func Unmarshal(data []byte, v interface{}) error {
+	d := NewDecoder(bytes.NewReader(data))
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	if d.offset != int64(len(data)) {
+		return &SyntaxError{d.offset, "trailing data"}
+	}
+	return nil
+}
+
+// A Decoder reads bencoded values from an input stream.
+// It may buffer more data than the values it reads.
+type Decoder struct {
+	r      *bufio.Reader
+	offset int64
+	depth  int
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next bencoded value from the stream and stores it in v, which must be a non-nil pointer.
+// Dictionary keys that don't match a field of a struct are skipped.
+// At the end of the stream, io.EOF is returned.
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errNonPointer
+	}
+	if _, err := d.r.Peek(1); err != nil {
+		return err
+	}
+	d.depth = 0
+	return d.decodeValue(rv.Elem())
+}
+
+func (d *Decoder) enter() error {
+	d.depth++
+	if d.depth > maxDepth {
+		return &SyntaxError{d.offset, "exceeded max depth"}
+	}
+	return nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	d.offset++
+	return b, nil
+}
+
+func (d *Decoder) peekByte() (byte, error) {
+	b, err := d.r.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readUntil reads up to the delimiter, which is consumed but not returned.
+func (d *Decoder) readUntil(delim byte) ([]byte, error) {
+	data, err := d.r.ReadSlice(delim)
+	d.offset += int64(len(data))
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data[:len(data)-1], nil
+}
+
+func (d *Decoder) readInt() (int64, error) {
+	data, err := d.readUntil('e')
+	if err != nil {
+		return 0, err
+	}
+	if !validInt(data) {
+		return 0, &SyntaxError{d.offset, fmt.Sprintf("invalid integer %q", data)}
+	}
+	i, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return 0, &SyntaxError{d.offset, fmt.Sprintf("invalid integer %q", data)}
+	}
+	return i, nil
+}
+
+// validInt rejects the forms the spec doesn't allow, which are leading zeros and negative zero.
+func validInt(data []byte) bool {
+	digits := data
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+		if len(digits) > 0 && digits[0] == '0' {
+			return false
+		}
+	}
+	return len(digits) > 0 && (digits[0] != '0' || len(digits) == 1)
+}
+
+func (d *Decoder) readString(first byte) ([]byte, error) {
+	data, err := d.readUntil(':')
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.ParseInt(string(first)+string(data), 10, 64)
+	if err != nil || length < 0 {
+		return nil, &SyntaxError{d.offset, "invalid string length"}
+	}
+
+	// The length comes from the input, so the string is read in chunks rather than allocated up front
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, d.r, length)
+	d.offset += n
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *Decoder) decodeValue(v reflect.Value) error {
+	b, err := d.readByte()
+	if err != nil {
+		return err
+	}
+
+	// Pointers are allocated as needed, empty interfaces get the natural types
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		value, err := d.decodeInterface(b)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(value))
+		return nil
+	}
+
+	switch {
+	case b == 'i':
+		return d.decodeInt(v)
+	case b >= '0' && b <= '9':
+		return d.decodeString(v, b)
+	case b == 'l':
+		if err = d.enter(); err != nil {
+			return err
+		}
+		defer func() { d.depth-- }()
+		return d.decodeList(v)
+	case b == 'd':
+		if err = d.enter(); err != nil {
+			return err
+		}
+		defer func() { d.depth-- }()
+		return d.decodeDict(v)
+	}
+	return &SyntaxError{d.offset - 1, fmt.Sprintf("invalid character %q", b)}
+}
+
+func (d *Decoder) decodeInt(v reflect.Value) error {
+	i, err := d.readInt()
+	if err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(i) {
+			return &UnmarshalTypeError{"integer " + strconv.FormatInt(i, 10), v.Type()}
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i < 0 || v.OverflowUint(uint64(i)) {
+			return &UnmarshalTypeError{"integer " + strconv.FormatInt(i, 10), v.Type()}
+		}
+		v.SetUint(uint64(i))
+	default:
+		return &UnmarshalTypeError{"integer", v.Type()}
+	}
+	return nil
+}
+
+func (d *Decoder) decodeString(v reflect.Value, first byte) error {
+	data, err := d.readString(first)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(data))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(data)
+	default:
+		return &UnmarshalTypeError{"string", v.Type()}
+	}
+	return nil
+}
+
+func (d *Decoder) decodeList(v reflect.Value) error {
+	if v.Kind() != reflect.Slice {
+		return &UnmarshalTypeError{"list", v.Type()}
+	}
+
+	v.SetLen(0)
+	for {
+		b, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if b == 'e' {
+			d.readByte()
+			break
+		}
+
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err = d.decodeValue(elem); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, elem))
+	}
+
+	if v.IsNil() {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+	return nil
+}
+
+func (d *Decoder) decodeDict(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return &UnmarshalTypeError{"dictionary", v.Type()}
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	case reflect.Struct:
+	default:
+		return &UnmarshalTypeError{"dictionary", v.Type()}
+	}
+
+	for {
+		b, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		if b == 'e' {
+			return nil
+		}
+		if b < '0' || b > '9' {
+			return &SyntaxError{d.offset - 1, "dictionary key is not a string"}
+		}
+		key, err := d.readString(b)
+		if err != nil {
+			return err
+		}
+
+		if v.Kind() == reflect.Map {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err = d.decodeValue(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), elem)
+			continue
+		}
+
+		if f, exists := fieldByKey(v.Type(), string(key)); exists {
+			err = d.decodeValue(v.Field(f.index))
+		} else {
+			var skipped interface{}
+			err = d.decodeValue(reflect.ValueOf(&skipped).Elem())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (d *Decoder) decodeInterface(b byte) (interface{}, error) {
+	if b == 'l' || b == 'd' {
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+		defer func() { d.depth-- }()
+	}
+
+	switch {
+	case b == 'i':
+		return d.readInt()
+	case b >= '0' && b <= '9':
+		data, err := d.readString(b)
+		return string(data), err
+	case b == 'l':
+		list := make([]interface{}, 0)
+		for {
+			next, err := d.readByte()
+			if err != nil {
+				return nil, err
+			}
+			if next == 'e' {
+				return list, nil
+			}
+			value, err := d.decodeInterface(next)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+	case b == 'd':
+		dict := make(map[string]interface{})
+		for {
+			next, err := d.readByte()
+			if err != nil {
+				return nil, err
+			}
+			if next == 'e' {
+				return dict, nil
+			}
+			if next < '0' || next > '9' {
+				return nil, &SyntaxError{d.offset - 1, "dictionary key is not a string"}
+			}
+			key, err := d.readString(next)
+			if err != nil {
+				return nil, err
+			}
+			next, err = d.readByte()
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.decodeInterface(next)
+			if err != nil {
+				return nil, err
+			}
+			dict[string(key)] = value
+		}
+	}
+	return nil, &SyntaxError{d.offset - 1, fmt.Sprintf("invalid character %q", b)}
+}
@@ -0,0 +1,297 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package bencode implements encoding and decoding of bencoded data as defined in BEP 3
+// (http://www.bittorrent.org/beps/bep_0003.html).
+//
+// Values map to bencode like this:
+//   - strings and byte slices are byte strings
+//   - signed and unsigned integers are integers
+//   - slices and arrays are lists
+//   - maps with string keys and structs are dictionaries, with their keys sorted as the spec requires
+//
+// Struct fields are encoded under their name, unless a `bencode:"key"` tag says otherwise.
+// A tag of "-" skips the field, and the "omitempty" option skips it if it's empty, like in encoding/json.
+// Decoding into an empty interface gives int64, string, []interface{} and map[string]interface{} values.
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// There is no bencoding for nil, so nil pointers and interfaces can't be encoded unless their field is omitted.
+var ErrNil = errors.New("bencode: can't encode nil")
+
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "bencode: unsupported type " + e.Type.String()
+}
+
+// Marshal returns the bencoding of v.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeValue(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// An Encoder writes bencoded values to an output stream.
+type Encoder struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the bencoding of v to the stream. Nothing is written if v can't be encoded.
+func (e *Encoder) Encode(v interface{}) error {
+	// Responses are written to pooled buffers, so those are encoded into directly
+	if buf, ok := e.w.(*bytes.Buffer); ok {
+		length := buf.Len()
+		err := encodeValue(buf, reflect.ValueOf(v))
+		if err != nil {
+			buf.Truncate(length)
+		}
+		return err
+	}
+
+	e.buf.Reset()
+	if err := encodeValue(&e.buf, reflect.ValueOf(v)); err != nil {
+		return err
+	}
+	_, err := e.w.Write(e.buf.Bytes())
+	return err
+}
+
+func encodeValue(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		return ErrNil
+	}
+
+	// The common types are handled without going through reflection
+	switch value := v.Interface().(type) {
+	case string:
+		encodeString(buf, value)
+		return nil
+	case []byte:
+		encodeBytes(buf, value)
+		return nil
+	case int:
+		encodeInt(buf, int64(value))
+		return nil
+	case int64:
+		encodeInt(buf, value)
+		return nil
+	case uint:
+		encodeUint(buf, uint64(value))
+		return nil
+	case uint64:
+		encodeUint(buf, value)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		encodeString(buf, v.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		encodeInt(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		encodeUint(buf, v.Uint())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			encodeBytes(buf, v.Bytes())
+			return nil
+		}
+		return encodeList(buf, v)
+	case reflect.Array:
+		return encodeList(buf, v)
+	case reflect.Map:
+		return encodeMap(buf, v)
+	case reflect.Struct:
+		return encodeStruct(buf, v)
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return ErrNil
+		}
+		return encodeValue(buf, v.Elem())
+	default:
+		return &UnsupportedTypeError{v.Type()}
+	}
+	return nil
+}
+
+func encodeString(buf *bytes.Buffer, s string) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.WriteString(s)
+}
+
+func encodeBytes(buf *bytes.Buffer, b []byte) {
+	buf.WriteString(strconv.Itoa(len(b)))
+	buf.WriteByte(':')
+	buf.Write(b)
+}
+
+func encodeInt(buf *bytes.Buffer, i int64) {
+	buf.WriteByte('i')
+	buf.WriteString(strconv.FormatInt(i, 10))
+	buf.WriteByte('e')
+}
+
+func encodeUint(buf *bytes.Buffer, i uint64) {
+	buf.WriteByte('i')
+	buf.WriteString(strconv.FormatUint(i, 10))
+	buf.WriteByte('e')
+}
+
+func encodeList(buf *bytes.Buffer, v reflect.Value) error {
+	buf.WriteByte('l')
+	for i := 0; i < v.Len(); i++ {
+		if err := encodeValue(buf, v.Index(i)); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('e')
+	return nil
+}
+
+func encodeMap(buf *bytes.Buffer, v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return &UnsupportedTypeError{v.Type()}
+	}
+
+	keys := make([]string, 0, v.Len())
+	for _, key := range v.MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+
+	buf.WriteByte('d')
+	for _, key := range keys {
+		encodeString(buf, key)
+		if err := encodeValue(buf, v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('e')
+	return nil
+}
+
+func encodeStruct(buf *bytes.Buffer, v reflect.Value) error {
+	buf.WriteByte('d')
+	for _, f := range cachedFields(v.Type()) {
+		field := v.Field(f.index)
+		if f.omitEmpty && isEmpty(field) {
+			continue
+		}
+		encodeString(buf, f.key)
+		if err := encodeValue(buf, field); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('e')
+	return nil
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return v.Len() == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+/*
+ * Struct fields are looked up once per type, and kept sorted by key so dictionaries can be written in order
+ */
+
+type field struct {
+	key       string
+	index     int
+	omitEmpty bool
+}
+
+var fieldCache struct {
+	fields map[reflect.Type][]field
+	sync.RWMutex
+}
+
+func cachedFields(t reflect.Type) []field {
+	fieldCache.RLock()
+	fields, exists := fieldCache.fields[t]
+	fieldCache.RUnlock()
+	if exists {
+		return fields
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		if structField.PkgPath != "" { // Unexported
+			continue
+		}
+
+		tag := structField.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+
+		f := field{key: structField.Name, index: i}
+		if tag != "" {
+			options := strings.Split(tag, ",")
+			if options[0] != "" {
+				f.key = options[0]
+			}
+			for _, option := range options[1:] {
+				if option == "omitempty" {
+					f.omitEmpty = true
+				}
+			}
+		}
+		fields = append(fields, f)
+	}
+	sort.Sort(byKey(fields))
+
+	fieldCache.Lock()
+	if fieldCache.fields == nil {
+		fieldCache.fields = make(map[reflect.Type][]field)
+	}
+	fieldCache.fields[t] = fields
+	fieldCache.Unlock()
+	return fields
+}
+
+type byKey []field
+
+func (f byKey) Len() int           { return len(f) }
+func (f byKey) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f byKey) Less(i, j int) bool { return f[i].key < f[j].key }
+
+// fieldByKey returns the field of a struct type that a dictionary key decodes into.
+func fieldByKey(t reflect.Type, key string) (field, bool) {
+	for _, f := range cachedFields(t) {
+		if f.key == key {
+			return f, true
+		}
+	}
+	return field{}, false
+}
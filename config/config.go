@@ -7,8 +7,13 @@ package config
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,9 +27,16 @@ func (d *TrackerDuration) MarshalJSON() ([]byte, error) {
 
 func (d *TrackerDuration) UnmarshalJSON(b []byte) error {
 	var str string
-	err := json.Unmarshal(b, &str)
-	d.Duration, err = time.ParseDuration(str)
-	return err
+	if err := json.Unmarshal(b, &str); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %v", err)
+	}
+
+	duration, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
 }
 
 // TrackerIntervals represents the intervals object in a config file.
@@ -32,7 +44,9 @@ type TrackerIntervals struct {
 	Announce    TrackerDuration `json:"announce"`
 	MinAnnounce TrackerDuration `json:"min_announce"`
 
+	// Reloads only read what changed since the last one, except every FullDatabaseReload
 	DatabaseReload        TrackerDuration `json:"database_reload"`
+	FullDatabaseReload    TrackerDuration `json:"full_database_reload"`
 	DatabaseSerialization TrackerDuration `json:"database_serialization"`
 	PurgeInactive         TrackerDuration `json:"purge_inactive"`
 
@@ -42,6 +56,15 @@ type TrackerIntervals struct {
 
 	// Initial wait time before retrying a query when the db deadlocks (ramps linearly)
 	DeadlockWait TrackerDuration `json:"deadlock_wait"`
+
+	// How often the journal is synced to disk, at most this much is lost in a crash
+	JournalSync TrackerDuration `json:"journal_sync"`
+
+	// Initial wait time before retrying a batch that failed to flush (doubles with every failure)
+	FlushRetryWait TrackerDuration `json:"flush_retry_wait"`
+
+	// How long requests in flight get to finish on shutdown, before the queues are flushed anyway
+	ShutdownTimeout TrackerDuration `json:"shutdown_timeout"`
 }
 
 // TrackerFlushBufferSizes represents the buffer_sizes object in a config file.
@@ -64,41 +87,323 @@ type TrackerDatabase struct {
 	Encoding string `json:"encoding"`
 }
 
+// TrackerLogging represents the logging object in a config file.
+type TrackerLogging struct {
+	Format string `json:"format"` // "logfmt" or "json"
+	Output string `json:"output"` // "stderr", "stdout", "syslog" or the path of a file
+
+	// Lowest level logged, "debug", "info", "warning" or "critical". Levels can be set per subsystem,
+	// which are main, server, admin, database, flush, journal and mysql.
+	Level  string            `json:"level"`
+	Levels map[string]string `json:"levels"`
+
+	// Log files are rotated once they grow past MaxSize megabytes, keeping MaxBackups old files. 0 disables rotation.
+	MaxSize    int `json:"max_size"`
+	MaxBackups int `json:"max_backups"`
+}
+
+// TrackerRateLimit allows Rate requests per second on average, in bursts of up to Burst requests.
+// A rate of 0 disables the limit.
+type TrackerRateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// TrackerRateLimits represents the rate_limits object in a config file, limiting announces and scrapes.
+type TrackerRateLimits struct {
+	Passkey TrackerRateLimit `json:"passkey"`
+	IP      TrackerRateLimit `json:"ip"` // Of the address the request came from
+}
+
+// TrackerBans represents the bans object in a config file. Bans are also loaded from the database.
+type TrackerBans struct {
+	// File with an IP address or CIDR range per line, read again on every database reload. Disabled when empty.
+	File string `json:"file"`
+
+	// Failure reason sent to banned clients.
+	Message string `json:"message"`
+}
+
 // TrackerConfig represents a whole Chihaya config file.
 type TrackerConfig struct {
+	// Either "mysql" or "memory". The memory backend is seeded from MemoryFixture, if set.
+	Backend       string `json:"backend"`
+	MemoryFixture string `json:"memory_fixture"`
+
 	Database     TrackerDatabase         `json:"database"`
 	Intervals    TrackerIntervals        `json:"intervals"`
 	FlushSizes   TrackerFlushBufferSizes `json:"sizes"`
+	Logging      TrackerLogging          `json:"logging"`
+	RateLimits   TrackerRateLimits       `json:"rate_limits"`
+	Bans         TrackerBans             `json:"bans"`
 	LogFlushes   bool                    `json:"log_flushes"`
 	SlotsEnabled bool                    `json:"slots_enabled"`
 	BindAddress  string                  `json:"addr"`
 
+	// Address for the UDP tracker protocol (BEP 15), disabled when empty.
+	UDPBindAddress string `json:"udp_addr"`
+
+	// Whether UDP scrapes are answered. They can't carry a passkey, so anyone could read the swarm counts.
+	UDPScrape bool `json:"udp_scrape"`
+
+	// Addresses and CIDR ranges of the proxies in front of the tracker. Forwarded, X-Forwarded-For and
+	// X-Real-Ip headers are only honored on requests from these.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// When the addresses clients give in the ip, ipv4 and ipv6 parameters (or the UDP IP field) are used:
+	// "never", "same_family" as the address the request came from, or "always". "always" lets anyone with
+	// a passkey put any address into the swarm.
+	IPParam string `json:"ip_param"`
+
+	// Key required by the /admin/ endpoint, which is disabled when empty.
+	AdminKey string `json:"admin_key"`
+
 	// When true disregards download. This value is loaded from the database.
 	GlobalFreeleech bool `json:"global_freeleach"`
 
 	// Maximum times to retry a deadlocked query before giving up.
 	MaxDeadlockRetries int `json:"max_deadlock_retries"`
+
+	// Directory of the journal of deltas that haven't been flushed yet, disabled when empty.
+	JournalPath string `json:"journal_path"`
+
+	// Times to retry a batch that failed to flush before splitting it up to find the rows that fail.
+	MaxFlushRetries int `json:"max_flush_retries"`
+
+	// Directory for deltas that couldn't be flushed at all, they're dropped when empty.
+	DeadLetterPath string `json:"dead_letter_path"`
+
+	// Whether the snapshots of the caches are gzip compressed.
+	SnapshotCompression bool `json:"snapshot_compression"`
+}
+
+// ParseNetworks parses a list of CIDR ranges, where a bare address is a range of just that address.
+func ParseNetworks(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't an address or CIDR range", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
 }
 
-// LoadConfig loads the config file from the given path
+// LoadConfig loads the config file from the given path, if any, and applies the overrides on top of it
 func LoadConfig(path string) (err error) {
-	expandedPath := os.ExpandEnv(path)
-	f, err := os.Open(expandedPath)
+	cfg, err := load(Loaded, path)
 	if err != nil {
 		return
 	}
+	Loaded = cfg
+	return
+}
+
+func load(cfg TrackerConfig, path string) (TrackerConfig, error) {
+	// Decoding reuses the backing array of slices, which is shared with base
+	cfg.TrustedProxies = append([]string(nil), cfg.TrustedProxies...)
+
+	if path != "" {
+		if err := decodeFile(path, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+	if err := applyOverrides(&cfg, os.Environ()); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+func decodeFile(path string, cfg *TrackerConfig) error {
+	f, err := os.Open(os.ExpandEnv(path))
+	if err != nil {
+		return err
+	}
 	defer f.Close()
 
-	err = json.NewDecoder(f).Decode(&Loaded)
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(cfg)
+}
+
+// Validate checks for values the tracker can't run with, and returns an error listing all of them.
+func (cfg *TrackerConfig) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	durations := []struct {
+		key   string
+		value TrackerDuration
+	}{
+		{"announce", cfg.Intervals.Announce},
+		{"min_announce", cfg.Intervals.MinAnnounce},
+		{"database_reload", cfg.Intervals.DatabaseReload},
+		{"full_database_reload", cfg.Intervals.FullDatabaseReload},
+		{"database_serialization", cfg.Intervals.DatabaseSerialization},
+		{"purge_inactive", cfg.Intervals.PurgeInactive},
+		{"flush_sleep", cfg.Intervals.FlushSleep},
+		{"deadlock_wait", cfg.Intervals.DeadlockWait},
+		{"journal_sync", cfg.Intervals.JournalSync},
+		{"flush_retry_wait", cfg.Intervals.FlushRetryWait},
+		{"shutdown_timeout", cfg.Intervals.ShutdownTimeout},
+	}
+	for _, d := range durations {
+		check(d.value.Duration > 0, "intervals.%s must be positive, got %s", d.key, d.value)
+	}
+	check(cfg.Intervals.MinAnnounce.Duration <= cfg.Intervals.Announce.Duration,
+		"intervals.min_announce (%s) can't be longer than intervals.announce (%s)", cfg.Intervals.MinAnnounce, cfg.Intervals.Announce)
+	check(cfg.Intervals.FullDatabaseReload.Duration >= cfg.Intervals.DatabaseReload.Duration,
+		"intervals.full_database_reload (%s) can't be shorter than intervals.database_reload (%s)",
+		cfg.Intervals.FullDatabaseReload, cfg.Intervals.DatabaseReload)
+	check(cfg.Intervals.VerifyUsedSlots > 0, "intervals.verify_used_slots must be positive, got %d", cfg.Intervals.VerifyUsedSlots)
+
+	sizes := []struct {
+		key   string
+		value int
+	}{
+		{"torrent", cfg.FlushSizes.Torrent},
+		{"user", cfg.FlushSizes.User},
+		{"transfer_history", cfg.FlushSizes.TransferHistory},
+		{"transfer_ips", cfg.FlushSizes.TransferIps},
+		{"snatch", cfg.FlushSizes.Snatch},
+	}
+	for _, size := range sizes {
+		check(size.value > 0, "sizes.%s must be positive, got %d", size.key, size.value)
+	}
+
+	check(cfg.Backend == "mysql" || cfg.Backend == "memory", "backend must be \"mysql\" or \"memory\", got %q", cfg.Backend)
+	check(cfg.MaxDeadlockRetries > 0, "max_deadlock_retries must be positive, got %d", cfg.MaxDeadlockRetries)
+	check(cfg.MaxFlushRetries >= 0, "max_flush_retries can't be negative, got %d", cfg.MaxFlushRetries)
+	check(cfg.Logging.MaxSize >= 0, "logging.max_size can't be negative, got %d", cfg.Logging.MaxSize)
+	check(cfg.Logging.MaxBackups >= 0, "logging.max_backups can't be negative, got %d", cfg.Logging.MaxBackups)
+
+	limits := []struct {
+		key   string
+		value TrackerRateLimit
+	}{
+		{"passkey", cfg.RateLimits.Passkey},
+		{"ip", cfg.RateLimits.IP},
+	}
+	for _, limit := range limits {
+		check(limit.value.Rate >= 0, "rate_limits.%s.rate can't be negative, got %g", limit.key, limit.value.Rate)
+		check(limit.value.Rate == 0 || limit.value.Burst > 0, "rate_limits.%s.burst must be positive, got %d", limit.key, limit.value.Burst)
+	}
+
+	addresses := []struct {
+		key   string
+		value string
+	}{
+		{"addr", cfg.BindAddress},
+		{"udp_addr", cfg.UDPBindAddress},
+	}
+	for _, addr := range addresses {
+		if addr.value != "" {
+			_, _, err := net.SplitHostPort(addr.value)
+			check(err == nil, "%s: %v", addr.key, err)
+		}
+	}
+	check(cfg.BindAddress != "", "addr can't be empty")
+	check(cfg.Bans.Message != "", "bans.message can't be empty")
+	check(cfg.IPParam == "never" || cfg.IPParam == "same_family" || cfg.IPParam == "always",
+		"ip_param must be \"never\", \"same_family\" or \"always\", got %q", cfg.IPParam)
+	if _, err := ParseNetworks(cfg.TrustedProxies); err != nil {
+		check(false, "trusted_proxies: %v", err)
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+/*
+ * Reloading
+ *
+ * Values that are safe to change while running are read through Current, and replaced together when the
+ * config file is reloaded. The others are only read from Loaded, and need a restart to change.
+ */
+
+var current atomic.Value // *TrackerConfig
+
+func init() {
+	current.Store(&Loaded)
+}
+
+// Current returns the config in effect, which must not be modified.
+func Current() *TrackerConfig {
+	return current.Load().(*TrackerConfig)
+}
+
+// Swap puts cfg in effect and returns the config it replaced, like Reload without reading the config file.
+// cfg must not be modified afterwards.
+func Swap(cfg *TrackerConfig) *TrackerConfig {
+	old := Current()
+	current.Store(cfg)
+	return old
+}
+
+// Reload reads and validates the config file again, and swaps in the values that can change while running.
+// It returns the keys of changed values that need a restart to apply. Nothing changes if an error is returned.
+func Reload(path string) (restart []string, err error) {
+	cfg, err := load(defaults, path)
 	if err != nil {
 		return
 	}
-	log.Printf("Successfully loaded config file.")
+
+	old := Current()
+	next := *old
+	next.Intervals = cfg.Intervals
+	next.Logging = cfg.Logging
+	next.RateLimits = cfg.RateLimits
+	next.Bans = cfg.Bans
+	next.TrustedProxies = cfg.TrustedProxies
+	next.IPParam = cfg.IPParam
+	next.LogFlushes = cfg.LogFlushes
+	next.SlotsEnabled = cfg.SlotsEnabled
+	next.AdminKey = cfg.AdminKey
+	next.MaxDeadlockRetries = cfg.MaxDeadlockRetries
+	next.MaxFlushRetries = cfg.MaxFlushRetries
+	next.SnapshotCompression = cfg.SnapshotCompression
+	next.UDPScrape = cfg.UDPScrape
+
+	changed := map[string]bool{
+		"backend":          cfg.Backend != old.Backend,
+		"memory_fixture":   cfg.MemoryFixture != old.MemoryFixture,
+		"database":         cfg.Database != old.Database,
+		"sizes":            cfg.FlushSizes != old.FlushSizes,
+		"addr":             cfg.BindAddress != old.BindAddress,
+		"udp_addr":         cfg.UDPBindAddress != old.UDPBindAddress,
+		"journal_path":     cfg.JournalPath != old.JournalPath,
+		"dead_letter_path": cfg.DeadLetterPath != old.DeadLetterPath,
+	}
+	for key, isChanged := range changed {
+		if isChanged {
+			restart = append(restart, key)
+		}
+	}
+	sort.Strings(restart)
+
+	current.Store(&next)
 	return
 }
 
-// Default TrackerConfig
+// The TrackerConfig the tracker was started with, read for the values that need a restart to change
 var Loaded = TrackerConfig{
+	Backend:       "mysql",
+	MemoryFixture: "",
 	Database: TrackerDatabase{
 		Username: "root",
 		Password: "",
@@ -111,11 +416,15 @@ var Loaded = TrackerConfig{
 		Announce:              TrackerDuration{30 * time.Minute},
 		MinAnnounce:           TrackerDuration{15 * time.Minute},
 		DatabaseReload:        TrackerDuration{45 * time.Second},
+		FullDatabaseReload:    TrackerDuration{15 * time.Minute},
 		DatabaseSerialization: TrackerDuration{time.Minute},
 		PurgeInactive:         TrackerDuration{time.Minute},
 		VerifyUsedSlots:       3600,
 		FlushSleep:            TrackerDuration{3 * time.Second},
 		DeadlockWait:          TrackerDuration{time.Second},
+		JournalSync:           TrackerDuration{time.Second},
+		FlushRetryWait:        TrackerDuration{5 * time.Second},
+		ShutdownTimeout:       TrackerDuration{30 * time.Second},
 	},
 	FlushSizes: TrackerFlushBufferSizes{
 		Torrent:         10000,
@@ -124,9 +433,34 @@ var Loaded = TrackerConfig{
 		TransferIps:     1000,
 		Snatch:          100,
 	},
-	LogFlushes:         true,
-	SlotsEnabled:       true,
-	BindAddress:        ":34000",
-	GlobalFreeleech:    false,
-	MaxDeadlockRetries: 10,
+	Logging: TrackerLogging{
+		Format:     "logfmt",
+		Output:     "stderr",
+		Level:      "info",
+		MaxSize:    100,
+		MaxBackups: 5,
+	},
+	RateLimits: TrackerRateLimits{
+		Passkey: TrackerRateLimit{Rate: 1, Burst: 60},
+		IP:      TrackerRateLimit{Rate: 5, Burst: 300},
+	},
+	Bans: TrackerBans{
+		Message: "Your IP address is banned",
+	},
+	TrustedProxies:      []string{"127.0.0.0/8", "::1"},
+	IPParam:             "same_family",
+	LogFlushes:          true,
+	SlotsEnabled:        true,
+	BindAddress:         ":34000",
+	UDPBindAddress:      "",
+	AdminKey:            "",
+	GlobalFreeleech:     false,
+	MaxDeadlockRetries:  10,
+	JournalPath:         "journal",
+	MaxFlushRetries:     5,
+	DeadLetterPath:      "dead_letters",
+	SnapshotCompression: true,
 }
+
+// Reloaded config files are applied on top of the defaults, rather than on top of what was loaded before
+var defaults = Loaded
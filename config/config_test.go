@@ -0,0 +1,110 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, dir, content string) string {
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadExample(t *testing.T) {
+	defer func(old TrackerConfig) { Loaded = old }(Loaded)
+
+	if err := LoadConfig("../config.json.example"); err != nil {
+		t.Fatalf("Failed to load the example config: %v", err)
+	}
+	if Loaded.Intervals.DeadlockWait.Duration != time.Second || Loaded.FlushSizes.Snatch != 100 {
+		t.Errorf("Example config values not loaded: %+v", Loaded)
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	defer func(old TrackerConfig) { Loaded = old }(Loaded)
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configs := map[string]string{
+		`{"buffer_sizes": {}}`:                  "unknown field",
+		`{"intervals": {"announce": "0s"}}`:     "intervals.announce must be positive",
+		`{"intervals": {"flush_sleep": "-1s"}}`: "intervals.flush_sleep must be positive",
+		`{"intervals": {"announce": 30}}`:       "duration must be a string",
+		`{"intervals": {"announce": "30"}}`:     "missing unit in duration",
+		`{"intervals": {"announce": "10m"}}`:    "intervals.min_announce (15m0s) can't be longer than intervals.announce (10m0s)",
+		`{"sizes": {"snatch": 0}}`:              "sizes.snatch must be positive",
+		`{"backend": "postgres"}`:               "backend must be",
+		`{"udp_addr": "34000"}`:                 "udp_addr: address 34000: missing port in address",
+		`{"ip_param": "sometimes"}`:             "ip_param must be",
+		`{"trusted_proxies": ["10.0.0.0/40"]}`:  "trusted_proxies: \"10.0.0.0/40\" isn't an address or CIDR range",
+	}
+	for content, expected := range configs {
+		err := LoadConfig(writeConfig(t, dir, content))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Loading %s returned %v, want %q", content, err, expected)
+		}
+	}
+	if !reflect.DeepEqual(Loaded, defaults) {
+		t.Error("Rejected config changed the loaded values")
+	}
+
+	err = LoadConfig(writeConfig(t, dir, `{"sizes": {"user": -1, "torrent": 0}, "max_deadlock_retries": 0}`))
+	if err == nil || strings.Count(err.Error(), ";") != 2 {
+		t.Errorf("Not every problem reported: %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	defer current.Store(&Loaded)
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	restart, err := Reload(writeConfig(t, dir, `{
+		"intervals": {"announce": "20m"},
+		"slots_enabled": false,
+		"addr": ":35000",
+		"sizes": {"user": 5}
+	}`))
+	if err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+
+	cfg := Current()
+	if cfg.Intervals.Announce.Duration != 20*time.Minute || cfg.SlotsEnabled {
+		t.Errorf("Reloaded values not applied: %+v", cfg.Intervals)
+	}
+	if cfg.BindAddress != Loaded.BindAddress || cfg.FlushSizes != Loaded.FlushSizes {
+		t.Error("Values needing a restart were applied")
+	}
+	if !reflect.DeepEqual(restart, []string{"addr", "sizes"}) {
+		t.Errorf("Restart needed for %v, want [addr sizes]", restart)
+	}
+
+	if _, err = Reload(writeConfig(t, dir, `{"intervals": {"announce": "0s"}}`)); err == nil {
+		t.Error("Invalid config reloaded")
+	}
+	if Current() != cfg {
+		t.Error("Invalid config replaced the current one")
+	}
+}
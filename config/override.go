@@ -0,0 +1,197 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Every config value can be overridden by an environment variable named after its JSON keys, like
+ * CHIHAYA_DATABASE_ADDR for database.addr. With a _FILE suffix, the variable holds the path of a file
+ * with the value instead, for secrets mounted into containers.
+ *
+ * Values are applied in this order, later ones winning: the defaults, the config file, the environment
+ * and the command line (Flags). Overrides are applied again on every reload.
+ *
+ * Variables with the prefix that don't name a config value are ignored, so that a variable left over from
+ * another version doesn't keep the tracker from starting. UnknownEnv lists them to be warned about.
+ */
+
+const envPrefix = "CHIHAYA_"
+
+// An Override replaces a config value from outside the config file.
+type Override struct {
+	Source string // Where the override came from, for errors
+	Key    string // Path of JSON keys, like "database.addr"
+	Value  string
+	File   bool // Value is the path of a file holding the value, read on every load so rotated secrets are picked up
+}
+
+// Flags are the overrides given on the command line, applied after the environment.
+var Flags []Override
+
+var durationType = reflect.TypeOf(TrackerDuration{})
+
+// EnvName returns the environment variable overriding the value of the given key.
+func EnvName(key string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+func applyOverrides(cfg *TrackerConfig, environ []string) error {
+	fields := make(map[string]reflect.Value)
+	configFields(reflect.ValueOf(cfg).Elem(), "", fields)
+
+	overrides, _ := envOverrides(fields, environ)
+	for _, override := range append(overrides, Flags...) {
+		field, exists := fields[override.Key]
+		if !exists {
+			return fmt.Errorf("%s: unknown config key %q", override.Source, override.Key)
+		}
+
+		value := override.Value
+		if override.File {
+			data, err := ioutil.ReadFile(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", override.Source, err)
+			}
+			value = strings.TrimRight(string(data), "\r\n")
+		}
+
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("%s: %v", override.Source, err)
+		}
+	}
+	return nil
+}
+
+// configFields maps the JSON key paths of all values in a config struct to its fields.
+func configFields(v reflect.Value, prefix string, fields map[string]reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct && field.Type() != durationType {
+			configFields(field, key, fields)
+		} else {
+			fields[key] = field
+		}
+	}
+}
+
+// UnknownEnv returns the environment variables with the CHIHAYA_ prefix that don't override any config value.
+func UnknownEnv() []string {
+	cfg := defaults
+	fields := make(map[string]reflect.Value)
+	configFields(reflect.ValueOf(&cfg).Elem(), "", fields)
+
+	_, unknown := envOverrides(fields, os.Environ())
+	return unknown
+}
+
+func envOverrides(fields map[string]reflect.Value, environ []string) (overrides []Override, unknown []string) {
+	keys := make(map[string]string)
+	for key := range fields {
+		keys[EnvName(key)] = key
+	}
+
+	for _, variable := range environ {
+		if !strings.HasPrefix(variable, envPrefix) {
+			continue
+		}
+		name, value := variable, ""
+		if i := strings.Index(variable, "="); i >= 0 {
+			name, value = variable[:i], variable[i+1:]
+		}
+
+		if key, exists := keys[name]; exists {
+			overrides = append(overrides, Override{Source: name, Key: key, Value: value})
+		} else if key, exists = keys[strings.TrimSuffix(name, "_FILE")]; exists && strings.HasSuffix(name, "_FILE") {
+			overrides = append(overrides, Override{Source: name, Key: key, Value: value, File: true})
+		} else {
+			unknown = append(unknown, name)
+		}
+	}
+	return
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(TrackerDuration{duration}))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+
+	case reflect.Slice:
+		// Comma separated, like "10.0.0.0/8,::1"
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+
+	case reflect.Map:
+		// Comma separated pairs, like "server=debug,flush=info"
+		m := make(map[string]string)
+		for _, pair := range strings.Split(value, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("%q isn't a key=value pair", pair)
+			}
+			m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		field.Set(reflect.ValueOf(m))
+
+	default:
+		return fmt.Errorf("can't override a %s", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverrides(t *testing.T) {
+	defer func() { Flags = nil }()
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passFile := filepath.Join(dir, "pass")
+	if err = ioutil.WriteFile(passFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	Flags = []Override{{Source: "-addr", Key: "addr", Value: ":36000"}}
+	cfg := defaults
+	err = applyOverrides(&cfg, []string{
+		"HOME=/root",
+		"CHIHAYA_ADDR=:35000",
+		"CHIHAYA_DATABASE_PASS_FILE=" + passFile,
+		"CHIHAYA_INTERVALS_MIN_ANNOUNCE=5m",
+		"CHIHAYA_SIZES_USER=50",
+		"CHIHAYA_SLOTS_ENABLED=false",
+		"CHIHAYA_LOGGING_LEVELS=server=debug, flush=warning",
+		"CHIHAYA_TRUSTED_PROXIES=10.0.0.0/8, ::1",
+	})
+	if err != nil {
+		t.Fatalf("Overrides failed: %v", err)
+	}
+
+	if cfg.BindAddress != ":36000" {
+		t.Errorf("Address is %s, flags should win over the environment", cfg.BindAddress)
+	}
+	if cfg.Database.Password != "secret" {
+		t.Errorf("Password is %q, want it read from the file", cfg.Database.Password)
+	}
+	if cfg.Intervals.MinAnnounce.Duration != 5*time.Minute || cfg.FlushSizes.User != 50 || cfg.SlotsEnabled {
+		t.Errorf("Environment not applied: %+v", cfg)
+	}
+	if !reflect.DeepEqual(cfg.Logging.Levels, map[string]string{"server": "debug", "flush": "warning"}) {
+		t.Errorf("Levels are %v", cfg.Logging.Levels)
+	}
+	if !reflect.DeepEqual(cfg.TrustedProxies, []string{"10.0.0.0/8", "::1"}) {
+		t.Errorf("Trusted proxies are %q", cfg.TrustedProxies)
+	}
+}
+
+func TestOverrideErrors(t *testing.T) {
+	environs := map[string]string{
+		"CHIHAYA_SIZES_USER=many":                 "CHIHAYA_SIZES_USER: strconv.ParseInt",
+		"CHIHAYA_INTERVALS_ANNOUNCE=30":           "CHIHAYA_INTERVALS_ANNOUNCE: time: missing unit",
+		"CHIHAYA_DATABASE_PASS_FILE=/nonexistent": "CHIHAYA_DATABASE_PASS_FILE: open /nonexistent",
+	}
+	for variable, expected := range environs {
+		cfg := defaults
+		err := applyOverrides(&cfg, []string{variable})
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Applying %s returned %v, want %q", variable, err, expected)
+		}
+	}
+}
+
+func TestUnknownEnv(t *testing.T) {
+	cfg := defaults
+	err := applyOverrides(&cfg, []string{"CHIHAYA_BIND_ADDR=:35000", "CHIHAYA_ADDR=:36000"})
+	if err != nil || cfg.BindAddress != ":36000" {
+		t.Errorf("Applying an unknown variable returned %v and addr %q, want it ignored", err, cfg.BindAddress)
+	}
+
+	os.Setenv("CHIHAYA_BIND_ADDR", ":35000")
+	defer os.Unsetenv("CHIHAYA_BIND_ADDR")
+	if unknown := UnknownEnv(); len(unknown) != 1 || unknown[0] != "CHIHAYA_BIND_ADDR" {
+		t.Errorf("Unknown variables are %q, want CHIHAYA_BIND_ADDR", unknown)
+	}
+}
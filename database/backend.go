@@ -0,0 +1,154 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"errors"
+
+	"github.com/kotoko/chihaya/config"
+)
+
+/*
+ * A Backend is the persistent store behind a Database.
+ *
+ * The Database keeps users, torrents and peers in memory and only talks to the backend when reloading its caches
+ * and when flushing the updates recorded by announces. The Load methods return fresh records which are merged
+ * into the in-memory caches (torrents are returned without peers). Each Flush method is called with batches
+ * of deltas in the order they were recorded, except for batches that failed and are retried, which may be
+ * flushed concurrently with new ones.
+ *
+ * Between full loads, only the users and torrents that changed are loaded. Changes are tracked with a position
+ * in a change log: ChangePosition is taken before a full load, and each LoadChanges call returns the position
+ * to continue from. Changes may be returned more than once, so applying them has to be idempotent.
+ * Backends without a change log return ErrNoChangeLog from LoadChanges, and are fully loaded on every reload.
+ */
+type Backend interface {
+	LoadUsers() (map[string]*User, error)       // Keyed by passkey
+	LoadTorrents() (map[string]*Torrent, error) // Keyed by info hash
+	LoadClientRules() ([]ClientRule, error)     // Approved and denied clients by peer ID prefix
+	LoadBans() ([]string, error)                // IP addresses and CIDR ranges
+	LoadGlobalFreeleech() (bool, error)
+
+	ChangePosition() (uint64, error)
+	LoadChanges(position uint64) (*Changes, error)
+
+	FlushTorrents(deltas []TorrentDelta) error
+	FlushUsers(deltas []UserDelta) error
+	FlushTransferHistory(deltas []TransferHistoryDelta) error
+	FlushTransferIps(deltas []TransferIpDelta) error
+	FlushSnatches(deltas []SnatchDelta) error
+
+	// MarkStalePeers marks peers that last announced before oldestActive as inactive,
+	// and returns how many were affected.
+	MarkStalePeers(oldestActive int64) (int64, error)
+	UnPrune(torrentId uint64) error
+
+	Close() error
+}
+
+// A RejectedError is returned by the Flush methods when the backend rejected the deltas themselves, as opposed
+// to failing to reach its store. Only rejected batches are split up and dead lettered, the others are retried
+// until the backend is back.
+type RejectedError struct {
+	Err error
+}
+
+func (e *RejectedError) Error() string {
+	return e.Err.Error()
+}
+
+// ErrNoChangeLog is returned by LoadChanges when the backend has no change log.
+var ErrNoChangeLog = errors.New("no change log")
+
+// Changes are the users and torrents that changed after a position in the backend's change log.
+type Changes struct {
+	Users        map[string]*User // Added or updated, keyed by passkey
+	DeletedUsers []uint64         // Deleted or disabled
+
+	Torrents        map[string]*Torrent // Added or updated, keyed by info hash
+	DeletedTorrents []uint64
+
+	Position uint64 // Where the next LoadChanges call should continue from
+}
+
+// OpenBackend creates the backend selected in the config file.
+func OpenBackend() Backend {
+	switch config.Loaded.Backend {
+	case "mysql":
+		return NewMySQLBackend()
+	case "memory":
+		b := NewMemoryBackend()
+		if config.Loaded.MemoryFixture != "" {
+			err := b.LoadFixture(config.Loaded.MemoryFixture)
+			if err != nil {
+				logger.Fatal("Couldn't load memory backend fixture", "err", err)
+			}
+		}
+		return b
+	}
+	logger.Fatal("Unknown database backend", "backend", config.Loaded.Backend)
+	return nil
+}
+
+/*
+ * Deltas are snapshots taken at record time, since the records they come from keep changing until they are flushed.
+ * Counters are deltas to add to the stored values, everything else replaces the stored value.
+ */
+
+type TorrentDelta struct {
+	Id          uint64
+	DeltaSnatch uint64
+	Seeders     int
+	Leechers    int
+	LastAction  int64
+	Deleted     bool // The torrent is gone from the backend, this is the last delta recorded for it
+
+	segment uint64 // Journal segment, committed once the delta is flushed
+}
+
+type UserDelta struct {
+	Id               uint64
+	RawDeltaUpload   int64
+	RawDeltaDownload int64
+	DeltaUpload      int64
+	DeltaDownload    int64
+
+	segment uint64
+}
+
+type TransferHistoryDelta struct {
+	UserId           uint64
+	TorrentId        uint64
+	RawDeltaUpload   int64
+	RawDeltaDownload int64
+	Seeding          bool
+	StartTime        int64
+	LastAnnounce     int64
+	DeltaTime        int64
+	Active           bool
+	DeltaSnatch      uint64
+	Left             uint64
+
+	segment uint64
+}
+
+type TransferIpDelta struct {
+	UserId    uint64
+	TorrentId uint64
+	PeerId    string
+	StartTime int64
+	Ip        string
+	Port      uint
+
+	segment uint64
+}
+
+type SnatchDelta struct {
+	UserId    uint64
+	TorrentId uint64
+	Time      int64
+
+	segment uint64
+}
@@ -0,0 +1,81 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// A BanList holds banned IP addresses and CIDR ranges. It isn't modified once built, so it can be read without locking.
+type BanList struct {
+	addrs map[string]bool // Keyed by the 16 byte form, so IPv4 and IPv4-mapped IPv6 addresses match
+	nets  []*net.IPNet
+}
+
+// NewBanList parses a ban list from addresses and CIDR ranges, skipping the entries that are neither.
+func NewBanList(entries []string) (bans *BanList, invalid []string) {
+	bans = &BanList{addrs: make(map[string]bool)}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+				bans.nets = append(bans.nets, ipNet)
+				continue
+			}
+		} else if ip := net.ParseIP(entry); ip != nil {
+			bans.addrs[string(ip.To16())] = true
+			continue
+		}
+		invalid = append(invalid, entry)
+	}
+	return
+}
+
+// Banned returns whether ip is banned. A nil ip never is.
+func (b *BanList) Banned(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if b.addrs[string(ip.To16())] {
+		return true
+	}
+	for _, ipNet := range b.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of banned addresses and ranges.
+func (b *BanList) Len() int {
+	return len(b.addrs) + len(b.nets)
+}
+
+// readBanFile reads a file with an address or CIDR range per line. Empty lines and lines starting with # are skipped.
+func readBanFile(path string) ([]string, error) {
+	f, err := os.Open(os.ExpandEnv(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			entries = append(entries, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return entries, nil
+}
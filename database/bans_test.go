@@ -0,0 +1,62 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBanList(t *testing.T) {
+	bans, invalid := NewBanList([]string{"10.0.0.1", " 192.168.0.0/16", "2001:db8::/32", "::ffff:172.16.0.1", "not.an.ip", "10.0.0.0/33"})
+	if !reflect.DeepEqual(invalid, []string{"not.an.ip", "10.0.0.0/33"}) {
+		t.Errorf("Invalid entries %q", invalid)
+	}
+	if bans.Len() != 4 {
+		t.Errorf("%d bans, want 4", bans.Len())
+	}
+
+	for ip, expected := range map[string]bool{
+		"10.0.0.1":        true,
+		"10.0.0.2":        false,
+		"::ffff:10.0.0.1": true,
+		"192.168.44.3":    true,
+		"192.169.0.1":     false,
+		"172.16.0.1":      true,
+		"2001:db8:1::5":   true,
+		"2001:db9::1":     false,
+	} {
+		if banned := bans.Banned(net.ParseIP(ip)); banned != expected {
+			t.Errorf("Banned(%s) = %v, want %v", ip, banned, expected)
+		}
+	}
+	if bans.Banned(nil) {
+		t.Error("Unknown address banned")
+	}
+}
+
+func TestReadBanFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bans.txt")
+	if err = ioutil.WriteFile(path, []byte("# Abusive ranges\n10.0.0.0/8\n\n  2001:db8::1  \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readBanFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, []string{"10.0.0.0/8", "2001:db8::1"}) {
+		t.Errorf("Read %q", entries)
+	}
+}
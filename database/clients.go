@@ -0,0 +1,262 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+ * Clients are approved by rules on the prefix of their peer ID, optionally limited to a range of versions.
+ * The rules with the longest prefix matching a peer ID decide, deny rules before allow rules, and a client no rule
+ * matches isn't approved.
+ *
+ * Versions are decoded from Azureus-style peer IDs, where -UT355B- is µTorrent 3.5.5.11, and from Shadow-style
+ * ones, where S58B----- is Shadow 5.8.11. Each character is a component, except for the clients in knownClients
+ * that encode their versions differently, so rule versions are written the way the client numbers its releases:
+ * 2.82 matches Transmission's -TR2820-.
+ */
+
+// ClientNotApproved is the failure reason for clients no rule allows, or deny rules without a note.
+const ClientNotApproved = "Your client is not approved"
+
+// A ClientRule allows or denies the clients with a peer ID prefix.
+type ClientRule struct {
+	Prefix string
+	Name   string // Of the client, for logging
+	Deny   bool
+
+	// Range of versions the rule applies to, from MinVersion up to but excluding MaxVersion. Empty for no bound.
+	// Rules with a version range don't apply to peer IDs a version can't be decoded from.
+	MinVersion string
+	MaxVersion string
+
+	Note string // Failure reason for denied clients
+}
+
+// A Client is the decoded form of a peer ID.
+type Client struct {
+	Id      string // Like "TR" for Azureus-style peer IDs, or "S" for Shadow-style ones
+	Name    string // Empty for clients not in knownClients
+	Version []int
+}
+
+type knownClient struct {
+	name string
+
+	// Decodes the four version characters of clients that don't use one per component, nil for those that do
+	version func(encoded string) ([]int, bool)
+}
+
+// knownClients names the common Azureus-style client IDs
+var knownClients = map[string]knownClient{
+	"AZ": {"Vuze", nil},
+	"BT": {"BitTorrent", nil},
+	"DE": {"Deluge", nil},
+	"KT": {"KTorrent", nil},
+	"LT": {"libtorrent", nil},
+	"lt": {"rTorrent", nil},
+	"qB": {"qBittorrent", nil},
+	"TR": {"Transmission", decodeTransmissionVersion},
+	"UT": {"µTorrent", nil},
+}
+
+// decodeTransmissionVersion decodes -TR2820- as 2.82 and -TR3000- as 3.00, a major version digit followed by two
+// minor version digits, up to Transmission 4, which uses one character per component (-TR4050- is 4.0.5).
+// The last character only marks betas and nightly builds, which are compared as the release.
+func decodeTransmissionVersion(encoded string) ([]int, bool) {
+	if encoded[0] >= '4' {
+		return decodeVersion(encoded)
+	}
+	for i := 0; i < 3; i++ {
+		if encoded[i] < '0' || encoded[i] > '9' {
+			return nil, false
+		}
+	}
+	return []int{int(encoded[0] - '0'), int(encoded[1]-'0')*10 + int(encoded[2]-'0')}, true
+}
+
+const shadowAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+// DecodePeerId decodes the client and version of Azureus-style and Shadow-style peer IDs.
+func DecodePeerId(peerId string) (client Client, ok bool) {
+	if len(peerId) >= 8 && peerId[0] == '-' && peerId[7] == '-' {
+		id := peerId[1:3]
+		known := knownClients[id]
+		decode := known.version
+		if decode == nil {
+			decode = decodeVersion
+		}
+		version, ok := decode(peerId[3:7])
+		return Client{id, known.name, version}, ok && isAlphanumeric(peerId[1]) && isAlphanumeric(peerId[2])
+	}
+
+	// Up to five version characters, padded with dashes to at least the ninth character
+	if len(peerId) >= 9 && isAlphanumeric(peerId[0]) && peerId[6:9] == "---" {
+		end := strings.IndexByte(peerId[1:6], '-')
+		if end == -1 {
+			end = 5
+		}
+		if end == 0 {
+			return
+		}
+		version, ok := decodeVersion(peerId[1 : 1+end])
+		return Client{peerId[:1], "", version}, ok
+	}
+	return
+}
+
+func decodeVersion(encoded string) ([]int, bool) {
+	version := make([]int, len(encoded))
+	for i := 0; i < len(encoded); i++ {
+		version[i] = strings.IndexByte(shadowAlphabet, encoded[i])
+		if version[i] == -1 {
+			return nil, false
+		}
+	}
+	return version, true
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// ParseVersion parses a dotted version, like "2.8.2".
+func ParseVersion(str string) ([]int, error) {
+	var version []int
+	for _, part := range strings.Split(str, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, strconv.ErrSyntax
+		}
+		version = append(version, n)
+	}
+	return version, nil
+}
+
+// compareVersions compares versions component by component, missing components being 0.
+func compareVersions(a []int, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// clientRule is a ClientRule with its versions parsed.
+type clientRule struct {
+	ClientRule
+	min, max []int
+}
+
+func (r *clientRule) matches(client Client, decoded bool) bool {
+	if r.min == nil && r.max == nil {
+		return true
+	}
+	if !decoded {
+		return false
+	}
+	return (r.min == nil || compareVersions(client.Version, r.min) >= 0) &&
+		(r.max == nil || compareVersions(client.Version, r.max) < 0)
+}
+
+type clientNode struct {
+	children map[byte]*clientNode
+	rules    []*clientRule // Deny rules first
+}
+
+// A ClientPolicy is a trie of client rules by peer ID prefix. It isn't modified once built,
+// so it can be read without locking.
+type ClientPolicy struct {
+	root  clientNode
+	rules []ClientRule
+}
+
+// NewClientPolicy builds a policy from rules, skipping the ones with versions that don't parse.
+func NewClientPolicy(rules []ClientRule) (policy *ClientPolicy, invalid []ClientRule) {
+	policy = &ClientPolicy{}
+	for _, rule := range rules {
+		parsed := &clientRule{ClientRule: rule}
+		var err error
+		if rule.MinVersion != "" {
+			parsed.min, err = ParseVersion(rule.MinVersion)
+		}
+		if err == nil && rule.MaxVersion != "" {
+			parsed.max, err = ParseVersion(rule.MaxVersion)
+		}
+		if err != nil || rule.Prefix == "" {
+			invalid = append(invalid, rule)
+			continue
+		}
+
+		node := &policy.root
+		for i := 0; i < len(rule.Prefix); i++ {
+			child, exists := node.children[rule.Prefix[i]]
+			if !exists {
+				if node.children == nil {
+					node.children = make(map[byte]*clientNode)
+				}
+				child = &clientNode{}
+				node.children[rule.Prefix[i]] = child
+			}
+			node = child
+		}
+		if rule.Deny {
+			node.rules = append([]*clientRule{parsed}, node.rules...)
+		} else {
+			node.rules = append(node.rules, parsed)
+		}
+		policy.rules = append(policy.rules, rule)
+	}
+	return
+}
+
+// Rules returns the rules the policy was built from, in their original order.
+func (p *ClientPolicy) Rules() []ClientRule {
+	return p.rules
+}
+
+// Check returns whether the client with the given peer ID is approved, and the failure reason if it isn't.
+func (p *ClientPolicy) Check(peerId string) (approved bool, reason string) {
+	client, decoded := DecodePeerId(peerId)
+
+	// The rules on the path to the deepest node matching the peer ID, with the longest prefix last
+	var path []*clientNode
+	node := &p.root
+	for i := 0; i < len(peerId); i++ {
+		if node = node.children[peerId[i]]; node == nil {
+			break
+		}
+		path = append(path, node)
+	}
+
+	for i := len(path) - 1; i >= 0; i-- {
+		for _, rule := range path[i].rules {
+			if !rule.matches(client, decoded) {
+				continue
+			}
+			if !rule.Deny {
+				return true, ""
+			}
+			if rule.Note != "" {
+				return false, rule.Note
+			}
+			return false, ClientNotApproved
+		}
+	}
+	return false, ClientNotApproved
+}
@@ -0,0 +1,73 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodePeerId(t *testing.T) {
+	peerIds := map[string]Client{
+		"-TR2820-abcdefghijkl": {"TR", "Transmission", []int{2, 82}},
+		"-TR300Z-abcdefghijkl": {"TR", "Transmission", []int{3, 0}},
+		"-TR4050-abcdefghijkl": {"TR", "Transmission", []int{4, 0, 5, 0}},
+		"-UT355B-abcdefghijkl": {"UT", "µTorrent", []int{3, 5, 5, 11}},
+		"-XX1230-abcdefghijkl": {"XX", "", []int{1, 2, 3, 0}},
+		"S58B-----abcdefghijk": {"S", "", []int{5, 8, 11}},
+		"T03I-----abcdefghijk": {"T", "", []int{0, 3, 18}},
+		"A310-----abcdefghijk": {"A", "", []int{3, 1, 0}},
+	}
+	for peerId, expected := range peerIds {
+		if client, ok := DecodePeerId(peerId); !ok || !reflect.DeepEqual(client, expected) {
+			t.Errorf("Decoded %q as %+v (%v), want %+v", peerId, client, ok, expected)
+		}
+	}
+
+	for _, peerId := range []string{"M4-3-6--abcdefghijkl", "-TR2820", "-T#2820-abcdefghijkl", "-TR28!0-abcdefghijkl", "-TR2A20-abcdefghijkl", "exbc\x01\x02abcdefghijkl", "S--------"} {
+		if client, ok := DecodePeerId(peerId); ok {
+			t.Errorf("Decoded %q as %+v", peerId, client)
+		}
+	}
+}
+
+func TestClientPolicy(t *testing.T) {
+	policy, invalid := NewClientPolicy([]ClientRule{
+		{Prefix: "-TR"},
+		{Prefix: "-TR", Deny: true, MaxVersion: "2.82", Note: "Update Transmission"},
+		{Prefix: "-TR2840", Deny: true},
+		{Prefix: "-UT", MinVersion: "3.5", MaxVersion: "4"},
+		{Prefix: "M4-"},
+		{Prefix: "-DE", MinVersion: "one"},
+		{Prefix: ""},
+	})
+	if len(invalid) != 2 || len(policy.Rules()) != 5 {
+		t.Errorf("Invalid rules %+v", invalid)
+	}
+
+	checks := []struct {
+		peerId   string
+		approved bool
+		reason   string
+	}{
+		{"-TR2820-abcdefghijkl", true, ""},
+		{"-TR2940-abcdefghijkl", true, ""},
+		{"-TR2810-abcdefghijkl", false, "Update Transmission"},
+		{"-TR1920-abcdefghijkl", false, "Update Transmission"},
+		{"-TR2840-abcdefghijkl", false, ClientNotApproved}, // Longest prefix first
+		{"-UT3550-abcdefghijkl", true, ""},
+		{"-UT3400-abcdefghijkl", false, ClientNotApproved},
+		{"-UT4000-abcdefghijkl", false, ClientNotApproved},
+		{"-UT35%0-abcdefghijkl", false, ClientNotApproved}, // No version, so the range doesn't apply
+		{"M4-3-6--abcdefghijkl", true, ""},
+		{"-DE1350-abcdefghijkl", false, ClientNotApproved},
+		{"-T", false, ClientNotApproved},
+	}
+	for _, check := range checks {
+		if approved, reason := policy.Check(check.peerId); approved != check.approved || reason != check.reason {
+			t.Errorf("Check(%q) = %v, %q, want %v, %q", check.peerId, approved, reason, check.approved, check.reason)
+		}
+	}
+}
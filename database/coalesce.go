@@ -0,0 +1,98 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+/*
+ * An announce records a delta for its user, torrent and transfer history row, so a batch usually holds many deltas
+ * for the same rows. They're merged into one row each before flushing, which keeps the queries short and means
+ * fewer row locks. Counters are added up and every other value is taken from the last delta, as if they had been
+ * flushed one after the other.
+ *
+ * The deltas in a batch are still committed to the journal and retried one by one, merging only happens when
+ * they're handed to the backend.
+ */
+
+func coalesceTorrents(deltas []TorrentDelta) []TorrentDelta {
+	rows := make([]TorrentDelta, 0, len(deltas))
+	index := make(map[uint64]int, len(deltas))
+
+	for _, delta := range deltas {
+		// A deleted torrent may be added again later on, so deltas aren't merged across its deletion
+		if delta.Deleted {
+			delete(index, delta.Id)
+			rows = append(rows, delta)
+			continue
+		}
+
+		i, exists := index[delta.Id]
+		if !exists {
+			index[delta.Id] = len(rows)
+			rows = append(rows, delta)
+			continue
+		}
+
+		row := &rows[i]
+		row.DeltaSnatch += delta.DeltaSnatch
+		row.Seeders = delta.Seeders
+		row.Leechers = delta.Leechers
+		if delta.LastAction > row.LastAction {
+			row.LastAction = delta.LastAction
+		}
+	}
+	return rows
+}
+
+func coalesceUsers(deltas []UserDelta) []UserDelta {
+	rows := make([]UserDelta, 0, len(deltas))
+	index := make(map[uint64]int, len(deltas))
+
+	for _, delta := range deltas {
+		i, exists := index[delta.Id]
+		if !exists {
+			index[delta.Id] = len(rows)
+			rows = append(rows, delta)
+			continue
+		}
+
+		row := &rows[i]
+		row.RawDeltaUpload += delta.RawDeltaUpload
+		row.RawDeltaDownload += delta.RawDeltaDownload
+		row.DeltaUpload += delta.DeltaUpload
+		row.DeltaDownload += delta.DeltaDownload
+	}
+	return rows
+}
+
+type transferHistoryKey struct {
+	userId    uint64
+	torrentId uint64
+}
+
+func coalesceTransferHistory(deltas []TransferHistoryDelta) []TransferHistoryDelta {
+	rows := make([]TransferHistoryDelta, 0, len(deltas))
+	index := make(map[transferHistoryKey]int, len(deltas))
+
+	for _, delta := range deltas {
+		key := transferHistoryKey{delta.UserId, delta.TorrentId}
+		i, exists := index[key]
+		if !exists {
+			index[key] = len(rows)
+			rows = append(rows, delta)
+			continue
+		}
+
+		// The start time is only written when the row is inserted, so the first one is kept
+		row := &rows[i]
+		row.RawDeltaUpload += delta.RawDeltaUpload
+		row.RawDeltaDownload += delta.RawDeltaDownload
+		row.DeltaTime += delta.DeltaTime
+		row.DeltaSnatch += delta.DeltaSnatch
+		row.Seeding = delta.Seeding
+		row.LastAnnounce = delta.LastAnnounce
+		row.Active = delta.Active
+		row.Left = delta.Left
+	}
+	return rows
+}
@@ -0,0 +1,65 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCoalesceUsers(t *testing.T) {
+	rows := coalesceUsers([]UserDelta{
+		{Id: 1, RawDeltaUpload: 10, RawDeltaDownload: 1, DeltaUpload: 20, DeltaDownload: 2},
+		{Id: 2, RawDeltaUpload: 5},
+		{Id: 1, RawDeltaUpload: 30, RawDeltaDownload: 3, DeltaUpload: 60, DeltaDownload: 6},
+	})
+
+	expected := []UserDelta{
+		{Id: 1, RawDeltaUpload: 40, RawDeltaDownload: 4, DeltaUpload: 80, DeltaDownload: 8},
+		{Id: 2, RawDeltaUpload: 5},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("Coalesced to %+v, want %+v", rows, expected)
+	}
+}
+
+func TestCoalesceTorrents(t *testing.T) {
+	rows := coalesceTorrents([]TorrentDelta{
+		{Id: 1, DeltaSnatch: 1, Seeders: 5, Leechers: 2, LastAction: 200},
+		{Id: 1, DeltaSnatch: 1, Seeders: 6, Leechers: 1, LastAction: 100},
+		{Id: 2, Seeders: 1, LastAction: 100},
+		{Id: 2, Deleted: true},
+		{Id: 2, Seeders: 3, LastAction: 300},
+	})
+
+	expected := []TorrentDelta{
+		{Id: 1, DeltaSnatch: 2, Seeders: 6, Leechers: 1, LastAction: 200},
+		{Id: 2, Seeders: 1, LastAction: 100},
+		{Id: 2, Deleted: true},
+		{Id: 2, Seeders: 3, LastAction: 300},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("Coalesced to %+v, want %+v", rows, expected)
+	}
+}
+
+func TestCoalesceTransferHistory(t *testing.T) {
+	rows := coalesceTransferHistory([]TransferHistoryDelta{
+		{UserId: 1, TorrentId: 1, RawDeltaUpload: 10, StartTime: 100, LastAnnounce: 100, DeltaTime: 0, Active: true, Left: 50},
+		{UserId: 1, TorrentId: 2, RawDeltaUpload: 1, StartTime: 150, LastAnnounce: 150, Active: true},
+		{UserId: 1, TorrentId: 1, RawDeltaUpload: 20, RawDeltaDownload: 50, StartTime: 100, LastAnnounce: 200,
+			DeltaTime: 100, DeltaSnatch: 1, Seeding: true, Active: true},
+		{UserId: 1, TorrentId: 1, StartTime: 100, LastAnnounce: 200, Seeding: true},
+	})
+
+	expected := []TransferHistoryDelta{
+		{UserId: 1, TorrentId: 1, RawDeltaUpload: 30, RawDeltaDownload: 50, StartTime: 100, LastAnnounce: 200,
+			DeltaTime: 100, DeltaSnatch: 1, Seeding: true},
+		{UserId: 1, TorrentId: 2, RawDeltaUpload: 1, StartTime: 150, LastAnnounce: 150, Active: true},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("Coalesced to %+v, want %+v", rows, expected)
+	}
+}
@@ -6,15 +6,19 @@
 package database
 
 import (
-	"bytes"
-	"log"
+	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/kotoko/chihaya/bufferpool"
-	"github.com/kotoko/chihaya/config"
-	"github.com/ziutek/mymysql/mysql"
-	_ "github.com/ziutek/mymysql/native"
+	"github.com/kotoko/chihaya/logging"
+)
+
+var (
+	logger        = logging.New("database")
+	flushLogger   = logging.New("flush")
+	journalLogger = logging.New("journal")
+	mysqlLogger   = logging.New("mysql")
 )
 
 type Peer struct {
@@ -22,9 +26,11 @@ type Peer struct {
 	UserId    uint64
 	TorrentId uint64
 
-	Port uint
-	Ip   string
-	Addr []byte
+	Port  uint
+	Ip    string // IPv4 address, empty if the peer has none
+	Ip6   string // IPv6 address, empty if the peer has none
+	Addr  []byte // Compact IPv4 address and port (6 bytes)
+	Addr6 []byte // Compact IPv6 address and port (18 bytes)
 
 	Uploaded   uint64
 	Downloaded uint64
@@ -33,9 +39,25 @@ type Peer struct {
 
 	StartTime    int64 // unix time
 	LastAnnounce int64
+
+	// Where Ip and Ip6 came from, one of the IpFrom constants
+	IpFrom  string
+	Ip6From string
 }
 
+const (
+	IpFromConnection = "connection" // The address the request came from
+	IpFromProxy      = "proxy"      // Forwarded by a trusted proxy
+	IpFromParam      = "param"      // Given by the client
+)
+
+/*
+ * Announces only read lock the torrents map, so the swarm of each torrent is guarded by its own mutex.
+ * Code holding the write lock on the map has every torrent to itself and doesn't need to lock them.
+ */
 type Torrent struct {
+	mutex sync.RWMutex // Unexported, so it isn't serialized
+
 	Id             uint64
 	UpMultiplier   float64
 	DownMultiplier float64
@@ -48,6 +70,22 @@ type Torrent struct {
 	LastAction int64
 }
 
+func (t *Torrent) Lock() {
+	t.mutex.Lock()
+}
+
+func (t *Torrent) Unlock() {
+	t.mutex.Unlock()
+}
+
+func (t *Torrent) RLock() {
+	t.mutex.RLock()
+}
+
+func (t *Torrent) RUnlock() {
+	t.mutex.RUnlock()
+}
+
 type User struct {
 	Id             uint64
 	UpMultiplier   float64
@@ -58,22 +96,31 @@ type User struct {
 	SlotsLastChecked int64
 }
 
-type DatabaseConnection struct {
-	sqlDb mysql.Conn
-	mutex sync.Mutex
+/*
+ * A user can announce on several torrents at once, so Slots, UsedSlots and SlotsLastChecked are read and written
+ * atomically. A slot is taken with a compare and swap, so concurrent announces can't take more than there are.
+ */
+
+// TakeSlot counts a new leecher of the user. If limited, it fails when the user has no slots free.
+func (u *User) TakeSlot(limited bool) bool {
+	for {
+		used := atomic.LoadInt64(&u.UsedSlots)
+		if slots := atomic.LoadInt64(&u.Slots); limited && slots != -1 && used >= slots {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&u.UsedSlots, used, used+1) {
+			return true
+		}
+	}
 }
 
 type Database struct {
-	terminate bool
+	// Canceled by Terminate, which stops the background loops
+	ctx    context.Context
+	cancel context.CancelFunc
 
-	mainConn *DatabaseConnection // Used for reloading and misc queries
-
-	loadUsersStmt       mysql.Stmt
-	loadTorrentsStmt    mysql.Stmt
-	loadWhitelistStmt   mysql.Stmt
-	loadFreeleechStmt   mysql.Stmt
-	cleanStalePeersStmt mysql.Stmt
-	unPruneTorrentStmt  mysql.Stmt
+	backend        Backend
+	changePosition uint64 // Where the next incremental reload continues from
 
 	Users      map[string]*User // 32 bytes
 	UsersMutex sync.RWMutex
@@ -81,165 +128,161 @@ type Database struct {
 	Torrents      map[string]*Torrent // SHA-1 hash (20 bytes)
 	TorrentsMutex sync.RWMutex
 
-	Whitelist      []string
-	WhitelistMutex sync.RWMutex
+	// Replaced as a whole on reload and by admin changes
+	Clients      *ClientPolicy
+	ClientsMutex sync.RWMutex
+
+	// Replaced as a whole on reload, from the backend and the ban file
+	Bans      *BanList
+	BansMutex sync.RWMutex
 
-	torrentChannel          chan *bytes.Buffer
-	userChannel             chan *bytes.Buffer
-	transferHistoryChannel  chan *bytes.Buffer
-	transferIpsChannel      chan *bytes.Buffer
-	snatchChannel           chan *bytes.Buffer
+	torrentChannel          chan TorrentDelta
+	userChannel             chan UserDelta
+	transferHistoryChannel  chan TransferHistoryDelta
+	transferIpsChannel      chan TransferIpDelta
+	snatchChannel           chan SnatchDelta
 	slotVerificationChannel chan *User
 
-	waitGroup                sync.WaitGroup
-	transferHistoryWaitGroup sync.WaitGroup
+	// Held for reading while deltas are queued, so Terminate can't close the channels under a sender
+	recording sync.RWMutex
+	closed    bool
+
+	journal   *journal // nil if journaling is disabled
+	handedOff bool     // A new process took over the snapshot
 
-	bufferPool *bufferpool.BufferPool
+	failedBatches   map[string][]*failedBatch // Keyed by channel label
+	failedMutex     sync.Mutex
+	deadLetterMutex sync.Mutex
+
+	workers                  sync.WaitGroup // Background loops
+	waitGroup                sync.WaitGroup // Flush routines
+	transferHistoryWaitGroup sync.WaitGroup
 }
 
-func (db *Database) Init() {
-	db.terminate = false
+func (db *Database) Init(backend Backend) {
+	db.ctx, db.cancel = context.WithCancel(context.Background())
+	db.closed = false
+	db.handedOff = false
 
-	db.mainConn = OpenDatabaseConnection()
+	db.backend = backend
 
-	maxBuffers := config.Loaded.FlushSizes.Torrent + config.Loaded.FlushSizes.User + config.Loaded.FlushSizes.TransferHistory +
-		config.Loaded.FlushSizes.TransferIps + config.Loaded.FlushSizes.Snatch
+	db.Users = make(map[string]*User)
+	db.Torrents = make(map[string]*Torrent)
+	db.Clients, _ = NewClientPolicy(nil)
+	db.Bans, _ = NewBanList(nil)
 
-	// Used for recording updates, so the max required size should be < 128 bytes. See record.go for details
-	db.bufferPool = bufferpool.New(maxBuffers, 128)
+	db.deserialize()
+	db.openJournal(true)
 
-	db.loadUsersStmt = db.mainConn.prepareStatement("SELECT ID, torrent_pass, DownMultiplier, UpMultiplier, Slots FROM users_main WHERE Enabled='1'")
-	db.loadTorrentsStmt = db.mainConn.prepareStatement("SELECT ID, info_hash, DownMultiplier, UpMultiplier, Snatched, Status FROM torrents")
-	db.loadWhitelistStmt = db.mainConn.prepareStatement("SELECT peer_id FROM xbt_client_whitelist")
-	db.loadFreeleechStmt = db.mainConn.prepareStatement("SELECT mod_setting FROM mod_core WHERE mod_option='global_freeleech'")
-	db.cleanStalePeersStmt = db.mainConn.prepareStatement("UPDATE transfer_history SET active = '0' WHERE last_announce < ? AND active='1'")
-	db.unPruneTorrentStmt = db.mainConn.prepareStatement("UPDATE torrents SET Status=0 WHERE ID = ?")
+	db.startReloading(true)
+	db.startSerializing()
+	db.startFlushing()
+}
+
+/*
+ * InitHandedOff starts from the snapshot written by the process handing off (see HandOff), which is current,
+ * so announces can be answered right away while the backend is reloaded in the background. The old process
+ * is still flushing the deltas in its journal segments, so whatever it leaves in them is only queued once
+ * previous is closed, after it exited.
+ */
+func (db *Database) InitHandedOff(backend Backend, previous <-chan struct{}) {
+	db.ctx, db.cancel = context.WithCancel(context.Background())
+	db.closed = false
+	db.handedOff = false
+
+	db.backend = backend
 
 	db.Users = make(map[string]*User)
 	db.Torrents = make(map[string]*Torrent)
-	db.Whitelist = make([]string, 0, 100)
+	db.Clients, _ = NewClientPolicy(nil)
+	db.Bans, _ = NewBanList(nil)
 
 	db.deserialize()
+	segments := db.openJournal(false)
 
-	db.startReloading()
+	db.startReloading(false)
 	db.startSerializing()
 	db.startFlushing()
+
+	db.startWorker(func() {
+		select {
+		case <-db.ctx.Done():
+			// The segments are replayed on the next start instead
+		case <-previous:
+			db.adoptSegments(segments)
+		}
+	})
 }
 
+/*
+ * HandOff is called once announces stopped, when a new process takes over. The background loops are stopped,
+ * the journal is sealed and the caches are serialized for the new process to start from. Terminate then flushes
+ * the queues as usual, but leaves the snapshot alone, since the new process owns it from then on.
+ */
+func (db *Database) HandOff() {
+	db.cancel()
+	db.workers.Wait()
+
+	db.journal.seal()
+	db.serialize()
+	db.handedOff = true
+}
+
+/*
+ * Terminate stops the background loops, letting a reload or purge in progress finish, then closes the flush channels
+ * and waits for the flush routines to drain them. Deltas recorded after that are dropped, so it must only be called
+ * once announces stopped. The caches are serialized last, unless they were handed off.
+ */
 func (db *Database) Terminate() {
-	db.terminate = true
+	db.cancel()
+	db.workers.Wait()
 
+	db.recording.Lock()
+	db.closed = true
 	close(db.torrentChannel)
 	close(db.userChannel)
 	close(db.transferHistoryChannel)
 	close(db.transferIpsChannel)
 	close(db.snatchChannel)
 	close(db.slotVerificationChannel)
+	db.recording.Unlock()
 
 	go func() {
 		time.Sleep(10 * time.Second)
-		log.Printf("Waiting for database flushing to finish. This can take a few minutes, please be patient!")
+		logger.Info("Waiting for database flushing to finish. This can take a few minutes, please be patient!")
 	}()
 
 	db.waitGroup.Wait()
-	db.mainConn.mutex.Lock()
-	db.mainConn.Close()
-	db.mainConn.mutex.Unlock()
-	db.serialize()
-}
-
-func OpenDatabaseConnection() (db *DatabaseConnection) {
-	db = &DatabaseConnection{}
-
-	db.sqlDb = mysql.New(config.Loaded.Database.Proto,
-		"",
-		config.Loaded.Database.Addr,
-		config.Loaded.Database.Username,
-		config.Loaded.Database.Password,
-		config.Loaded.Database.Database,
-	)
-
-	err := db.sqlDb.Connect()
-	if err != nil {
-		log.Fatalf("Couldn't connect to database at %s:%s - %s", config.Loaded.Database.Proto, config.Loaded.Database.Addr, err)
+	db.abandonRetries()
+	db.journal.close()
+	db.backend.Close()
+	if !db.handedOff {
+		db.serialize()
 	}
-	return
 }
 
-func (db *DatabaseConnection) Close() error {
-	return db.sqlDb.Close()
+func (db *Database) terminating() bool {
+	return db.ctx.Err() != nil
 }
 
-func (db *DatabaseConnection) prepareStatement(sql string) mysql.Stmt {
-	stmt, err := db.sqlDb.Prepare(sql)
-	if err != nil {
-		log.Fatalf("%s for SQL: %s", err, sql)
+// sleep waits for the given duration, and returns false if the database was terminated in the meantime.
+func (db *Database) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-db.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
 	}
-	return stmt
 }
 
-/*
- * mymysql uses different semantics than the database/sql interface
- * For some reason (for prepared statements), mymysql's Exec is the equivalent of Query, and Run is the equivalent of Exec.
- * For the connection object, Query is still Query, but Start is Exec
- *
- * This is really confusing, which is why these wrapper functions are named as such
- */
-
-func (db *DatabaseConnection) query(stmt mysql.Stmt, args ...interface{}) mysql.Result {
-	return db.exec(stmt, args...)
-}
-
-func (db *DatabaseConnection) exec(stmt mysql.Stmt, args ...interface{}) (result mysql.Result) {
-	var err error
-	var tries int
-	var wait int64
-
-	for tries = 0; tries < config.Loaded.MaxDeadlockRetries; tries++ {
-		result, err = stmt.Run(args...)
-		if err != nil {
-			if merr, isMysqlError := err.(*mysql.Error); isMysqlError {
-				if merr.Code == 1213 || merr.Code == 1205 {
-					wait = config.Loaded.Intervals.DeadlockWait.Nanoseconds() * int64(tries+1)
-					log.Printf("!!! DEADLOCK !!! Retrying in %dms (%d/20)", wait/1000000, tries)
-					time.Sleep(time.Duration(wait))
-					continue
-				} else {
-					log.Printf("!!! CRITICAL !!! SQL error: %v", err)
-				}
-			} else {
-				log.Panicf("Error executing SQL: %v", err)
-			}
-		}
-		return
-	}
-	log.Printf("!!! CRITICAL !!! Deadlocked %d times, giving up!", tries)
-	return
-}
-
-func (db *DatabaseConnection) execBuffer(query *bytes.Buffer) (result mysql.Result) {
-	var err error
-	var tries int
-	var wait int64
-
-	for tries = 0; tries < config.Loaded.MaxDeadlockRetries; tries++ {
-		result, err = db.sqlDb.Start(query.String())
-		if err != nil {
-			if merr, isMysqlError := err.(*mysql.Error); isMysqlError {
-				if merr.Code == 1213 || merr.Code == 1205 {
-					wait = config.Loaded.Intervals.DeadlockWait.Nanoseconds() * int64(tries+1)
-					log.Printf("!!! DEADLOCK !!! Retrying in %dms (%d/20)", wait/1000000, tries)
-					time.Sleep(time.Duration(wait))
-					continue
-				} else {
-					log.Printf("!!! CRITICAL !!! SQL error: %v", err)
-				}
-			} else {
-				log.Panicf("Error executing SQL: %v", err)
-			}
-		}
-		return
-	}
-	log.Printf("!!! CRITICAL !!! Deadlocked %d times, giving up!", tries)
-	return
+// startWorker runs a background loop, which Terminate waits for.
+func (db *Database) startWorker(loop func()) {
+	db.workers.Add(1)
+	go func() {
+		defer db.workers.Done()
+		loop()
+	}()
 }
@@ -0,0 +1,182 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kotoko/chihaya/config"
+)
+
+func TestTerminate(t *testing.T) {
+	// The caches are serialized to the working directory
+	dir, err := ioutil.TempDir("", "database")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	defer func(old config.TrackerIntervals) { config.Loaded.Intervals = old }(config.Loaded.Intervals)
+	config.Loaded.Intervals.FlushSleep.Duration = 10 * time.Millisecond
+	defer func(old string) { config.Loaded.JournalPath = old }(config.Loaded.JournalPath)
+	config.Loaded.JournalPath = ""
+
+	b := newKeepingBackend()
+	db := &Database{}
+	db.Init(b)
+
+	user := &User{Id: 1}
+	db.RecordUser(user, 10, 10, 10, 10)
+
+	// Announces that are still running when the database is terminated
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				db.RecordUser(user, 1, 1, 1, 1)
+				db.VerifyUsedSlots(user)
+			}
+		}
+	}()
+
+	terminated := make(chan struct{})
+	go func() {
+		db.Terminate()
+		close(terminated)
+	}()
+	select {
+	case <-terminated:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Terminate didn't return, the background loops weren't stopped")
+	}
+	close(stop)
+	<-stopped
+
+	deltas := b.UserDeltas()
+	if len(deltas) == 0 || deltas[0].RawDeltaUpload < 10 {
+		t.Errorf("Flushed %+v, want the queued deltas flushed", deltas)
+	}
+	if _, err = os.Stat("user-cache.gob"); err != nil {
+		t.Errorf("Caches not serialized: %v", err)
+	}
+
+	// Dropped rather than sent on a closed channel
+	db.RecordUser(user, 1, 1, 1, 1)
+	if _, err = db.ReplayDeadLetters(); err == nil {
+		t.Error("Dead letters replayed after termination")
+	}
+}
+
+func TestSlotsEnabledByReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "database")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	defer func(old config.TrackerIntervals) { config.Loaded.Intervals = old }(config.Loaded.Intervals)
+	config.Loaded.Intervals.FlushSleep.Duration = 10 * time.Millisecond
+	defer func(old string) { config.Loaded.JournalPath = old }(config.Loaded.JournalPath)
+	config.Loaded.JournalPath = ""
+
+	cfg := *config.Current()
+	cfg.SlotsEnabled = false
+	defer config.Swap(config.Swap(&cfg))
+
+	db := &Database{}
+	db.Init(newKeepingBackend())
+	defer db.Terminate()
+	time.Sleep(50 * time.Millisecond) // Let the workers start while slots are disabled
+
+	enabled := cfg
+	enabled.SlotsEnabled = true
+	config.Swap(&enabled)
+
+	// The slot count drifted, with no peers left
+	user := &User{Id: 1, Slots: 1, UsedSlots: 5}
+	db.VerifyUsedSlots(user)
+	for i := 0; i < 100 && atomic.LoadInt64(&user.UsedSlots) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if used := atomic.LoadInt64(&user.UsedSlots); used != 0 {
+		t.Errorf("%d slots used after verification, want 0", used)
+	}
+}
+
+func TestHandOff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "database")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	defer func(old config.TrackerIntervals) { config.Loaded.Intervals = old }(config.Loaded.Intervals)
+	config.Loaded.Intervals.FlushSleep.Duration = 10 * time.Millisecond
+	defer func(old string) { config.Loaded.JournalPath = old }(config.Loaded.JournalPath)
+	config.Loaded.JournalPath = "journal"
+
+	// The old process can't flush, so its deltas are left in the journal
+	oldBackend := &unreliableBackend{MemoryBackend: newKeepingBackend(), down: true}
+	oldBackend.AddTorrent("infohash1", &Torrent{Id: 1})
+	old := &Database{}
+	old.Init(oldBackend)
+	old.Torrents["infohash1"].Leechers["peer1"] = &Peer{Id: "peer1", UserId: 1, TorrentId: 1}
+	old.RecordUser(&User{Id: 1}, 10, 10, 10, 10)
+	old.HandOff()
+
+	b := newKeepingBackend()
+	b.AddTorrent("infohash1", &Torrent{Id: 1})
+	b.AddTorrent("infohash2", &Torrent{Id: 2})
+	previous := make(chan struct{})
+	db := &Database{}
+	db.InitHandedOff(b, previous)
+	defer db.Terminate()
+
+	db.TorrentsMutex.RLock()
+	torrent := db.Torrents["infohash1"]
+	db.TorrentsMutex.RUnlock()
+	if torrent == nil || len(torrent.Leechers) != 1 {
+		t.Fatalf("Started with %+v, want the swarm from the snapshot", torrent)
+	}
+	if db.journal.segment <= old.journal.segment {
+		t.Errorf("New journal segment %d, old one %d", db.journal.segment, old.journal.segment)
+	}
+
+	old.Terminate()
+	close(previous)
+
+	reloaded := func() bool {
+		db.TorrentsMutex.RLock()
+		defer db.TorrentsMutex.RUnlock()
+		return db.Torrents["infohash2"] != nil
+	}
+	for i := 0; i < 100 && (len(b.UserDeltas()) == 0 || !reloaded()); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if deltas := b.UserDeltas(); len(deltas) != 1 || deltas[0].RawDeltaUpload != 10 {
+		t.Errorf("Flushed %+v, want the delta the old process left", deltas)
+	}
+	if !reloaded() {
+		t.Error("Backend not reloaded in the background")
+	}
+}
@@ -5,8 +5,6 @@
 package database
 
 import (
-	"bytes"
-	"log"
 	"sync/atomic"
 	"time"
 
@@ -21,7 +19,8 @@ import (
  *
  * This tradeoff can be adjusted by tweaking the various xFlushBufferSize values to suit the server.
  *
- * Each flush routine now gets its own database connection to maximize update throughput.
+ * Each flush routine hands its batches to the backend from a single goroutine.
+ * Deltas that were flushed are committed to the journal, batches that failed are retried (see retry.go).
  */
 
 /*
@@ -31,167 +30,162 @@ import (
  */
 
 func (db *Database) startFlushing() {
-	db.torrentChannel = make(chan *bytes.Buffer, config.Loaded.FlushSizes.Torrent)
-	db.userChannel = make(chan *bytes.Buffer, config.Loaded.FlushSizes.User)
-	db.transferHistoryChannel = make(chan *bytes.Buffer, config.Loaded.FlushSizes.TransferHistory)
-	db.transferIpsChannel = make(chan *bytes.Buffer, config.Loaded.FlushSizes.TransferIps)
-	db.snatchChannel = make(chan *bytes.Buffer, config.Loaded.FlushSizes.Snatch)
+	db.torrentChannel = make(chan TorrentDelta, config.Loaded.FlushSizes.Torrent)
+	db.userChannel = make(chan UserDelta, config.Loaded.FlushSizes.User)
+	db.transferHistoryChannel = make(chan TransferHistoryDelta, config.Loaded.FlushSizes.TransferHistory)
+	db.transferIpsChannel = make(chan TransferIpDelta, config.Loaded.FlushSizes.TransferIps)
+	db.snatchChannel = make(chan SnatchDelta, config.Loaded.FlushSizes.Snatch)
 	db.slotVerificationChannel = make(chan *User, 100)
 
+	db.waitGroup.Add(5)
 	go db.flushTorrents()
 	go db.flushUsers()
 	go db.flushTransferHistory()
 	go db.flushTransferIps()
 	go db.flushSnatches()
 
-	go db.purgeInactivePeers()
-	go db.startUsedSlotsVerification()
+	db.startWorker(db.retryFlushes)
+	if db.journal != nil {
+		db.startWorker(db.syncJournal)
+	}
+
+	db.startWorker(db.purgeInactivePeers)
+	db.startWorker(db.startUsedSlotsVerification)
 }
 
 func (db *Database) flushTorrents() {
-	var query bytes.Buffer
-	db.waitGroup.Add(1)
 	defer db.waitGroup.Done()
-	var count int
-	conn := OpenDatabaseConnection()
+	deltas := make([]TorrentDelta, 0, config.Loaded.FlushSizes.Torrent)
+	closed := false
 
 	for {
 		length := maxInt(1, len(db.torrentChannel))
-		query.Reset()
+		deltas = deltas[:0]
 
-		query.WriteString("INSERT INTO torrents (ID, Snatched, Seeders, Leechers, last_action) VALUES\n")
-
-		for count = 0; count < length; count++ {
-			b := <-db.torrentChannel
-			if b == nil {
+		for len(deltas) < length {
+			delta, ok := <-db.torrentChannel
+			if !ok {
+				closed = true
 				break
 			}
-			query.Write(b.Bytes())
-			db.bufferPool.Give(b)
-
-			if count != length-1 {
-				query.WriteRune(',')
-			}
+			deltas = append(deltas, delta)
 		}
 
-		if config.Loaded.LogFlushes && !db.terminate {
-			log.Printf("[torrents] Flushing %d\n", count)
+		if config.Current().LogFlushes && !db.terminating() {
+			flushLogger.Info("Flushing", "table", "torrents", "count", len(deltas))
 		}
 
-		if count > 0 {
-			query.WriteString("\nON DUPLICATE KEY UPDATE Snatched = Snatched + VALUES(Snatched), " +
-				"Seeders = VALUES(Seeders), Leechers = VALUES(Leechers), " +
-				"last_action = IF(last_action < VALUES(last_action), VALUES(last_action), last_action);")
-
-			conn.execBuffer(&query)
+		if len(deltas) > 0 {
+			start := time.Now()
+			if err := db.backend.FlushTorrents(coalesceTorrents(deltas)); err != nil {
+				flushLogger.Critical("Flush failed", "table", "torrents", "count", len(deltas), "err", err)
+				flushFailures.Inc("torrents")
+				db.retryLater("torrents", torrentEntries(deltas))
+			} else {
+				for i := range deltas {
+					db.journal.commit(deltas[i].segment)
+				}
+			}
+			flushDuration.ObserveSince("torrents", start)
 
-			if length < (config.Loaded.FlushSizes.Torrent >> 1) {
-				time.Sleep(config.Loaded.Intervals.FlushSleep.Duration)
+			if !closed && length < (config.Loaded.FlushSizes.Torrent>>1) {
+				time.Sleep(config.Current().Intervals.FlushSleep.Duration)
 			}
-		} else if db.terminate {
+		} else if closed {
 			break
 		} else {
 			time.Sleep(time.Second)
 		}
 	}
-
-	conn.Close()
 }
 
 func (db *Database) flushUsers() {
-	var query bytes.Buffer
-	db.waitGroup.Add(1)
 	defer db.waitGroup.Done()
-	var count int
-	conn := OpenDatabaseConnection()
+	deltas := make([]UserDelta, 0, config.Loaded.FlushSizes.User)
+	closed := false
 
 	for {
 		length := maxInt(1, len(db.userChannel))
-		query.Reset()
-
-		query.WriteString("INSERT INTO users_main (ID, Uploaded, Downloaded, rawdl, rawup) VALUES\n")
+		deltas = deltas[:0]
 
-		for count = 0; count < length; count++ {
-			b := <-db.userChannel
-			if b == nil {
+		for len(deltas) < length {
+			delta, ok := <-db.userChannel
+			if !ok {
+				closed = true
 				break
 			}
-			query.Write(b.Bytes())
-			db.bufferPool.Give(b)
-
-			if count != length-1 {
-				query.WriteRune(',')
-			}
+			deltas = append(deltas, delta)
 		}
 
-		if config.Loaded.LogFlushes && !db.terminate {
-			log.Printf("[users_main] Flushing %d\n", count)
+		if config.Current().LogFlushes && !db.terminating() {
+			flushLogger.Info("Flushing", "table", "users_main", "count", len(deltas))
 		}
 
-		if count > 0 {
-			query.WriteString("\nON DUPLICATE KEY UPDATE Uploaded = Uploaded + VALUES(Uploaded), " +
-				"Downloaded = Downloaded + VALUES(Downloaded), rawdl = rawdl + VALUES(rawdl), rawup = rawup + VALUES(rawup);")
-
-			conn.execBuffer(&query)
+		if len(deltas) > 0 {
+			start := time.Now()
+			if err := db.backend.FlushUsers(coalesceUsers(deltas)); err != nil {
+				flushLogger.Critical("Flush failed", "table", "users_main", "count", len(deltas), "err", err)
+				flushFailures.Inc("users_main")
+				db.retryLater("users_main", userEntries(deltas))
+			} else {
+				for i := range deltas {
+					db.journal.commit(deltas[i].segment)
+				}
+			}
+			flushDuration.ObserveSince("users_main", start)
 
-			if length < (config.Loaded.FlushSizes.User >> 1) {
-				time.Sleep(config.Loaded.Intervals.FlushSleep.Duration)
+			if !closed && length < (config.Loaded.FlushSizes.User>>1) {
+				time.Sleep(config.Current().Intervals.FlushSleep.Duration)
 			}
-		} else if db.terminate {
+		} else if closed {
 			break
 		} else {
 			time.Sleep(time.Second)
 		}
 	}
-
-	conn.Close()
 }
 
 func (db *Database) flushTransferHistory() {
-	var query bytes.Buffer
-	db.waitGroup.Add(1)
 	defer db.waitGroup.Done()
-	var count int
-	conn := OpenDatabaseConnection()
+	deltas := make([]TransferHistoryDelta, 0, config.Loaded.FlushSizes.TransferHistory)
+	closed := false
 
 	for {
 		db.transferHistoryWaitGroup.Add(1)
 		length := maxInt(1, len(db.transferHistoryChannel))
-		query.Reset()
+		deltas = deltas[:0]
 
-		query.WriteString("INSERT INTO transfer_history (uid, fid, uploaded, downloaded, " +
-			"seeding, starttime, last_announce, seedtime, active, snatched, remaining) VALUES\n")
-
-		for count = 0; count < length; count++ {
-			b := <-db.transferHistoryChannel
-			if b == nil {
+		for len(deltas) < length {
+			delta, ok := <-db.transferHistoryChannel
+			if !ok {
+				closed = true
 				break
 			}
-			query.Write(b.Bytes())
-			db.bufferPool.Give(b)
-
-			if count != length-1 {
-				query.WriteRune(',')
-			}
+			deltas = append(deltas, delta)
 		}
 
-		if config.Loaded.LogFlushes && !db.terminate {
-			log.Printf("[transfer_history] Flushing %d\n", count)
+		if config.Current().LogFlushes && !db.terminating() {
+			flushLogger.Info("Flushing", "table", "transfer_history", "count", len(deltas))
 		}
 
-		if count > 0 {
-			query.WriteString("\nON DUPLICATE KEY UPDATE uploaded = uploaded + VALUES(uploaded), " +
-				"downloaded = downloaded + VALUES(downloaded), connectable = VALUES(connectable), " +
-				"seeding = VALUES(seeding), seedtime = seedtime + VALUES(seedtime), last_announce = VALUES(last_announce), " +
-				"active = VALUES(active), snatched = snatched + VALUES(snatched), remaining = VALUES(remaining);")
-
-			conn.execBuffer(&query)
+		if len(deltas) > 0 {
+			start := time.Now()
+			if err := db.backend.FlushTransferHistory(coalesceTransferHistory(deltas)); err != nil {
+				flushLogger.Critical("Flush failed", "table", "transfer_history", "count", len(deltas), "err", err)
+				flushFailures.Inc("transfer_history")
+				db.retryLater("transfer_history", transferHistoryEntries(deltas))
+			} else {
+				for i := range deltas {
+					db.journal.commit(deltas[i].segment)
+				}
+			}
+			flushDuration.ObserveSince("transfer_history", start)
 			db.transferHistoryWaitGroup.Done()
 
-			if length < (config.Loaded.FlushSizes.TransferHistory >> 1) {
-				time.Sleep(config.Loaded.Intervals.FlushSleep.Duration)
+			if !closed && length < (config.Loaded.FlushSizes.TransferHistory>>1) {
+				time.Sleep(config.Current().Intervals.FlushSleep.Duration)
 			}
-		} else if db.terminate {
+		} else if closed {
 			db.transferHistoryWaitGroup.Done()
 			break
 		} else {
@@ -199,210 +193,196 @@ func (db *Database) flushTransferHistory() {
 			time.Sleep(time.Second)
 		}
 	}
-
-	conn.Close()
 }
 
 func (db *Database) flushTransferIps() {
-	var query bytes.Buffer
-	db.waitGroup.Add(1)
 	defer db.waitGroup.Done()
-	var count int
-	conn := OpenDatabaseConnection()
+	deltas := make([]TransferIpDelta, 0, config.Loaded.FlushSizes.TransferIps)
+	closed := false
 
 	for {
 		length := maxInt(1, len(db.transferIpsChannel))
-		query.Reset()
-
-		query.WriteString("INSERT INTO transfer_ips (uid, fid, peer_id, starttime, ip, port) VALUES\n")
+		deltas = deltas[:0]
 
-		for count = 0; count < length; count++ {
-			b := <-db.transferIpsChannel
-			if b == nil {
+		for len(deltas) < length {
+			delta, ok := <-db.transferIpsChannel
+			if !ok {
+				closed = true
 				break
 			}
-			query.Write(b.Bytes())
-			db.bufferPool.Give(b)
-
-			if count != length-1 {
-				query.WriteRune(',')
-			}
+			deltas = append(deltas, delta)
 		}
 
-		if config.Loaded.LogFlushes && !db.terminate {
-			log.Printf("[transfer_ips] Flushing %d\n", count)
+		if config.Current().LogFlushes && !db.terminating() {
+			flushLogger.Info("Flushing", "table", "transfer_ips", "count", len(deltas))
 		}
 
-		if count > 0 {
-			query.WriteString("\nON DUPLICATE KEY UPDATE ip = VALUES(ip), port = VALUES(port);")
-
-			conn.execBuffer(&query)
+		if len(deltas) > 0 {
+			start := time.Now()
+			if err := db.backend.FlushTransferIps(deltas); err != nil {
+				flushLogger.Critical("Flush failed", "table", "transfer_ips", "count", len(deltas), "err", err)
+				flushFailures.Inc("transfer_ips")
+				db.retryLater("transfer_ips", transferIpEntries(deltas))
+			} else {
+				for i := range deltas {
+					db.journal.commit(deltas[i].segment)
+				}
+			}
+			flushDuration.ObserveSince("transfer_ips", start)
 
-			if length < (config.Loaded.FlushSizes.TransferIps >> 1) {
-				time.Sleep(config.Loaded.Intervals.FlushSleep.Duration)
+			if !closed && length < (config.Loaded.FlushSizes.TransferIps>>1) {
+				time.Sleep(config.Current().Intervals.FlushSleep.Duration)
 			}
-		} else if db.terminate {
+		} else if closed {
 			break
 		} else {
 			time.Sleep(time.Second)
 		}
 	}
-
-	conn.Close()
 }
 
 func (db *Database) flushSnatches() {
-	var query bytes.Buffer
-	db.waitGroup.Add(1)
 	defer db.waitGroup.Done()
-	var count int
-	conn := OpenDatabaseConnection()
+	deltas := make([]SnatchDelta, 0, config.Loaded.FlushSizes.Snatch)
+	closed := false
 
 	for {
 		length := maxInt(1, len(db.snatchChannel))
-		query.Reset()
-
-		query.WriteString("INSERT INTO transfer_history (uid, fid, snatched_time) VALUES\n")
+		deltas = deltas[:0]
 
-		for count = 0; count < length; count++ {
-			b := <-db.snatchChannel
-			if b == nil {
+		for len(deltas) < length {
+			delta, ok := <-db.snatchChannel
+			if !ok {
+				closed = true
 				break
 			}
-			query.Write(b.Bytes())
-			db.bufferPool.Give(b)
-
-			if count != length-1 {
-				query.WriteRune(',')
-			}
+			deltas = append(deltas, delta)
 		}
 
-		if config.Loaded.LogFlushes && !db.terminate {
-			log.Printf("[snatches] Flushing %d\n", count)
+		if config.Current().LogFlushes && !db.terminating() {
+			flushLogger.Info("Flushing", "table", "snatches", "count", len(deltas))
 		}
 
-		if count > 0 {
-			query.WriteString("\nON DUPLICATE KEY UPDATE snatched_time = VALUES(snatched_time);")
-
-			conn.execBuffer(&query)
+		if len(deltas) > 0 {
+			start := time.Now()
+			if err := db.backend.FlushSnatches(deltas); err != nil {
+				flushLogger.Critical("Flush failed", "table", "snatches", "count", len(deltas), "err", err)
+				flushFailures.Inc("snatches")
+				db.retryLater("snatches", snatchEntries(deltas))
+			} else {
+				for i := range deltas {
+					db.journal.commit(deltas[i].segment)
+				}
+			}
+			flushDuration.ObserveSince("snatches", start)
 
-			if length < (config.Loaded.FlushSizes.Snatch >> 1) {
-				time.Sleep(config.Loaded.Intervals.FlushSleep.Duration)
+			if !closed && length < (config.Loaded.FlushSizes.Snatch>>1) {
+				time.Sleep(config.Current().Intervals.FlushSleep.Duration)
 			}
-		} else if db.terminate {
+		} else if closed {
 			break
 		} else {
 			time.Sleep(time.Second)
 		}
 	}
-
-	conn.Close()
 }
 
 func (db *Database) purgeInactivePeers() {
-	time.Sleep(2 * time.Second)
-
-	for !db.terminate {
-		db.waitGroup.Add(1)
-
+	for wait := 2 * time.Second; db.sleep(wait); wait = config.Current().Intervals.PurgeInactive.Duration {
 		start := time.Now()
-		now := start.Unix()
-		count := 0
-
-		oldestActive := now - 2*int64(config.Loaded.Intervals.Announce.Seconds())
+		oldestActive := start.Unix() - 2*int64(config.Current().Intervals.Announce.Seconds())
 
 		// First, remove inactive peers from memory
-		db.TorrentsMutex.Lock()
-		for _, torrent := range db.Torrents {
-			countThisTorrent := count
-			for id, peer := range torrent.Leechers {
-				if peer.LastAnnounce < oldestActive {
-					delete(torrent.Leechers, id)
-
-					// TODO: possibly optimize this
-					for _, user := range db.Users {
-						if user.Id == peer.UserId {
-							atomic.AddInt64(&user.UsedSlots, -1)
-							break
-						}
-					}
-					count++
-				}
-			}
-			for id, peer := range torrent.Seeders {
-				if peer.LastAnnounce < oldestActive {
-					delete(torrent.Seeders, id)
-					count++
-				}
-			}
-			if countThisTorrent != count {
-				db.RecordTorrent(torrent, 0)
-			}
-		}
-		db.TorrentsMutex.Unlock()
+		count := db.removeInactivePeers(oldestActive)
 
-		log.Printf("Purged %d inactive peers from memory (%dms)\n", count, time.Now().Sub(start).Nanoseconds()/1000000)
+		logger.Info("Purged inactive peers from memory", "peers", count, "duration_ms", time.Now().Sub(start).Nanoseconds()/1000000)
 
 		// Wait on flushing to prevent a race condition where the user has announced but their announce time hasn't been flushed yet
 		db.transferHistoryWaitGroup.Wait()
 
 		// Then set them to inactive in the database
-		db.mainConn.mutex.Lock()
 		start = time.Now()
-		result := db.mainConn.exec(db.cleanStalePeersStmt, oldestActive)
-		rows := result.AffectedRows()
-		db.mainConn.mutex.Unlock()
-
-		if rows > 0 {
-			log.Printf("Updated %d inactive peers in database (%dms)\n", rows, time.Now().Sub(start).Nanoseconds()/1000000)
+		rows, err := db.backend.MarkStalePeers(oldestActive)
+		if err != nil {
+			logger.Critical("Failed to update inactive peers in database", "err", err)
+		} else if rows > 0 {
+			logger.Info("Updated inactive peers in database", "peers", rows, "duration_ms", time.Now().Sub(start).Nanoseconds()/1000000)
 		}
+	}
+}
 
-		db.waitGroup.Done()
-		time.Sleep(config.Loaded.Intervals.PurgeInactive.Duration)
+// removeInactivePeers locks one torrent at a time, so announces on the others aren't held up.
+func (db *Database) removeInactivePeers(oldestActive int64) int {
+	count := 0
+	var leechers []uint64
+
+	db.TorrentsMutex.RLock()
+	for _, torrent := range db.Torrents {
+		countThisTorrent := count
+
+		torrent.Lock()
+		for id, peer := range torrent.Leechers {
+			if peer.LastAnnounce < oldestActive {
+				delete(torrent.Leechers, id)
+				leechers = append(leechers, peer.UserId)
+				count++
+			}
+		}
+		for id, peer := range torrent.Seeders {
+			if peer.LastAnnounce < oldestActive {
+				delete(torrent.Seeders, id)
+				count++
+			}
+		}
+		if countThisTorrent != count {
+			db.RecordTorrent(torrent, 0)
+		}
+		torrent.Unlock()
 	}
+	db.TorrentsMutex.RUnlock()
+
+	db.releaseSlots(leechers)
+	return count
 }
 
 /*
- * Deleting a torrent that a user is leeching will cause their slot count to be incorrect,
- * so the count is verified every so often
+ * Slots are released when peers leave, are purged or their torrent is deleted,
+ * but the count is still verified every so often in case it drifted.
+ * Slots can be enabled by a reload, so the worker always runs and checks the setting per user.
  */
 func (db *Database) startUsedSlotsVerification() {
-	if !config.Loaded.SlotsEnabled {
-		log.Printf("Slots disabled, skipping slot verification")
-		return
-	}
-
 	var slots int64
-	for !db.terminate {
-		user := <-db.slotVerificationChannel
-		if user == nil {
-			break
+	for {
+		var user *User
+		select {
+		case <-db.ctx.Done():
+			return
+		case user = <-db.slotVerificationChannel:
 		}
-		if user.Slots == -1 {
+		if !config.Current().SlotsEnabled || atomic.LoadInt64(&user.Slots) == -1 {
 			continue
 		}
 
-		db.waitGroup.Add(1)
 		userId := user.Id
 
 		slots = 0
 		db.TorrentsMutex.RLock()
 		for _, torrent := range db.Torrents {
+			torrent.RLock()
 			for _, peer := range torrent.Leechers {
 				if peer.UserId == userId {
 					slots++
 				}
 			}
+			torrent.RUnlock()
 		}
 		db.TorrentsMutex.RUnlock()
-		if user.UsedSlots != slots {
-			if user.UsedSlots < slots {
-				log.Printf("!!! WARNING/BUG !!! Negative UsedSlots value (%d < %d) for user %d\n", user.UsedSlots, slots, user.Id)
+		if used := atomic.LoadInt64(&user.UsedSlots); used != slots {
+			if used < slots {
+				logger.Warning("Negative UsedSlots value, this is a bug", "user_id", user.Id, "used_slots", used, "slots", slots)
 			}
 			atomic.StoreInt64(&user.UsedSlots, slots)
-			log.Printf("Fixed used slot cache for user %d", userId)
+			logger.Info("Fixed used slot cache", "user_id", userId)
 		}
-
-		db.waitGroup.Done()
 	}
 }
@@ -0,0 +1,497 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kotoko/chihaya/config"
+)
+
+/*
+ * Deltas are appended to a journal before they're queued for flushing, so they survive a crash or a backend outage.
+ *
+ * The journal is split into numbered segment files, and every delta remembers the segment it was written to.
+ * Once a batch has been flushed, its deltas are committed: segments with nothing left to flush are deleted,
+ * and the segment being written is truncated whenever everything in it has been flushed.
+ *
+ * Entries are written and fsynced in batches every JournalSync, so a crash loses at most that much.
+ * A crash between a flush and its commit flushes that batch again on the next start.
+ */
+
+// Segments are rotated after this many entries, so a backlog doesn't keep the whole journal around
+const journalSegmentEntries = 100000
+
+// journalEntry holds one delta, gob only encodes the field that is set.
+type journalEntry struct {
+	Torrent         *TorrentDelta
+	User            *UserDelta
+	TransferHistory *TransferHistoryDelta
+	TransferIp      *TransferIpDelta
+	Snatch          *SnatchDelta
+}
+
+// label returns the label of the channel the delta is flushed from.
+func (e *journalEntry) label() string {
+	switch {
+	case e.Torrent != nil:
+		return "torrents"
+	case e.User != nil:
+		return "users_main"
+	case e.TransferHistory != nil:
+		return "transfer_history"
+	case e.TransferIp != nil:
+		return "transfer_ips"
+	}
+	return "snatches"
+}
+
+func (e *journalEntry) segment() uint64 {
+	switch {
+	case e.Torrent != nil:
+		return e.Torrent.segment
+	case e.User != nil:
+		return e.User.segment
+	case e.TransferHistory != nil:
+		return e.TransferHistory.segment
+	case e.TransferIp != nil:
+		return e.TransferIp.segment
+	case e.Snatch != nil:
+		return e.Snatch.segment
+	}
+	return 0
+}
+
+func (e *journalEntry) setSegment(segment uint64) {
+	switch {
+	case e.Torrent != nil:
+		e.Torrent.segment = segment
+	case e.User != nil:
+		e.User.segment = segment
+	case e.TransferHistory != nil:
+		e.TransferHistory.segment = segment
+	case e.TransferIp != nil:
+		e.TransferIp.segment = segment
+	case e.Snatch != nil:
+		e.Snatch.segment = segment
+	}
+}
+
+type journal struct {
+	dir string
+
+	// Appends only encode entries into memory under mutex. Writing, truncating and syncing the files is left
+	// to sync, which holds fileMutex instead, so announces never wait on the disk.
+	mutex    sync.Mutex
+	buf      bytes.Buffer   // Entries of the current segment that weren't written yet
+	encoder  *gob.Encoder   // Encodes into buf
+	rotated  []journalChunk // Entries of previous segments that weren't written yet
+	truncate bool           // Everything in the current segment was committed, so its file is truncated
+	sealed   bool           // A new process took over, which numbers its segments after this one
+
+	segment uint64         // The segment being appended to, 0 is never used so it can mean "not journaled"
+	written int            // Entries appended to the current segment
+	pending map[uint64]int // Entries not flushed yet, by segment
+
+	fileMutex   sync.Mutex
+	file        *os.File
+	fileSegment uint64 // The segment file is open for
+}
+
+// journalChunk holds entries to be written to a segment file.
+type journalChunk struct {
+	segment  uint64
+	data     []byte
+	truncate bool // The file is truncated before writing
+}
+
+func (j *journal) segmentPath(segment uint64) string {
+	return segmentPath(j.dir, segment)
+}
+
+func segmentPath(dir string, segment uint64) string {
+	return filepath.Join(dir, strconv.FormatUint(segment, 10)+".journal")
+}
+
+// listSegments lists the segment files in a directory, in order.
+func listSegments(dir string) ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.journal"))
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]uint64, 0, len(names))
+	for _, name := range names {
+		segment, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".journal"), 10, 64)
+		if err == nil {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Sort(uint64Slice(segments))
+	return segments, nil
+}
+
+// startSegment starts appending to a new segment. The caller must hold the mutex.
+func (j *journal) startSegment(segment uint64) {
+	j.buf.Reset()
+	j.encoder = gob.NewEncoder(&j.buf)
+	j.truncate = false
+	j.segment = segment
+	j.written = 0
+}
+
+// takeChunks returns the entries that weren't written yet, oldest first. The caller must hold the mutex.
+func (j *journal) takeChunks() []journalChunk {
+	chunks := append(j.rotated, journalChunk{j.segment, append([]byte(nil), j.buf.Bytes()...), j.truncate})
+	j.rotated = nil
+	j.buf.Reset()
+	j.truncate = false
+	return chunks
+}
+
+// append encodes an entry and returns the segment it belongs to, or 0 if it couldn't be encoded.
+func (j *journal) append(entry *journalEntry) uint64 {
+	if j == nil {
+		return 0
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if err := j.encoder.Encode(entry); err != nil {
+		journalLogger.Critical("Failed to write to journal", "err", err)
+		return 0
+	}
+
+	segment := j.segment
+	j.pending[segment]++
+	j.written++
+
+	if j.written >= journalSegmentEntries && !j.sealed {
+		j.rotated = append(j.rotated, journalChunk{segment, append([]byte(nil), j.buf.Bytes()...), j.truncate})
+		j.startSegment(segment + 1)
+	}
+	return segment
+}
+
+// commit marks an entry as flushed.
+func (j *journal) commit(segment uint64) {
+	if j == nil || segment == 0 {
+		return
+	}
+
+	j.mutex.Lock()
+	j.pending[segment]--
+	if j.pending[segment] > 0 {
+		j.mutex.Unlock()
+		return
+	}
+	delete(j.pending, segment)
+
+	if segment == j.segment {
+		// Everything appended so far has been flushed, so there's nothing to replay
+		j.startSegment(segment)
+		j.truncate = true
+	}
+	j.mutex.Unlock()
+
+	// Segments that are still being written are removed by sync once they're closed
+	if segment != j.segment {
+		os.Remove(j.segmentPath(segment))
+	}
+}
+
+// sync writes out the appended entries and fsyncs them.
+func (j *journal) sync() {
+	j.fileMutex.Lock()
+	defer j.fileMutex.Unlock()
+
+	j.writeChunks()
+}
+
+// writeChunks writes and fsyncs the appended entries. The caller must hold fileMutex.
+func (j *journal) writeChunks() {
+	j.mutex.Lock()
+	chunks := j.takeChunks()
+	j.mutex.Unlock()
+
+	dirty := false
+	for _, chunk := range chunks {
+		if chunk.segment != j.fileSegment {
+			if dirty {
+				j.syncFile()
+				dirty = false
+			}
+			j.closeFile()
+			if err := j.openFile(chunk.segment); err != nil {
+				journalLogger.Panic("Failed to rotate journal", "err", err)
+			}
+		}
+
+		if chunk.truncate {
+			if err := j.file.Truncate(0); err != nil {
+				journalLogger.Critical("Failed to truncate journal", "err", err)
+			}
+			j.file.Seek(0, 0)
+			dirty = true
+		}
+		if len(chunk.data) > 0 {
+			if _, err := j.file.Write(chunk.data); err != nil {
+				journalLogger.Critical("Failed to write to journal", "err", err)
+			}
+			dirty = true
+		}
+	}
+	if dirty {
+		j.syncFile()
+	}
+}
+
+func (j *journal) syncFile() {
+	if err := j.file.Sync(); err != nil {
+		journalLogger.Critical("Failed to sync journal", "err", err)
+	}
+}
+
+// openFile opens the file of a segment for writing. The caller must hold fileMutex.
+func (j *journal) openFile(segment uint64) error {
+	file, err := os.OpenFile(j.segmentPath(segment), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	j.file = file
+	j.fileSegment = segment
+	return nil
+}
+
+// closeFile closes the segment file, and removes it if everything in it was flushed. The caller must hold fileMutex.
+func (j *journal) closeFile() {
+	if j.file == nil {
+		return
+	}
+	j.file.Close()
+	j.file = nil
+
+	j.mutex.Lock()
+	flushed := j.pending[j.fileSegment] == 0
+	j.mutex.Unlock()
+	if flushed {
+		os.Remove(j.segmentPath(j.fileSegment))
+	}
+}
+
+// seal stops rotating and writes out the appended entries, so every segment of this process is on disk
+// before a new process taking over numbers its own after them.
+func (j *journal) seal() {
+	if j == nil {
+		return
+	}
+
+	j.mutex.Lock()
+	j.sealed = true
+	j.mutex.Unlock()
+	j.sync()
+}
+
+func (db *Database) syncJournal() {
+	for db.sleep(config.Current().Intervals.JournalSync.Duration) {
+		db.journal.sync()
+	}
+}
+
+func (j *journal) close() {
+	if j == nil {
+		return
+	}
+
+	j.fileMutex.Lock()
+	defer j.fileMutex.Unlock()
+
+	j.writeChunks()
+	j.closeFile()
+}
+
+/*
+ * Entries left over from the last run are flushed before flushing starts.
+ * If the backend fails, whatever hasn't been flushed is written to a new segment, which is replayed on the next start.
+ */
+
+// openJournal replays the segments left by the last run, and starts a new one. If replay is false, they're
+// returned instead, since the process that handed off is still flushing them (see adoptSegments).
+func (db *Database) openJournal(replay bool) []uint64 {
+	if config.Loaded.JournalPath == "" {
+		journalLogger.Warning("Journal disabled, pending deltas will be lost if the tracker crashes")
+		return nil
+	}
+
+	j := &journal{dir: os.ExpandEnv(config.Loaded.JournalPath), pending: make(map[uint64]int)}
+	if err := os.MkdirAll(j.dir, 0700); err != nil {
+		journalLogger.Fatal("Failed to create journal directory", "err", err)
+	}
+
+	segments, err := listSegments(j.dir)
+	if err != nil {
+		journalLogger.Fatal("Failed to list journal segments", "err", err)
+	}
+
+	next := uint64(1)
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+		if replay {
+			next = db.replayJournal(j, segments, next)
+			segments = nil
+		}
+	}
+
+	j.startSegment(next)
+	if err = j.openFile(next); err != nil {
+		journalLogger.Fatal("Failed to open journal", "err", err)
+	}
+	db.journal = j
+	return segments
+}
+
+// adoptSegments queues the entries left in the segments of the process that handed off, once it exited.
+// They're journaled again before the segments are removed, so they can't be lost in between.
+func (db *Database) adoptSegments(segments []uint64) {
+	if len(segments) == 0 {
+		return
+	}
+	if !db.startRecording("journal") {
+		return
+	}
+	defer db.recording.RUnlock()
+
+	var entries []journalEntry
+	for _, segment := range segments {
+		read, err := readSegment(db.journal.segmentPath(segment))
+		if err != nil && !os.IsNotExist(err) {
+			journalLogger.Warning("Journal segment is damaged", "segment", segment, "entries", len(read), "err", err)
+		}
+		entries = append(entries, read...)
+	}
+
+	for i := range entries {
+		entries[i].setSegment(db.journal.append(&entries[i]))
+	}
+	db.journal.sync()
+	for _, segment := range segments {
+		os.Remove(db.journal.segmentPath(segment))
+	}
+
+	db.queueEntries(entries)
+	journalLogger.Info("Queued the journal entries left by the old process", "entries", len(entries))
+}
+
+// replayJournal flushes the given segments and returns the next free segment number.
+func (db *Database) replayJournal(j *journal, segments []uint64, next uint64) uint64 {
+	start := time.Now()
+
+	var entries []journalEntry
+	for _, segment := range segments {
+		read, err := readSegment(j.segmentPath(segment))
+		if err != nil {
+			// The last entries of a segment may have been cut off by a crash
+			journalLogger.Warning("Journal segment is damaged", "segment", segment, "entries", len(read), "err", err)
+		}
+		entries = append(entries, read...)
+	}
+
+	remaining := db.flushEntries(entries)
+	if len(remaining) > 0 {
+		journalLogger.Critical("Failed to replay journal entries, they'll be replayed on the next start", "entries", len(remaining))
+		if err := writeSegment(j.segmentPath(next), remaining); err != nil {
+			journalLogger.Fatal("Failed to write journal segment", "err", err)
+		}
+		next++
+	}
+
+	for _, segment := range segments {
+		os.Remove(j.segmentPath(segment))
+	}
+
+	journalLogger.Info("Replayed journal", "entries", len(entries)-len(remaining), "duration_ms", time.Now().Sub(start).Nanoseconds()/1000000)
+	return next
+}
+
+func readSegment(path string) (entries []journalEntry, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	decoder := gob.NewDecoder(bufio.NewReader(f))
+	for {
+		var entry journalEntry
+		if err = decoder.Decode(&entry); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func writeSegment(path string, entries []journalEntry) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	writer := bufio.NewWriter(f)
+	encoder := gob.NewEncoder(writer)
+	for i := range entries {
+		if err = encoder.Encode(&entries[i]); err != nil {
+			return err
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// flushEntries flushes the entries to the backend in batches, and returns the ones that couldn't be flushed.
+func (db *Database) flushEntries(entries []journalEntry) []journalEntry {
+	batches := make(map[string][]journalEntry)
+	for _, entry := range entries {
+		label := entry.label()
+		batches[label] = append(batches[label], entry)
+	}
+
+	var remaining []journalEntry
+	for _, label := range flushLabels {
+		batch := batches[label]
+		for len(batch) > 0 && remaining == nil {
+			n := minInt(len(batch), flushSize(label))
+			if err := db.flushBatch(batch[:n]); err != nil {
+				journalLogger.Critical("Journal replay failed", "table", label, "err", err)
+				break
+			}
+			batch = batch[n:]
+		}
+		remaining = append(remaining, batch...)
+	}
+	return remaining
+}
+
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
@@ -0,0 +1,125 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kotoko/chihaya/config"
+)
+
+func newJournalDatabase(t *testing.T, backend Backend, dir string) *Database {
+	config.Loaded.JournalPath = dir
+	db := newTestDatabase(backend)
+	db.userChannel = make(chan UserDelta, 100)
+	db.openJournal(true)
+	if db.journal == nil {
+		t.Fatal("Journal not opened")
+	}
+	return db
+}
+
+func journalSize(t *testing.T, dir string) int64 {
+	var size int64
+	names, _ := filepath.Glob(filepath.Join(dir, "*.journal"))
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += info.Size()
+	}
+	return size
+}
+
+func TestJournalCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { config.Loaded.JournalPath = "" }()
+
+	db := newJournalDatabase(t, newKeepingBackend(), dir)
+	user := &User{Id: 1}
+	db.RecordUser(user, 10, 10, 10, 10)
+	db.RecordUser(user, 20, 20, 20, 20)
+
+	db.journal.sync()
+	if journalSize(t, dir) == 0 {
+		t.Fatal("Nothing written to the journal")
+	}
+
+	first := <-db.userChannel
+	db.journal.commit(first.segment)
+	if journalSize(t, dir) == 0 {
+		t.Error("Journal truncated before every delta was committed")
+	}
+
+	second := <-db.userChannel
+	db.journal.commit(second.segment)
+	db.journal.sync()
+	if size := journalSize(t, dir); size != 0 {
+		t.Errorf("Journal is %d bytes after every delta was committed", size)
+	}
+
+	// The journal keeps working after it was truncated
+	db.RecordUser(user, 30, 30, 30, 30)
+	db.journal.close()
+
+	entries, err := readSegment(db.journal.segmentPath(db.journal.segment))
+	if err != nil || len(entries) != 1 || entries[0].User.RawDeltaUpload != 30 {
+		t.Errorf("Read %+v (%v) after truncating, want the last delta", entries, err)
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { config.Loaded.JournalPath = "" }()
+
+	// Nothing is committed, as if the tracker crashed before flushing
+	db := newJournalDatabase(t, newKeepingBackend(), dir)
+	db.RecordUser(&User{Id: 1}, 10, 10, 10, 10)
+	db.RecordTorrent(&Torrent{Id: 2}, 1)
+	db.RecordUser(&User{Id: 3}, 30, 30, 30, 30)
+	db.journal.close()
+
+	// A write cut off by the crash
+	f, err := os.OpenFile(db.journal.segmentPath(db.journal.segment), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0x20, 0xff, 0x81})
+	f.Close()
+
+	// The users can't be flushed, so they're kept for the next start
+	failing := &unreliableBackend{MemoryBackend: newKeepingBackend(), down: true}
+	db = newJournalDatabase(t, failing, dir)
+	if deltas := failing.TorrentDeltas(); len(deltas) != 1 || deltas[0].Id != 2 || deltas[0].DeltaSnatch != 1 {
+		t.Errorf("Replayed torrent deltas %+v, want the recorded one", deltas)
+	}
+	db.journal.close()
+
+	b := newKeepingBackend()
+	db = newJournalDatabase(t, b, dir)
+	if deltas := b.UserDeltas(); len(deltas) != 2 || deltas[0].Id != 1 || deltas[1].Id != 3 {
+		t.Errorf("Replayed user deltas %+v, want the recorded ones", deltas)
+	}
+	if deltas := b.TorrentDeltas(); len(deltas) != 0 {
+		t.Errorf("Replayed torrent deltas %+v again", deltas)
+	}
+	db.journal.close()
+
+	if names, _ := filepath.Glob(filepath.Join(dir, "*.journal")); len(names) != 0 {
+		t.Errorf("Journal segments %v left after a successful replay", names)
+	}
+}
@@ -0,0 +1,445 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// MemoryBackend keeps everything in memory, which makes it suitable for tests and single-node development.
+type MemoryBackend struct {
+	// Keeps every flushed delta, so tests can assert on what would have been written to a real store.
+	// Off by default, since they'd grow without bound in a tracker that runs for long.
+	KeepDeltas bool
+
+	mutex sync.Mutex
+
+	users           map[string]*User
+	torrents        map[string]*Torrent
+	clientRules     []ClientRule
+	bans            []string
+	globalFreeleech bool
+
+	torrentDeltas         []TorrentDelta
+	userDeltas            []UserDelta
+	transferHistoryDeltas []TransferHistoryDelta
+	transferIpDeltas      []TransferIpDelta
+	snatchDeltas          []SnatchDelta
+	unPruned              []uint64
+
+	changes []memoryChange // The position in the change log is its length
+}
+
+type memoryChange struct {
+	torrent bool // Otherwise a user
+	id      uint64
+}
+
+// memoryFixture is the JSON representation of a MemoryBackend's contents.
+// Users are keyed by passkey and torrents by hex encoded info hash.
+type memoryFixture struct {
+	Users map[string]struct {
+		Id             uint64  `json:"id"`
+		UpMultiplier   float64 `json:"up_multiplier"`
+		DownMultiplier float64 `json:"down_multiplier"`
+		Slots          int64   `json:"slots"`
+	} `json:"users"`
+
+	Torrents map[string]struct {
+		Id             uint64  `json:"id"`
+		UpMultiplier   float64 `json:"up_multiplier"`
+		DownMultiplier float64 `json:"down_multiplier"`
+		Snatched       uint    `json:"snatched"`
+		Status         int64   `json:"status"`
+	} `json:"torrents"`
+
+	Whitelist []string `json:"whitelist"` // Peer ID prefixes of clients allowed in any version
+
+	ClientRules []struct {
+		Prefix     string `json:"prefix"`
+		Name       string `json:"name"`
+		Deny       bool   `json:"deny"`
+		MinVersion string `json:"min_version"`
+		MaxVersion string `json:"max_version"`
+		Note       string `json:"note"`
+	} `json:"client_rules"`
+
+	Bans            []string `json:"bans"`
+	GlobalFreeleech bool     `json:"global_freeleech"`
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		users:    make(map[string]*User),
+		torrents: make(map[string]*Torrent),
+	}
+}
+
+// LoadFixture adds the users, torrents and whitelisted clients from a JSON fixture file.
+func (b *MemoryBackend) LoadFixture(path string) error {
+	f, err := os.Open(os.ExpandEnv(path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var fixture memoryFixture
+	err = json.NewDecoder(f).Decode(&fixture)
+	if err != nil {
+		return fmt.Errorf("error decoding fixture %s: %v", path, err)
+	}
+
+	for passkey, user := range fixture.Users {
+		b.AddUser(passkey, &User{
+			Id:             user.Id,
+			UpMultiplier:   user.UpMultiplier,
+			DownMultiplier: user.DownMultiplier,
+			Slots:          user.Slots,
+		})
+	}
+
+	for hexInfoHash, torrent := range fixture.Torrents {
+		infoHash, err := hex.DecodeString(hexInfoHash)
+		if err != nil || len(infoHash) != 20 {
+			return fmt.Errorf("invalid info hash %q in fixture %s", hexInfoHash, path)
+		}
+		b.AddTorrent(string(infoHash), &Torrent{
+			Id:             torrent.Id,
+			UpMultiplier:   torrent.UpMultiplier,
+			DownMultiplier: torrent.DownMultiplier,
+			Snatched:       torrent.Snatched,
+			Status:         torrent.Status,
+		})
+	}
+
+	for _, peerId := range fixture.Whitelist {
+		b.AddClientRule(ClientRule{Prefix: peerId})
+	}
+
+	for _, rule := range fixture.ClientRules {
+		b.AddClientRule(ClientRule{
+			Prefix:     rule.Prefix,
+			Name:       rule.Name,
+			Deny:       rule.Deny,
+			MinVersion: rule.MinVersion,
+			MaxVersion: rule.MaxVersion,
+			Note:       rule.Note,
+		})
+	}
+
+	for _, ban := range fixture.Bans {
+		b.AddBan(ban)
+	}
+
+	b.SetGlobalFreeleech(fixture.GlobalFreeleech)
+	return nil
+}
+
+// AddUser adds or replaces the user with the given passkey. Only the stored fields of the user are used.
+func (b *MemoryBackend) AddUser(passkey string, user *User) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.users[passkey] = &User{
+		Id:             user.Id,
+		UpMultiplier:   user.UpMultiplier,
+		DownMultiplier: user.DownMultiplier,
+		Slots:          user.Slots,
+	}
+	b.changes = append(b.changes, memoryChange{false, user.Id})
+}
+
+func (b *MemoryBackend) RemoveUser(passkey string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if user, exists := b.users[passkey]; exists {
+		delete(b.users, passkey)
+		b.changes = append(b.changes, memoryChange{false, user.Id})
+	}
+}
+
+// AddTorrent adds or replaces the torrent with the given info hash. Only the stored fields of the torrent are used.
+func (b *MemoryBackend) AddTorrent(infoHash string, torrent *Torrent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.torrents[infoHash] = copyTorrent(torrent)
+	b.changes = append(b.changes, memoryChange{true, torrent.Id})
+}
+
+// copyTorrent copies the stored fields of a torrent.
+func copyTorrent(torrent *Torrent) *Torrent {
+	return &Torrent{
+		Id:             torrent.Id,
+		UpMultiplier:   torrent.UpMultiplier,
+		DownMultiplier: torrent.DownMultiplier,
+		Snatched:       torrent.Snatched,
+		Status:         torrent.Status,
+	}
+}
+
+func (b *MemoryBackend) RemoveTorrent(infoHash string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if torrent, exists := b.torrents[infoHash]; exists {
+		delete(b.torrents, infoHash)
+		b.changes = append(b.changes, memoryChange{true, torrent.Id})
+	}
+}
+
+func (b *MemoryBackend) AddClientRule(rule ClientRule) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.clientRules = append(b.clientRules, rule)
+}
+
+// AddBan bans an IP address or CIDR range.
+func (b *MemoryBackend) AddBan(ban string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.bans = append(b.bans, ban)
+}
+
+func (b *MemoryBackend) SetGlobalFreeleech(freeleech bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.globalFreeleech = freeleech
+}
+
+func (b *MemoryBackend) LoadUsers() (map[string]*User, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	users := make(map[string]*User, len(b.users))
+	for passkey, user := range b.users {
+		u := *user
+		users[passkey] = &u
+	}
+	return users, nil
+}
+
+func (b *MemoryBackend) LoadTorrents() (map[string]*Torrent, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	torrents := make(map[string]*Torrent, len(b.torrents))
+	for infoHash, torrent := range b.torrents {
+		torrents[infoHash] = copyTorrent(torrent)
+	}
+	return torrents, nil
+}
+
+func (b *MemoryBackend) LoadClientRules() ([]ClientRule, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]ClientRule(nil), b.clientRules...), nil
+}
+
+func (b *MemoryBackend) LoadBans() ([]string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]string(nil), b.bans...), nil
+}
+
+func (b *MemoryBackend) LoadGlobalFreeleech() (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.globalFreeleech, nil
+}
+
+func (b *MemoryBackend) ChangePosition() (uint64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return uint64(len(b.changes)), nil
+}
+
+func (b *MemoryBackend) LoadChanges(position uint64) (*Changes, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	changes := &Changes{
+		Users:    make(map[string]*User),
+		Torrents: make(map[string]*Torrent),
+		Position: uint64(len(b.changes)),
+	}
+	if position >= uint64(len(b.changes)) {
+		return changes, nil
+	}
+
+	userIds := make(map[uint64]bool)
+	torrentIds := make(map[uint64]bool)
+	for _, change := range b.changes[position:] {
+		if change.torrent {
+			torrentIds[change.id] = true
+		} else {
+			userIds[change.id] = true
+		}
+	}
+
+	for passkey, user := range b.users {
+		if userIds[user.Id] {
+			u := *user
+			changes.Users[passkey] = &u
+			delete(userIds, user.Id)
+		}
+	}
+	for id := range userIds {
+		changes.DeletedUsers = append(changes.DeletedUsers, id)
+	}
+
+	for infoHash, torrent := range b.torrents {
+		if torrentIds[torrent.Id] {
+			changes.Torrents[infoHash] = copyTorrent(torrent)
+			delete(torrentIds, torrent.Id)
+		}
+	}
+	for id := range torrentIds {
+		changes.DeletedTorrents = append(changes.DeletedTorrents, id)
+	}
+
+	return changes, nil
+}
+
+func (b *MemoryBackend) FlushTorrents(deltas []TorrentDelta) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, delta := range deltas {
+		for _, torrent := range b.torrents {
+			if torrent.Id == delta.Id {
+				torrent.Snatched += uint(delta.DeltaSnatch)
+				break
+			}
+		}
+	}
+	if b.KeepDeltas {
+		b.torrentDeltas = append(b.torrentDeltas, deltas...)
+	}
+	return nil
+}
+
+func (b *MemoryBackend) FlushUsers(deltas []UserDelta) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.KeepDeltas {
+		b.userDeltas = append(b.userDeltas, deltas...)
+	}
+	return nil
+}
+
+func (b *MemoryBackend) FlushTransferHistory(deltas []TransferHistoryDelta) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.KeepDeltas {
+		b.transferHistoryDeltas = append(b.transferHistoryDeltas, deltas...)
+	}
+	return nil
+}
+
+func (b *MemoryBackend) FlushTransferIps(deltas []TransferIpDelta) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.KeepDeltas {
+		b.transferIpDeltas = append(b.transferIpDeltas, deltas...)
+	}
+	return nil
+}
+
+func (b *MemoryBackend) FlushSnatches(deltas []SnatchDelta) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.KeepDeltas {
+		b.snatchDeltas = append(b.snatchDeltas, deltas...)
+	}
+	return nil
+}
+
+// MarkStalePeers has nothing to do, since the memory backend doesn't keep peers.
+func (b *MemoryBackend) MarkStalePeers(oldestActive int64) (int64, error) {
+	return 0, nil
+}
+
+func (b *MemoryBackend) UnPrune(torrentId uint64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, torrent := range b.torrents {
+		if torrent.Id == torrentId {
+			torrent.Status = 0
+			break
+		}
+	}
+	if b.KeepDeltas {
+		b.unPruned = append(b.unPruned, torrentId)
+	}
+	return nil
+}
+
+func (b *MemoryBackend) Close() error {
+	return nil
+}
+
+/*
+ * The flushed deltas are returned as copies, since flushing can happen concurrently. They're only kept with KeepDeltas.
+ */
+
+func (b *MemoryBackend) TorrentDeltas() []TorrentDelta {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]TorrentDelta(nil), b.torrentDeltas...)
+}
+
+func (b *MemoryBackend) UserDeltas() []UserDelta {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]UserDelta(nil), b.userDeltas...)
+}
+
+func (b *MemoryBackend) TransferHistoryDeltas() []TransferHistoryDelta {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]TransferHistoryDelta(nil), b.transferHistoryDeltas...)
+}
+
+func (b *MemoryBackend) TransferIpDeltas() []TransferIpDelta {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]TransferIpDelta(nil), b.transferIpDeltas...)
+}
+
+func (b *MemoryBackend) SnatchDeltas() []SnatchDelta {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]SnatchDelta(nil), b.snatchDeltas...)
+}
+
+func (b *MemoryBackend) UnPruned() []uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]uint64(nil), b.unPruned...)
+}
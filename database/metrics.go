@@ -0,0 +1,70 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"bytes"
+
+	"github.com/kotoko/chihaya/metrics"
+)
+
+var (
+	flushDuration   = metrics.NewHistogramVec("chihaya_flush_duration_seconds", "Time taken to flush a batch of deltas to the backend.", "channel", metrics.DurationBuckets)
+	flushFailures   = metrics.NewCounterVec("chihaya_flush_failures_total", "Batches of deltas that couldn't be flushed to the backend.", "channel")
+	reloadDuration  = metrics.NewHistogramVec("chihaya_reload_duration_seconds", "Time taken to reload from the backend.", "kind", metrics.DurationBuckets)
+	deadlockRetries = metrics.NewCounter("chihaya_deadlock_retries_total", "MySQL queries retried after a deadlock or lock wait timeout.")
+	deadLetters     = metrics.NewCounterVec("chihaya_dead_letters_total", "Deltas written to the dead letters after they failed to flush.", "channel")
+)
+
+/*
+ * Clients block once a flush channel is full, so the queue lengths are exposed next to their capacities for alerting.
+ * The channel labels match the ones used when logging flushes.
+ */
+func (db *Database) WriteMetrics(buf *bytes.Buffer) {
+	metrics.WriteGaugeVec(buf, "chihaya_flush_queue_length", "Deltas waiting to be flushed.", "channel", map[string]float64{
+		"torrents":         float64(len(db.torrentChannel)),
+		"users_main":       float64(len(db.userChannel)),
+		"transfer_history": float64(len(db.transferHistoryChannel)),
+		"transfer_ips":     float64(len(db.transferIpsChannel)),
+		"snatches":         float64(len(db.snatchChannel)),
+	})
+	metrics.WriteGaugeVec(buf, "chihaya_flush_queue_capacity", "Deltas that can be queued before clients block.", "channel", map[string]float64{
+		"torrents":         float64(cap(db.torrentChannel)),
+		"users_main":       float64(cap(db.userChannel)),
+		"transfer_history": float64(cap(db.transferHistoryChannel)),
+		"transfer_ips":     float64(cap(db.transferIpsChannel)),
+		"snatches":         float64(cap(db.snatchChannel)),
+	})
+
+	retrying := make(map[string]float64)
+	db.failedMutex.Lock()
+	for label, batches := range db.failedBatches {
+		for _, batch := range batches {
+			retrying[label] += float64(len(batch.entries))
+		}
+	}
+	db.failedMutex.Unlock()
+	metrics.WriteGaugeVec(buf, "chihaya_flush_retry_length", "Deltas that failed to flush and are waiting to be retried.", "channel", retrying)
+
+	var seeders, leechers int
+	db.TorrentsMutex.RLock()
+	torrents := len(db.Torrents)
+	for _, torrent := range db.Torrents {
+		torrent.RLock()
+		seeders += len(torrent.Seeders)
+		leechers += len(torrent.Leechers)
+		torrent.RUnlock()
+	}
+	db.TorrentsMutex.RUnlock()
+
+	db.UsersMutex.RLock()
+	users := len(db.Users)
+	db.UsersMutex.RUnlock()
+
+	metrics.WriteGauge(buf, "chihaya_torrents", "Torrents in the cache.", float64(torrents))
+	metrics.WriteGauge(buf, "chihaya_seeders", "Seeders across all torrents.", float64(seeders))
+	metrics.WriteGauge(buf, "chihaya_leechers", "Leechers across all torrents.", float64(leechers))
+	metrics.WriteGauge(buf, "chihaya_users", "Users in the cache.", float64(users))
+}
@@ -5,7 +5,7 @@
 package database
 
 import (
-	"log"
+	"fmt"
 
 	"github.com/ziutek/mymysql/mysql"
 )
@@ -45,7 +45,7 @@ func (r *rowWrapper) Int64(nn int) int64 {
 	case uint:
 		return int64(data)
 	}
-	log.Panicf("i64 %T", r.r[nn])
+	mysqlLogger.Panic("Unexpected column type", "conversion", "i64", "type", fmt.Sprintf("%T", r.r[nn]))
 	return 0
 }
 
@@ -72,7 +72,7 @@ func (r *rowWrapper) Uint64(nn int) uint64 {
 	case int:
 		return uint64(data)
 	}
-	log.Panicf("ui64 %T", r.r[nn])
+	mysqlLogger.Panic("Unexpected column type", "conversion", "ui64", "type", fmt.Sprintf("%T", r.r[nn]))
 	return 0
 }
 
@@ -99,7 +99,7 @@ func (r *rowWrapper) Uint(nn int) uint {
 	case int:
 		return uint(data)
 	}
-	log.Panicf("ui %T", r.r[nn])
+	mysqlLogger.Panic("Unexpected column type", "conversion", "ui", "type", fmt.Sprintf("%T", r.r[nn]))
 	return 0
 }
 
@@ -110,6 +110,6 @@ func (r *rowWrapper) Float64(nn int) float64 {
 	case float32:
 		return float64(data)
 	}
-	log.Panicf("f64 %T", r.r[nn])
+	mysqlLogger.Panic("Unexpected column type", "conversion", "f64", "type", fmt.Sprintf("%T", r.r[nn]))
 	return 0
 }
@@ -0,0 +1,702 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kotoko/chihaya/config"
+	"github.com/ziutek/mymysql/mysql"
+	_ "github.com/ziutek/mymysql/native"
+)
+
+type DatabaseConnection struct {
+	sqlDb mysql.Conn
+	mutex sync.Mutex
+}
+
+// MySQLBackend stores everything in a Gazelle MySQL database.
+type MySQLBackend struct {
+	mainConn *DatabaseConnection // Used for reloading and misc queries
+
+	// Each flush routine gets its own database connection to maximize update throughput
+	torrentConn         *DatabaseConnection
+	userConn            *DatabaseConnection
+	transferHistoryConn *DatabaseConnection
+	transferIpsConn     *DatabaseConnection
+	snatchConn          *DatabaseConnection
+
+	loadUsersStmt       mysql.Stmt
+	loadTorrentsStmt    mysql.Stmt
+	loadClientsStmt     mysql.Stmt
+	loadBansStmt        mysql.Stmt
+	loadFreeleechStmt   mysql.Stmt
+	cleanStalePeersStmt mysql.Stmt
+	unPruneTorrentStmt  mysql.Stmt
+	changePositionStmt  mysql.Stmt
+	loadChangesStmt     mysql.Stmt
+}
+
+const (
+	loadUsersQuery    = "SELECT ID, torrent_pass, DownMultiplier, UpMultiplier, Slots FROM users_main WHERE Enabled='1'"
+	loadTorrentsQuery = "SELECT ID, info_hash, DownMultiplier, UpMultiplier, Snatched, Status FROM torrents"
+)
+
+func NewMySQLBackend() *MySQLBackend {
+	b := &MySQLBackend{
+		mainConn:            OpenDatabaseConnection(),
+		torrentConn:         OpenDatabaseConnection(),
+		userConn:            OpenDatabaseConnection(),
+		transferHistoryConn: OpenDatabaseConnection(),
+		transferIpsConn:     OpenDatabaseConnection(),
+		snatchConn:          OpenDatabaseConnection(),
+	}
+
+	b.loadUsersStmt = b.mainConn.prepareStatement(loadUsersQuery)
+	b.loadTorrentsStmt = b.mainConn.prepareStatement(loadTorrentsQuery)
+	b.loadClientsStmt = b.mainConn.prepareOptional("SELECT peer_id, vstring, action, min_version, max_version, notes FROM xbt_client_whitelist", "003_client_rules.sql")
+	if b.loadClientsStmt == nil {
+		// Every row of a whitelist from before the migration allows its prefix
+		b.loadClientsStmt = b.mainConn.prepareStatement("SELECT peer_id, vstring, 'allow', '', '', notes FROM xbt_client_whitelist")
+	}
+	b.loadBansStmt = b.mainConn.prepareOptional("SELECT ip FROM tracker_bans", "002_tracker_bans.sql")
+	b.loadFreeleechStmt = b.mainConn.prepareStatement("SELECT mod_setting FROM mod_core WHERE mod_option='global_freeleech'")
+	b.cleanStalePeersStmt = b.mainConn.prepareStatement("UPDATE transfer_history SET active = '0' WHERE last_announce < ? AND active='1'")
+	b.unPruneTorrentStmt = b.mainConn.prepareStatement("UPDATE torrents SET Status=0 WHERE ID = ?")
+	b.changePositionStmt = b.mainConn.prepareOptional("SELECT IFNULL(MAX(id), 0) FROM tracker_changes", "001_tracker_changes.sql")
+	b.loadChangesStmt = b.mainConn.prepareOptional("SELECT id, kind, row_id FROM tracker_changes WHERE id > ? ORDER BY id", "001_tracker_changes.sql")
+
+	return b
+}
+
+func (b *MySQLBackend) Close() error {
+	for _, conn := range []*DatabaseConnection{b.torrentConn, b.userConn, b.transferHistoryConn, b.transferIpsConn, b.snatchConn} {
+		conn.Close()
+	}
+
+	b.mainConn.mutex.Lock()
+	defer b.mainConn.mutex.Unlock()
+	return b.mainConn.Close()
+}
+
+func (b *MySQLBackend) LoadUsers() (map[string]*User, error) {
+	b.mainConn.mutex.Lock()
+	defer b.mainConn.mutex.Unlock()
+
+	result, err := b.mainConn.query(b.loadUsersStmt)
+	if err != nil {
+		return nil, err
+	}
+	return scanUsers(result)
+}
+
+func (b *MySQLBackend) LoadTorrents() (map[string]*Torrent, error) {
+	b.mainConn.mutex.Lock()
+	defer b.mainConn.mutex.Unlock()
+
+	result, err := b.mainConn.query(b.loadTorrentsStmt)
+	if err != nil {
+		return nil, err
+	}
+	return scanTorrents(result)
+}
+
+func scanUsers(result mysql.Result) (users map[string]*User, err error) {
+	users = make(map[string]*User)
+
+	row := &rowWrapper{result.MakeRow()}
+
+	id := result.Map("ID")
+	torrentPass := result.Map("torrent_pass")
+	downMultiplier := result.Map("DownMultiplier")
+	upMultiplier := result.Map("UpMultiplier")
+	slots := result.Map("Slots")
+
+	for {
+		err = result.ScanRow(row.r)
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error scanning user rows: %v", err)
+		}
+
+		users[row.Str(torrentPass)] = &User{
+			Id:             row.Uint64(id),
+			UpMultiplier:   row.Float64(upMultiplier),
+			DownMultiplier: row.Float64(downMultiplier),
+			Slots:          row.Int64(slots),
+		}
+	}
+	return
+}
+
+func scanTorrents(result mysql.Result) (torrents map[string]*Torrent, err error) {
+	torrents = make(map[string]*Torrent)
+
+	row := &rowWrapper{result.MakeRow()}
+
+	id := result.Map("ID")
+	infoHash := result.Map("info_hash")
+	downMultiplier := result.Map("DownMultiplier")
+	upMultiplier := result.Map("UpMultiplier")
+	snatched := result.Map("Snatched")
+	status := result.Map("Status")
+
+	for {
+		err = result.ScanRow(row.r)
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error scanning torrent rows: %v", err)
+		}
+
+		torrents[row.Str(infoHash)] = &Torrent{
+			Id:             row.Uint64(id),
+			UpMultiplier:   row.Float64(upMultiplier),
+			DownMultiplier: row.Float64(downMultiplier),
+			Snatched:       row.Uint(snatched),
+			Status:         row.Int64(status),
+		}
+	}
+	return
+}
+
+/*
+ * Changes are read from the tracker_changes table, which is filled by triggers on users_main and torrents
+ * (see migrations/001_tracker_changes.sql). The changed rows are then loaded by ID with the same queries as a full load,
+ * so any ID that doesn't come back was deleted or disabled. Databases without the table get a full load every time.
+ */
+
+func (b *MySQLBackend) ChangePosition() (position uint64, err error) {
+	if b.changePositionStmt == nil {
+		return 0, nil
+	}
+
+	b.mainConn.mutex.Lock()
+	defer b.mainConn.mutex.Unlock()
+
+	result, err := b.mainConn.query(b.changePositionStmt)
+	if err != nil {
+		return
+	}
+
+	row := &rowWrapper{result.MakeRow()}
+	for {
+		err = result.ScanRow(row.r)
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("error scanning change position: %v", err)
+		}
+		position = row.Uint64(0)
+	}
+	return
+}
+
+func (b *MySQLBackend) LoadChanges(position uint64) (changes *Changes, err error) {
+	if b.loadChangesStmt == nil {
+		return nil, ErrNoChangeLog
+	}
+
+	b.mainConn.mutex.Lock()
+	defer b.mainConn.mutex.Unlock()
+
+	result, err := b.mainConn.query(b.loadChangesStmt, position)
+	if err != nil {
+		return
+	}
+
+	changes = &Changes{Position: position}
+	userIds := make(map[uint64]bool)
+	torrentIds := make(map[uint64]bool)
+
+	row := &rowWrapper{result.MakeRow()}
+	for {
+		err = result.ScanRow(row.r)
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error scanning change rows: %v", err)
+		}
+
+		switch row.Str(1) {
+		case "user":
+			userIds[row.Uint64(2)] = true
+		case "torrent":
+			torrentIds[row.Uint64(2)] = true
+		}
+		changes.Position = row.Uint64(0)
+	}
+
+	if len(userIds) > 0 {
+		result, err = b.mainConn.execBuffer(idQuery(loadUsersQuery+" AND ID IN (", userIds))
+		if err != nil {
+			return nil, err
+		}
+		changes.Users, err = scanUsers(result)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range changes.Users {
+			delete(userIds, user.Id)
+		}
+		for id := range userIds {
+			changes.DeletedUsers = append(changes.DeletedUsers, id)
+		}
+	}
+
+	if len(torrentIds) > 0 {
+		result, err = b.mainConn.execBuffer(idQuery(loadTorrentsQuery+" WHERE ID IN (", torrentIds))
+		if err != nil {
+			return nil, err
+		}
+		changes.Torrents, err = scanTorrents(result)
+		if err != nil {
+			return nil, err
+		}
+		for _, torrent := range changes.Torrents {
+			delete(torrentIds, torrent.Id)
+		}
+		for id := range torrentIds {
+			changes.DeletedTorrents = append(changes.DeletedTorrents, id)
+		}
+	}
+	return
+}
+
+// idQuery completes a query ending in "IN (" with the given IDs.
+func idQuery(prefix string, ids map[uint64]bool) *bytes.Buffer {
+	var query bytes.Buffer
+	query.WriteString(prefix)
+
+	first := true
+	for id := range ids {
+		if !first {
+			query.WriteRune(',')
+		}
+		query.WriteString(strconv.FormatUint(id, 10))
+		first = false
+	}
+	query.WriteRune(')')
+	return &query
+}
+
+func (b *MySQLBackend) LoadClientRules() (rules []ClientRule, err error) {
+	b.mainConn.mutex.Lock()
+	defer b.mainConn.mutex.Unlock()
+
+	result, err := b.mainConn.query(b.loadClientsStmt)
+	if err != nil {
+		return
+	}
+
+	rules = make([]ClientRule, 0, 100)
+
+	row := result.MakeRow()
+
+	for {
+		err = result.ScanRow(row)
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error scanning whitelist rows: %v", err)
+		}
+		rules = append(rules, ClientRule{
+			Prefix:     row.Str(0),
+			Name:       row.Str(1),
+			Deny:       row.Str(2) == "deny",
+			MinVersion: row.Str(3),
+			MaxVersion: row.Str(4),
+			Note:       row.Str(5),
+		})
+	}
+	return
+}
+
+// LoadBans returns no bans if the database doesn't have the tracker_bans table, so only the ban file is used.
+func (b *MySQLBackend) LoadBans() (bans []string, err error) {
+	if b.loadBansStmt == nil {
+		return nil, nil
+	}
+
+	b.mainConn.mutex.Lock()
+	defer b.mainConn.mutex.Unlock()
+
+	result, err := b.mainConn.query(b.loadBansStmt)
+	if err != nil {
+		return
+	}
+
+	row := result.MakeRow()
+
+	for {
+		err = result.ScanRow(row)
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error scanning ban rows: %v", err)
+		}
+		bans = append(bans, row.Str(0))
+	}
+	return
+}
+
+func (b *MySQLBackend) LoadGlobalFreeleech() (freeleech bool, err error) {
+	b.mainConn.mutex.Lock()
+	defer b.mainConn.mutex.Unlock()
+
+	result, err := b.mainConn.query(b.loadFreeleechStmt)
+	if err != nil {
+		return
+	}
+	for {
+		row, err := result.GetRow()
+		if err != nil || row == nil {
+			break
+		} else {
+			freeleech = row.Bool(0)
+		}
+	}
+	return
+}
+
+func (b *MySQLBackend) MarkStalePeers(oldestActive int64) (int64, error) {
+	b.mainConn.mutex.Lock()
+	defer b.mainConn.mutex.Unlock()
+
+	result, err := b.mainConn.exec(b.cleanStalePeersStmt, oldestActive)
+	if err != nil {
+		return 0, err
+	}
+	return int64(result.AffectedRows()), nil
+}
+
+func (b *MySQLBackend) UnPrune(torrentId uint64) error {
+	b.mainConn.mutex.Lock()
+	defer b.mainConn.mutex.Unlock()
+
+	_, err := b.mainConn.exec(b.unPruneTorrentStmt, torrentId)
+	return err
+}
+
+/*
+ * Buffers are used for efficient string concatenation
+ * It may look ugly with all the explicit type conversions, but this tracker is about speed
+ */
+
+func (b *MySQLBackend) FlushTorrents(deltas []TorrentDelta) error {
+	b.torrentConn.mutex.Lock()
+	defer b.torrentConn.mutex.Unlock()
+
+	var query bytes.Buffer
+	query.Grow(len(deltas) * 50) // ~50 bytes per record max
+
+	query.WriteString("INSERT INTO torrents (ID, Snatched, Seeders, Leechers, last_action) VALUES\n")
+
+	// Deleted torrents are skipped, as the upsert would insert them again
+	rows := 0
+	for _, delta := range deltas {
+		if delta.Deleted {
+			continue
+		}
+		if rows != 0 {
+			query.WriteRune(',')
+		}
+		rows++
+		query.WriteString("('")
+		query.WriteString(strconv.FormatUint(delta.Id, 10))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatUint(delta.DeltaSnatch, 10))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatInt(int64(delta.Seeders), 10))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatInt(int64(delta.Leechers), 10))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatInt(delta.LastAction, 10))
+		query.WriteString("')")
+	}
+
+	query.WriteString("\nON DUPLICATE KEY UPDATE Snatched = Snatched + VALUES(Snatched), " +
+		"Seeders = VALUES(Seeders), Leechers = VALUES(Leechers), " +
+		"last_action = IF(last_action < VALUES(last_action), VALUES(last_action), last_action);")
+
+	if rows == 0 {
+		return nil
+	}
+
+	_, err := b.torrentConn.execBuffer(&query)
+	return err
+}
+
+func (b *MySQLBackend) FlushUsers(deltas []UserDelta) error {
+	b.userConn.mutex.Lock()
+	defer b.userConn.mutex.Unlock()
+
+	var query bytes.Buffer
+	query.Grow(len(deltas) * 60) // ~60 bytes per record max
+
+	query.WriteString("INSERT INTO users_main (ID, Uploaded, Downloaded, rawdl, rawup) VALUES\n")
+
+	for i, delta := range deltas {
+		if i != 0 {
+			query.WriteRune(',')
+		}
+		query.WriteString("('")
+		query.WriteString(strconv.FormatUint(delta.Id, 10))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatInt(delta.DeltaUpload, 10))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatInt(delta.DeltaDownload, 10))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatInt(delta.RawDeltaDownload, 10))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatInt(delta.RawDeltaUpload, 10))
+		query.WriteString("')")
+	}
+
+	query.WriteString("\nON DUPLICATE KEY UPDATE Uploaded = Uploaded + VALUES(Uploaded), " +
+		"Downloaded = Downloaded + VALUES(Downloaded), rawdl = rawdl + VALUES(rawdl), rawup = rawup + VALUES(rawup);")
+
+	_, err := b.userConn.execBuffer(&query)
+	return err
+}
+
+func (b *MySQLBackend) FlushTransferHistory(deltas []TransferHistoryDelta) error {
+	b.transferHistoryConn.mutex.Lock()
+	defer b.transferHistoryConn.mutex.Unlock()
+
+	var query bytes.Buffer
+	query.Grow(len(deltas) * 110) // ~110 bytes per record max
+
+	query.WriteString("INSERT INTO transfer_history (uid, fid, uploaded, downloaded, " +
+		"seeding, starttime, last_announce, seedtime, active, snatched, remaining) VALUES\n")
+
+	for i, delta := range deltas {
+		if i != 0 {
+			query.WriteRune(',')
+		}
+		query.WriteString("('")
+		query.WriteString(strconv.FormatUint(delta.UserId, 10))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatUint(delta.TorrentId, 10))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatInt(delta.RawDeltaUpload, 10))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatInt(delta.RawDeltaDownload, 10))
+		query.WriteString("','")
+		query.WriteString(btoa(delta.Seeding))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatInt(delta.StartTime, 10))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatInt(delta.LastAnnounce, 10))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatInt(delta.DeltaTime, 10))
+		query.WriteString("','")
+		query.WriteString(btoa(delta.Active))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatUint(delta.DeltaSnatch, 10))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatUint(delta.Left, 10))
+		query.WriteString("')")
+	}
+
+	query.WriteString("\nON DUPLICATE KEY UPDATE uploaded = uploaded + VALUES(uploaded), " +
+		"downloaded = downloaded + VALUES(downloaded), connectable = VALUES(connectable), " +
+		"seeding = VALUES(seeding), seedtime = seedtime + VALUES(seedtime), last_announce = VALUES(last_announce), " +
+		"active = VALUES(active), snatched = snatched + VALUES(snatched), remaining = VALUES(remaining);")
+
+	_, err := b.transferHistoryConn.execBuffer(&query)
+	return err
+}
+
+func (b *MySQLBackend) FlushTransferIps(deltas []TransferIpDelta) error {
+	b.transferIpsConn.mutex.Lock()
+	defer b.transferIpsConn.mutex.Unlock()
+
+	var query bytes.Buffer
+	query.Grow(len(deltas) * 95) // ~95 bytes per record max
+
+	query.WriteString("INSERT INTO transfer_ips (uid, fid, peer_id, starttime, ip, port) VALUES\n")
+
+	for i, delta := range deltas {
+		if i != 0 {
+			query.WriteRune(',')
+		}
+		query.WriteString("('")
+		query.WriteString(strconv.FormatUint(delta.UserId, 10))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatUint(delta.TorrentId, 10))
+		query.WriteString("','")
+		query.WriteString(base64.StdEncoding.EncodeToString([]byte(delta.PeerId))) // ~30 bytes
+		query.WriteString("','")
+		query.WriteString(strconv.FormatInt(delta.StartTime, 10))
+		query.WriteString("','")
+		query.WriteString(delta.Ip)
+		query.WriteString("','")
+		query.WriteString(strconv.FormatUint(uint64(delta.Port), 10))
+		query.WriteString("')")
+	}
+
+	query.WriteString("\nON DUPLICATE KEY UPDATE ip = VALUES(ip), port = VALUES(port);")
+
+	_, err := b.transferIpsConn.execBuffer(&query)
+	return err
+}
+
+func (b *MySQLBackend) FlushSnatches(deltas []SnatchDelta) error {
+	b.snatchConn.mutex.Lock()
+	defer b.snatchConn.mutex.Unlock()
+
+	var query bytes.Buffer
+	query.Grow(len(deltas) * 36) // ~36 bytes per record max
+
+	query.WriteString("INSERT INTO transfer_history (uid, fid, snatched_time) VALUES\n")
+
+	for i, delta := range deltas {
+		if i != 0 {
+			query.WriteRune(',')
+		}
+		query.WriteString("('")
+		query.WriteString(strconv.FormatUint(delta.UserId, 10))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatUint(delta.TorrentId, 10))
+		query.WriteString("','")
+		query.WriteString(strconv.FormatInt(delta.Time, 10))
+		query.WriteString("')")
+	}
+
+	query.WriteString("\nON DUPLICATE KEY UPDATE snatched_time = VALUES(snatched_time);")
+
+	_, err := b.snatchConn.execBuffer(&query)
+	return err
+}
+
+func OpenDatabaseConnection() (db *DatabaseConnection) {
+	db = &DatabaseConnection{}
+
+	db.sqlDb = mysql.New(config.Loaded.Database.Proto,
+		"",
+		config.Loaded.Database.Addr,
+		config.Loaded.Database.Username,
+		config.Loaded.Database.Password,
+		config.Loaded.Database.Database,
+	)
+
+	err := db.sqlDb.Connect()
+	if err != nil {
+		mysqlLogger.Fatal("Couldn't connect to database", "proto", config.Loaded.Database.Proto, "addr", config.Loaded.Database.Addr, "err", err)
+	}
+	return
+}
+
+func (db *DatabaseConnection) Close() error {
+	return db.sqlDb.Close()
+}
+
+func (db *DatabaseConnection) prepareStatement(sql string) mysql.Stmt {
+	stmt, err := db.sqlDb.Prepare(sql)
+	if err != nil {
+		mysqlLogger.Fatal("Failed to prepare statement", "sql", sql, "err", err)
+	}
+	return stmt
+}
+
+// prepareOptional prepares a statement on a table or column added by a migration, returning nil if the database
+// doesn't have it yet.
+func (db *DatabaseConnection) prepareOptional(sql string, migration string) mysql.Stmt {
+	stmt, err := db.sqlDb.Prepare(sql)
+	if merr, isMysqlError := err.(*mysql.Error); isMysqlError && (merr.Code == 1146 || merr.Code == 1054) {
+		mysqlLogger.Warning("Database is missing a migration, see README.md", "migration", migration, "err", err)
+		return nil
+	} else if err != nil {
+		mysqlLogger.Fatal("Failed to prepare statement", "sql", sql, "err", err)
+	}
+	return stmt
+}
+
+/*
+ * mymysql uses different semantics than the database/sql interface
+ * For some reason (for prepared statements), mymysql's Exec is the equivalent of Query, and Run is the equivalent of Exec.
+ * For the connection object, Query is still Query, but Start is Exec
+ *
+ * This is really confusing, which is why these wrapper functions are named as such
+ */
+
+func (db *DatabaseConnection) query(stmt mysql.Stmt, args ...interface{}) (mysql.Result, error) {
+	return db.exec(stmt, args...)
+}
+
+func (db *DatabaseConnection) exec(stmt mysql.Stmt, args ...interface{}) (result mysql.Result, err error) {
+	var tries int
+	var wait int64
+
+	for tries = 0; tries < config.Current().MaxDeadlockRetries; tries++ {
+		result, err = stmt.Run(args...)
+		if err != nil {
+			if merr, isMysqlError := err.(*mysql.Error); isMysqlError {
+				if merr.Code == 1213 || merr.Code == 1205 {
+					wait = config.Current().Intervals.DeadlockWait.Nanoseconds() * int64(tries+1)
+					mysqlLogger.Warning("Deadlock, retrying", "wait_ms", wait/1000000, "try", tries+1, "max_tries", config.Current().MaxDeadlockRetries)
+					deadlockRetries.Inc()
+					time.Sleep(time.Duration(wait))
+					continue
+				}
+			} else {
+				return nil, db.connectionError(err)
+			}
+		}
+		return
+	}
+	return nil, fmt.Errorf("deadlocked %d times, giving up", tries)
+}
+
+// connectionError reconnects after an error that didn't come from MySQL, so the query can be retried later.
+func (db *DatabaseConnection) connectionError(err error) error {
+	mysqlLogger.Critical("Error executing SQL, reconnecting", "err", err)
+	if rerr := db.sqlDb.Reconnect(); rerr != nil {
+		mysqlLogger.Critical("Failed to reconnect to database", "err", rerr)
+	}
+	return fmt.Errorf("error executing SQL: %v", err)
+}
+
+func (db *DatabaseConnection) execBuffer(query *bytes.Buffer) (result mysql.Result, err error) {
+	var tries int
+	var wait int64
+
+	for tries = 0; tries < config.Current().MaxDeadlockRetries; tries++ {
+		result, err = db.sqlDb.Start(query.String())
+		if err != nil {
+			if merr, isMysqlError := err.(*mysql.Error); isMysqlError {
+				if merr.Code == 1213 || merr.Code == 1205 {
+					wait = config.Current().Intervals.DeadlockWait.Nanoseconds() * int64(tries+1)
+					mysqlLogger.Warning("Deadlock, retrying", "wait_ms", wait/1000000, "try", tries+1, "max_tries", config.Current().MaxDeadlockRetries)
+					deadlockRetries.Inc()
+					time.Sleep(time.Duration(wait))
+					continue
+				}
+				// Too many connections and server shutdown say nothing about the rows
+				if merr.Code != 1040 && merr.Code != 1053 {
+					return nil, &RejectedError{err}
+				}
+			} else {
+				return nil, db.connectionError(err)
+			}
+		}
+		return
+	}
+	return nil, fmt.Errorf("deadlocked %d times, giving up", tries)
+}
@@ -4,125 +4,153 @@
 
 package database
 
-import (
-	"encoding/base64"
-	"strconv"
-)
-
 /*
  * For these, we assume that the caller already has a read lock on the record
  *
- * Buffers are used for efficient string concatenation
- * It may look ugly with all the explicit type conversions, but this tracker is about speed
- *
- * These functions take from the buffer pool but don't give back,
- * so it's expected that the buffers are returned in the flush functions
+ * The deltas are copied onto the flush channels, so the records can keep changing after they've been recorded.
+ * Each delta is journaled before it's queued, see journal.go
+ * Once the database is terminated, deltas are dropped instead
  */
 
 func (db *Database) RecordTorrent(torrent *Torrent, deltaSnatch uint64) {
-	tq := db.bufferPool.Take() // ~50 bytes per record max
-	tq.WriteString("('")
-	tq.WriteString(strconv.FormatUint(torrent.Id, 10))
-	tq.WriteString("','")
-	tq.WriteString(strconv.FormatUint(deltaSnatch, 10))
-	tq.WriteString("','")
-	tq.WriteString(strconv.FormatInt(int64(len(torrent.Seeders)), 10))
-	tq.WriteString("','")
-	tq.WriteString(strconv.FormatInt(int64(len(torrent.Leechers)), 10))
-	tq.WriteString("','")
-	tq.WriteString(strconv.FormatInt(torrent.LastAction, 10))
-	tq.WriteString("')")
-
-	db.torrentChannel <- tq
+	if !db.startRecording("torrents") {
+		return
+	}
+	defer db.recording.RUnlock()
+
+	delta := TorrentDelta{
+		Id:          torrent.Id,
+		DeltaSnatch: deltaSnatch,
+		Seeders:     len(torrent.Seeders),
+		Leechers:    len(torrent.Leechers),
+		LastAction:  torrent.LastAction,
+	}
+	delta.segment = db.journal.append(&journalEntry{Torrent: &delta})
+	db.torrentChannel <- delta
+}
+
+// recordDeletedTorrent records the final state of a torrent that was removed from the cache, after its peers were evicted.
+func (db *Database) recordDeletedTorrent(torrent *Torrent) {
+	if !db.startRecording("torrents") {
+		return
+	}
+	defer db.recording.RUnlock()
+
+	delta := TorrentDelta{
+		Id:         torrent.Id,
+		Seeders:    len(torrent.Seeders),
+		Leechers:   len(torrent.Leechers),
+		LastAction: torrent.LastAction,
+		Deleted:    true,
+	}
+	delta.segment = db.journal.append(&journalEntry{Torrent: &delta})
+	db.torrentChannel <- delta
 }
 
 func (db *Database) RecordUser(user *User, rawDeltaUpload int64, rawDeltaDownload int64, deltaUpload int64, deltaDownload int64) {
-	uq := db.bufferPool.Take() // ~60 bytes per record max
-	uq.WriteString("('")
-	uq.WriteString(strconv.FormatUint(user.Id, 10))
-	uq.WriteString("','")
-	uq.WriteString(strconv.FormatInt(deltaUpload, 10))
-	uq.WriteString("','")
-	uq.WriteString(strconv.FormatInt(deltaDownload, 10))
-	uq.WriteString("','")
-	uq.WriteString(strconv.FormatInt(rawDeltaDownload, 10))
-	uq.WriteString("','")
-	uq.WriteString(strconv.FormatInt(rawDeltaUpload, 10))
-	uq.WriteString("')")
-
-	db.userChannel <- uq
+	if !db.startRecording("users_main") {
+		return
+	}
+	defer db.recording.RUnlock()
+
+	delta := UserDelta{
+		Id:               user.Id,
+		RawDeltaUpload:   rawDeltaUpload,
+		RawDeltaDownload: rawDeltaDownload,
+		DeltaUpload:      deltaUpload,
+		DeltaDownload:    deltaDownload,
+	}
+	delta.segment = db.journal.append(&journalEntry{User: &delta})
+	db.userChannel <- delta
 }
 
 func (db *Database) RecordTransferHistory(peer *Peer, rawDeltaUpload int64, rawDeltaDownload int64, deltaTime int64, deltaSnatch uint64, active bool) {
-	th := db.bufferPool.Take() // ~110 bytes per record max
-
-	th.WriteString("('")
-	th.WriteString(strconv.FormatUint(peer.UserId, 10))
-	th.WriteString("','")
-	th.WriteString(strconv.FormatUint(peer.TorrentId, 10))
-	th.WriteString("','")
-	th.WriteString(strconv.FormatInt(rawDeltaUpload, 10))
-	th.WriteString("','")
-	th.WriteString(strconv.FormatInt(rawDeltaDownload, 10))
-	th.WriteString("','")
-	th.WriteString(btoa(peer.Seeding))
-	th.WriteString("','")
-	th.WriteString(strconv.FormatInt(peer.StartTime, 10))
-	th.WriteString("','")
-	th.WriteString(strconv.FormatInt(peer.LastAnnounce, 10))
-	th.WriteString("','")
-	th.WriteString(strconv.FormatInt(deltaTime, 10))
-	th.WriteString("','")
-	th.WriteString(btoa(active))
-	th.WriteString("','")
-	th.WriteString(strconv.FormatUint(deltaSnatch, 10))
-	th.WriteString("','")
-	th.WriteString(strconv.FormatUint(peer.Left, 10))
-	th.WriteString("')")
-
-	db.transferHistoryChannel <- th
+	if !db.startRecording("transfer_history") {
+		return
+	}
+	defer db.recording.RUnlock()
+
+	delta := TransferHistoryDelta{
+		UserId:           peer.UserId,
+		TorrentId:        peer.TorrentId,
+		RawDeltaUpload:   rawDeltaUpload,
+		RawDeltaDownload: rawDeltaDownload,
+		Seeding:          peer.Seeding,
+		StartTime:        peer.StartTime,
+		LastAnnounce:     peer.LastAnnounce,
+		DeltaTime:        deltaTime,
+		Active:           active,
+		DeltaSnatch:      deltaSnatch,
+		Left:             peer.Left,
+	}
+	delta.segment = db.journal.append(&journalEntry{TransferHistory: &delta})
+	db.transferHistoryChannel <- delta
 }
 
 func (db *Database) RecordTransferIp(peer *Peer) {
-	ti := db.bufferPool.Take() // ~95 bytes per record max
-
-	ti.WriteString("('")
-	ti.WriteString(strconv.FormatUint(peer.UserId, 10))
-	ti.WriteString("','")
-	ti.WriteString(strconv.FormatUint(peer.TorrentId, 10))
-	ti.WriteString("','")
-	ti.WriteString(base64.StdEncoding.EncodeToString([]byte(peer.Id))) // ~30 bytes
-	ti.WriteString("','")
-	ti.WriteString(strconv.FormatInt(peer.StartTime, 10))
-	ti.WriteString("','")
-	ti.WriteString(peer.Ip)
-	ti.WriteString("','")
-	ti.WriteString(strconv.FormatUint(uint64(peer.Port), 10))
-	ti.WriteString("')")
-
-	db.transferIpsChannel <- ti
+	if !db.startRecording("transfer_ips") {
+		return
+	}
+	defer db.recording.RUnlock()
+
+	ip := peer.Ip
+	if ip == "" {
+		ip = peer.Ip6
+	}
+
+	delta := TransferIpDelta{
+		UserId:    peer.UserId,
+		TorrentId: peer.TorrentId,
+		PeerId:    peer.Id,
+		StartTime: peer.StartTime,
+		Ip:        ip,
+		Port:      peer.Port,
+	}
+	delta.segment = db.journal.append(&journalEntry{TransferIp: &delta})
+	db.transferIpsChannel <- delta
 }
 
 func (db *Database) RecordSnatch(peer *Peer, now int64) {
-	sn := db.bufferPool.Take() // ~36 bytes per record max
-
-	sn.WriteString("('")
-	sn.WriteString(strconv.FormatUint(peer.UserId, 10))
-	sn.WriteString("','")
-	sn.WriteString(strconv.FormatUint(peer.TorrentId, 10))
-	sn.WriteString("','")
-	sn.WriteString(strconv.FormatInt(now, 10))
-	sn.WriteString("')")
-
-	db.snatchChannel <- sn
+	if !db.startRecording("snatches") {
+		return
+	}
+	defer db.recording.RUnlock()
+
+	delta := SnatchDelta{
+		UserId:    peer.UserId,
+		TorrentId: peer.TorrentId,
+		Time:      now,
+	}
+	delta.segment = db.journal.append(&journalEntry{Snatch: &delta})
+	db.snatchChannel <- delta
 }
 
+// VerifyUsedSlots queues the user for slot verification, unless the queue is full.
 func (db *Database) VerifyUsedSlots(user *User) {
-	db.slotVerificationChannel <- user
+	if !db.startRecording("slots") {
+		return
+	}
+	defer db.recording.RUnlock()
+
+	select {
+	case db.slotVerificationChannel <- user:
+	default:
+	}
+}
+
+// startRecording read locks recording, unless the database was terminated and the delta has to be dropped.
+func (db *Database) startRecording(label string) bool {
+	db.recording.RLock()
+	if db.closed {
+		db.recording.RUnlock()
+		flushLogger.Warning("Dropped delta recorded after termination", "table", label)
+		return false
+	}
+	return true
 }
 
 func (db *Database) UnPrune(torrent *Torrent) {
-	db.mainConn.mutex.Lock()
-	db.mainConn.exec(db.unPruneTorrentStmt, torrent.Id)
-	db.mainConn.mutex.Unlock()
+	if err := db.backend.UnPrune(torrent.Id); err != nil {
+		logger.Critical("Failed to unprune torrent", "torrent_id", torrent.Id, "err", err)
+	}
 }
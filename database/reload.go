@@ -5,8 +5,7 @@
 package database
 
 import (
-	"io"
-	"log"
+	"net"
 	"time"
 
 	"github.com/kotoko/chihaya/config"
@@ -20,188 +19,320 @@ import (
  *   - Writing is blocked until all current readers release the mutex
  *   - Once a writer locks the mutex, new readers block until the writer unlocks it
  */
-func (db *Database) startReloading() {
-	go func() {
-		count := 0
-		for !db.terminate {
-			db.waitGroup.Add(1)
-			db.loadUsers()
-			db.loadTorrents()
-			db.loadConfig()
-
-			if count%10 == 0 {
-				db.loadWhitelist()
-			}
+func (db *Database) startReloading(wait bool) {
+	// The first reload is done synchronously, so that announces can be answered as soon as Init returns,
+	// unless the caches are known to be current
+	if wait {
+		db.reload(0, true)
+	}
 
-			count++
-			db.waitGroup.Done()
-			time.Sleep(config.Loaded.Intervals.DatabaseReload.Duration)
+	db.startWorker(func() {
+		if !wait {
+			db.reload(0, true)
 		}
-	}()
-}
+		lastFullReload := time.Now()
 
-func (db *Database) loadUsers() {
-	var err error
-	var count uint
+		for count := 1; db.sleep(config.Current().Intervals.DatabaseReload.Duration); count++ {
+			full := time.Now().Sub(lastFullReload) >= config.Current().Intervals.FullDatabaseReload.Duration
+			if full {
+				lastFullReload = time.Now()
+			}
+			db.reload(count, full)
+		}
+	})
+}
 
-	db.UsersMutex.Lock()
-	db.mainConn.mutex.Lock()
-	start := time.Now()
-	result := db.mainConn.query(db.loadUsersStmt)
+/*
+ * A full reload reads every user and torrent, and drops the ones that are gone.
+ * In between, only the changes since the last reload are read from the backend's change log.
+ */
+func (db *Database) reload(count int, full bool) {
+	if !full && !db.loadChanges() {
+		full = true
+	}
+	if full {
+		// Taken first, so that changes made during the full load are read again by the next incremental one
+		position, err := db.backend.ChangePosition()
+		if err != nil {
+			logger.Critical("Failed to read change position", "err", err)
+		} else {
+			db.changePosition = position
+		}
 
-	newUsers := make(map[string]*User, len(db.Users))
+		db.loadUsers()
+		db.loadTorrents()
+	}
+	db.loadConfig()
+	db.loadBans()
 
-	row := &rowWrapper{result.MakeRow()}
+	if count%10 == 0 {
+		db.loadClientRules()
+	}
+}
 
-	id := result.Map("ID")
-	torrentPass := result.Map("torrent_pass")
-	downMultiplier := result.Map("DownMultiplier")
-	upMultiplier := result.Map("UpMultiplier")
-	slots := result.Map("Slots")
+/*
+ * The backend is queried before taking the write lock, so announces are only blocked while the results are merged.
+ * Existing records are updated in place to keep the state that isn't stored in the backend (peers, used slots).
+ */
 
-	for {
-		err = result.ScanRow(row.r)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			log.Panicf("Error scanning user rows: %v", err)
-		}
+func (db *Database) loadUsers() {
+	start := time.Now()
+	users, err := db.backend.LoadUsers()
+	if err != nil {
+		logger.Critical("Failed to load users", "err", err)
+		return
+	}
 
-		torrentPass := row.Str(torrentPass)
+	db.UsersMutex.Lock()
+	newUsers := make(map[string]*User, len(users))
 
-		old, exists := db.Users[torrentPass]
+	for passkey, user := range users {
+		old, exists := db.Users[passkey]
 		if exists && old != nil {
-			old.Id = row.Uint64(id)
-			old.DownMultiplier = row.Float64(downMultiplier)
-			old.UpMultiplier = row.Float64(upMultiplier)
-			old.Slots = row.Int64(slots)
-			newUsers[torrentPass] = old
+			old.update(user)
+			newUsers[passkey] = old
 		} else {
-			newUsers[torrentPass] = &User{
-				Id:             row.Uint64(id),
-				UpMultiplier:   row.Float64(downMultiplier),
-				DownMultiplier: row.Float64(upMultiplier),
-				Slots:          row.Int64(slots),
-				UsedSlots:      0,
-			}
+			user.UsedSlots = 0
+			newUsers[passkey] = user
 		}
-		count++
 	}
-	db.mainConn.mutex.Unlock()
 
 	db.Users = newUsers
 	db.UsersMutex.Unlock()
 
-	log.Printf("User load complete (%d rows, %dms)", count, time.Now().Sub(start).Nanoseconds()/1000000)
+	reloadDuration.ObserveSince("users", start)
+	logger.Info("User load complete", "rows", len(users), "duration_ms", time.Now().Sub(start).Nanoseconds()/1000000)
 }
 
 func (db *Database) loadTorrents() {
-	var err error
-	var count uint
-
-	db.TorrentsMutex.Lock()
-	db.mainConn.mutex.Lock()
 	start := time.Now()
-	result := db.mainConn.query(db.loadTorrentsStmt)
-
-	newTorrents := make(map[string]*Torrent)
-
-	row := &rowWrapper{result.MakeRow()}
-
-	id := result.Map("ID")
-	infoHash := result.Map("info_hash")
-	downMultiplier := result.Map("DownMultiplier")
-	upMultiplier := result.Map("UpMultiplier")
-	snatched := result.Map("Snatched")
-	status := result.Map("Status")
-
-	for {
-		err = result.ScanRow(row.r)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			log.Panicf("Error scanning torrent rows: %v", err)
-		}
+	torrents, err := db.backend.LoadTorrents()
+	if err != nil {
+		logger.Critical("Failed to load torrents", "err", err)
+		return
+	}
 
-		infoHash := row.Str(infoHash)
+	db.TorrentsMutex.Lock()
+	newTorrents := make(map[string]*Torrent, len(torrents))
 
+	for infoHash, torrent := range torrents {
 		old, exists := db.Torrents[infoHash]
 		if exists && old != nil {
-			old.Id = row.Uint64(id)
-			old.DownMultiplier = row.Float64(downMultiplier)
-			old.UpMultiplier = row.Float64(upMultiplier)
-			old.Snatched = row.Uint(snatched)
-			old.Status = row.Int64(status)
+			old.update(torrent)
 			newTorrents[infoHash] = old
 		} else {
-			newTorrents[infoHash] = &Torrent{
-				Id:             row.Uint64(id),
-				UpMultiplier:   row.Float64(downMultiplier),
-				DownMultiplier: row.Float64(upMultiplier),
-				Snatched:       row.Uint(snatched),
-				Status:         row.Int64(status),
-
-				Seeders:  make(map[string]*Peer),
-				Leechers: make(map[string]*Peer),
-			}
+			torrent.Seeders = make(map[string]*Peer)
+			torrent.Leechers = make(map[string]*Peer)
+			newTorrents[infoHash] = torrent
+		}
+	}
+
+	var evicted []eviction
+	for infoHash, torrent := range db.Torrents {
+		if _, exists := newTorrents[infoHash]; !exists && torrent != nil {
+			evicted = append(evicted, evictTorrent(torrent))
 		}
-		count++
 	}
-	db.mainConn.mutex.Unlock()
 
 	db.Torrents = newTorrents
 	db.TorrentsMutex.Unlock()
 
-	log.Printf("Torrent load complete (%d rows, %dms)", count, time.Now().Sub(start).Nanoseconds()/1000000)
+	db.recordEvictions(evicted)
+
+	reloadDuration.ObserveSince("torrents", start)
+	logger.Info("Torrent load complete", "rows", len(torrents), "duration_ms", time.Now().Sub(start).Nanoseconds()/1000000)
 }
 
-func (db *Database) loadConfig() {
-	db.mainConn.mutex.Lock()
-	result := db.mainConn.query(db.loadFreeleechStmt)
-	for {
-		row, err := result.GetRow()
-		if err != nil || row == nil {
-			break
+// loadChanges returns false if the backend has no change log, so a full load is needed instead.
+func (db *Database) loadChanges() bool {
+	start := time.Now()
+	changes, err := db.backend.LoadChanges(db.changePosition)
+	if err == ErrNoChangeLog {
+		return false
+	} else if err != nil {
+		logger.Critical("Failed to load changes", "err", err)
+		return true
+	}
+	db.changePosition = changes.Position
+
+	userCount := len(changes.Users) + len(changes.DeletedUsers)
+	torrentCount := len(changes.Torrents) + len(changes.DeletedTorrents)
+	if userCount == 0 && torrentCount == 0 {
+		reloadDuration.ObserveSince("changes", start)
+		return true
+	}
+
+	if userCount > 0 {
+		db.UsersMutex.Lock()
+		db.applyUserChanges(changes)
+		db.UsersMutex.Unlock()
+	}
+
+	if torrentCount > 0 {
+		db.TorrentsMutex.Lock()
+		evicted := db.applyTorrentChanges(changes)
+		db.TorrentsMutex.Unlock()
+
+		db.recordEvictions(evicted)
+	}
+
+	reloadDuration.ObserveSince("changes", start)
+	logger.Info("Change load complete", "users", userCount, "torrents", torrentCount, "duration_ms", time.Now().Sub(start).Nanoseconds()/1000000)
+	return true
+}
+
+/*
+ * The caches are keyed by passkey and info hash, which may have changed too, so records are matched by ID.
+ * Changed records are taken out of the cache along with the deleted ones, and put back in under their current key.
+ */
+
+func (db *Database) applyUserChanges(changes *Changes) {
+	ids := make(map[uint64]*User, len(changes.Users)+len(changes.DeletedUsers))
+	for _, id := range changes.DeletedUsers {
+		ids[id] = nil
+	}
+	for _, user := range changes.Users {
+		ids[user.Id] = nil
+	}
+
+	for passkey, user := range db.Users {
+		if _, changed := ids[user.Id]; changed {
+			ids[user.Id] = user
+			delete(db.Users, passkey)
+		}
+	}
+
+	for passkey, user := range changes.Users {
+		if old := ids[user.Id]; old != nil {
+			old.update(user)
+			db.Users[passkey] = old
+		} else {
+			user.UsedSlots = 0
+			db.Users[passkey] = user
+		}
+	}
+}
+
+// applyTorrentChanges returns the deleted torrents, see evictTorrent.
+func (db *Database) applyTorrentChanges(changes *Changes) []eviction {
+	ids := make(map[uint64]*Torrent, len(changes.Torrents)+len(changes.DeletedTorrents))
+	for _, id := range changes.DeletedTorrents {
+		ids[id] = nil
+	}
+	for _, torrent := range changes.Torrents {
+		ids[torrent.Id] = nil
+	}
+
+	for infoHash, torrent := range db.Torrents {
+		if _, changed := ids[torrent.Id]; changed {
+			ids[torrent.Id] = torrent
+			delete(db.Torrents, infoHash)
+		}
+	}
+
+	for infoHash, torrent := range changes.Torrents {
+		if old := ids[torrent.Id]; old != nil {
+			old.update(torrent)
+			db.Torrents[infoHash] = old
+			ids[torrent.Id] = nil
 		} else {
-			config.Loaded.GlobalFreeleech = row.Bool(0)
+			torrent.Seeders = make(map[string]*Peer)
+			torrent.Leechers = make(map[string]*Peer)
+			db.Torrents[infoHash] = torrent
 		}
 	}
-	db.mainConn.mutex.Unlock()
+
+	// Whatever wasn't put back was deleted
+	var evicted []eviction
+	for _, old := range ids {
+		if old != nil {
+			evicted = append(evicted, evictTorrent(old))
+		}
+	}
+	return evicted
 }
 
-func (db *Database) loadWhitelist() {
-	var err error
-	var count int
+func (db *Database) loadConfig() {
+	freeleech, err := db.backend.LoadGlobalFreeleech()
+	if err != nil {
+		logger.Critical("Failed to load global freeleech", "err", err)
+		return
+	}
+	config.Loaded.GlobalFreeleech = freeleech
+}
 
-	db.WhitelistMutex.Lock()
-	db.mainConn.mutex.Lock()
+func (db *Database) loadClientRules() {
 	start := time.Now()
-	result := db.mainConn.query(db.loadWhitelistStmt)
+	rules, err := db.backend.LoadClientRules()
+	if err != nil {
+		logger.Critical("Failed to load client rules", "err", err)
+		return
+	}
 
-	row := result.MakeRow()
+	policy, invalid := NewClientPolicy(rules)
+	for _, rule := range invalid {
+		logger.Warning("Skipping invalid client rule", "prefix", rule.Prefix, "min_version", rule.MinVersion, "max_version", rule.MaxVersion)
+	}
 
-	db.Whitelist = db.Whitelist[0:1] // Effectively clear the whitelist
+	db.ClientsMutex.Lock()
+	db.Clients = policy
+	db.ClientsMutex.Unlock()
 
-	for {
-		err = result.ScanRow(row)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			log.Panicf("Error scanning whitelist rows: %v", err)
-		}
-		if count >= cap(db.Whitelist) {
-			newSlice := make([]string, count, count*2)
-			copy(newSlice, db.Whitelist)
-			db.Whitelist = newSlice
-		} else if count >= len(db.Whitelist) {
-			db.Whitelist = db.Whitelist[0 : count+1]
+	// Still labeled whitelist, as the rules come from the client whitelist table
+	reloadDuration.ObserveSince("whitelist", start)
+	logger.Info("Client rules load complete", "rows", len(rules), "duration_ms", time.Now().Sub(start).Nanoseconds()/1000000)
+}
+
+// CheckClient returns whether the client with the given peer ID is approved, and the failure reason if it isn't.
+func (db *Database) CheckClient(peerId string) (approved bool, reason string) {
+	db.ClientsMutex.RLock()
+	clients := db.Clients
+	db.ClientsMutex.RUnlock()
+
+	return clients.Check(peerId)
+}
+
+// loadBans reads the bans from the backend and the ban file. If either fails, the previous bans are kept.
+func (db *Database) loadBans() {
+	start := time.Now()
+	entries, err := db.backend.LoadBans()
+	if err != nil {
+		logger.Critical("Failed to load bans", "err", err)
+		return
+	}
+
+	if path := config.Current().Bans.File; path != "" {
+		fileEntries, err := readBanFile(path)
+		if err != nil {
+			logger.Critical("Failed to read ban file", "err", err)
+			return
 		}
-		db.Whitelist[count] = row.Str(0)
-		count++
+		entries = append(entries, fileEntries...)
+	}
+
+	bans, invalid := NewBanList(entries)
+	for _, entry := range invalid {
+		logger.Warning("Skipping invalid ban", "entry", entry)
 	}
-	db.mainConn.mutex.Unlock()
 
-	db.WhitelistMutex.Unlock()
+	db.BansMutex.Lock()
+	db.Bans = bans
+	db.BansMutex.Unlock()
+
+	reloadDuration.ObserveSince("bans", start)
+	logger.Debug("Ban load complete", "bans", bans.Len(), "duration_ms", time.Now().Sub(start).Nanoseconds()/1000000)
+}
+
+// Banned returns whether any of the addresses is banned.
+func (db *Database) Banned(ips ...net.IP) bool {
+	db.BansMutex.RLock()
+	bans := db.Bans
+	db.BansMutex.RUnlock()
 
-	log.Printf("Whitelist load complete (%d rows, %dms)", count, time.Now().Sub(start).Nanoseconds()/1000000)
+	for _, ip := range ips {
+		if bans.Banned(ip) {
+			return true
+		}
+	}
+	return false
 }
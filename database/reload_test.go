@@ -0,0 +1,254 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestDatabase(backend Backend) *Database {
+	return &Database{
+		backend:  backend,
+		Users:    make(map[string]*User),
+		Torrents: make(map[string]*Torrent),
+
+		torrentChannel:         make(chan TorrentDelta, 100),
+		transferHistoryChannel: make(chan TransferHistoryDelta, 100),
+	}
+}
+
+// newKeepingBackend returns a memory backend that keeps the flushed deltas to assert on.
+func newKeepingBackend() *MemoryBackend {
+	b := NewMemoryBackend()
+	b.KeepDeltas = true
+	return b
+}
+
+func TestIncrementalReload(t *testing.T) {
+	b := NewMemoryBackend()
+	b.AddUser("passkey1", &User{Id: 1, Slots: -1})
+	b.AddUser("passkey2", &User{Id: 2, Slots: -1})
+	b.AddTorrent("infohash1", &Torrent{Id: 1})
+	b.AddTorrent("infohash2", &Torrent{Id: 2})
+
+	db := newTestDatabase(b)
+	db.reload(0, true)
+
+	if len(db.Users) != 2 || len(db.Torrents) != 2 {
+		t.Fatalf("Full reload loaded %d users and %d torrents, want 2 and 2", len(db.Users), len(db.Torrents))
+	}
+
+	user1 := db.Users["passkey1"]
+	user1.UsedSlots = 3
+	torrent1 := db.Torrents["infohash1"]
+	torrent1.Seeders["peer"] = &Peer{}
+
+	b.AddUser("newpasskey1", &User{Id: 1, Slots: 5})
+	b.RemoveUser("passkey1")
+	b.RemoveUser("passkey2")
+	b.AddTorrent("infohash1", &Torrent{Id: 1, Status: 1})
+	b.RemoveTorrent("infohash2")
+	b.AddTorrent("infohash3", &Torrent{Id: 3})
+
+	db.reload(1, false)
+
+	if _, exists := db.Users["passkey1"]; exists {
+		t.Error("User still cached under its old passkey")
+	}
+	if _, exists := db.Users["passkey2"]; exists {
+		t.Error("Deleted user still cached")
+	}
+	if user := db.Users["newpasskey1"]; user != user1 || user.Slots != 5 || user.UsedSlots != 3 {
+		t.Errorf("Changed user not updated in place: %+v", user)
+	}
+
+	if _, exists := db.Torrents["infohash2"]; exists {
+		t.Error("Deleted torrent still cached")
+	}
+	if torrent := db.Torrents["infohash1"]; torrent != torrent1 || torrent.Status != 1 || len(torrent.Seeders) != 1 {
+		t.Errorf("Changed torrent not updated in place: %+v", torrent)
+	}
+	if torrent := db.Torrents["infohash3"]; torrent == nil || torrent.Seeders == nil || torrent.Leechers == nil {
+		t.Errorf("New torrent not added: %+v", torrent)
+	}
+
+	// Nothing changed since, so nothing should happen
+	db.reload(2, false)
+	if len(db.Users) != 1 || len(db.Torrents) != 2 {
+		t.Errorf("Empty reload changed the caches: %d users, %d torrents", len(db.Users), len(db.Torrents))
+	}
+}
+
+// noChangeLogBackend is a backend whose database lacks the change log table.
+type noChangeLogBackend struct {
+	*MemoryBackend
+}
+
+func (b noChangeLogBackend) LoadChanges(position uint64) (*Changes, error) {
+	return nil, ErrNoChangeLog
+}
+
+func TestReloadWithoutChangeLog(t *testing.T) {
+	b := NewMemoryBackend()
+	b.AddUser("passkey1", &User{Id: 1, Slots: -1})
+	b.AddTorrent("infohash1", &Torrent{Id: 1})
+
+	db := newTestDatabase(noChangeLogBackend{b})
+	db.reload(0, true)
+
+	b.RemoveUser("passkey1")
+	b.AddUser("passkey2", &User{Id: 2, Slots: -1})
+	b.RemoveTorrent("infohash1")
+
+	db.reload(1, false)
+
+	if _, exists := db.Users["passkey1"]; exists {
+		t.Error("Deleted user still cached")
+	}
+	if _, exists := db.Users["passkey2"]; !exists {
+		t.Error("New user not added")
+	}
+	if _, exists := db.Torrents["infohash1"]; exists {
+		t.Error("Deleted torrent still cached")
+	}
+}
+
+func TestTorrentDeletion(t *testing.T) {
+	for _, full := range []bool{true, false} {
+		b := NewMemoryBackend()
+		b.AddUser("passkey1", &User{Id: 1, Slots: 2})
+		b.AddTorrent("infohash1", &Torrent{Id: 1})
+		b.AddTorrent("infohash2", &Torrent{Id: 2})
+
+		db := newTestDatabase(b)
+		db.reload(0, true)
+
+		db.Users["passkey1"].UsedSlots = 2
+		db.Torrents["infohash1"].Leechers["leecher"] = &Peer{UserId: 1, TorrentId: 1}
+		db.Torrents["infohash1"].Seeders["seeder"] = &Peer{UserId: 2, TorrentId: 1, Seeding: true}
+		db.Torrents["infohash2"].Leechers["leecher"] = &Peer{UserId: 1, TorrentId: 2}
+
+		b.RemoveTorrent("infohash1")
+		db.reload(1, full)
+
+		if _, exists := db.Torrents["infohash1"]; exists {
+			t.Errorf("Deleted torrent still cached (full reload: %t)", full)
+		}
+		if usedSlots := db.Users["passkey1"].UsedSlots; usedSlots != 1 {
+			t.Errorf("Used slots %d after deleting a leeched torrent, want 1 (full reload: %t)", usedSlots, full)
+		}
+
+		if len(db.transferHistoryChannel) != 2 {
+			t.Fatalf("Recorded %d transfer history deltas, want 2 (full reload: %t)", len(db.transferHistoryChannel), full)
+		}
+		for len(db.transferHistoryChannel) > 0 {
+			delta := <-db.transferHistoryChannel
+			if delta.TorrentId != 1 || delta.Active {
+				t.Errorf("Evicted peer not recorded as inactive: %+v", delta)
+			}
+		}
+
+		if len(db.torrentChannel) != 1 {
+			t.Fatalf("Recorded %d torrent deltas, want 1 (full reload: %t)", len(db.torrentChannel), full)
+		}
+		if delta := <-db.torrentChannel; delta.Id != 1 || !delta.Deleted || delta.Seeders != 0 || delta.Leechers != 0 {
+			t.Errorf("Unexpected final torrent delta: %+v", delta)
+		}
+	}
+}
+
+func TestDeleteTorrentWithFullQueue(t *testing.T) {
+	b := NewMemoryBackend()
+	b.AddTorrent("infohash1", &Torrent{Id: 1})
+	b.AddTorrent("infohash2", &Torrent{Id: 2})
+
+	db := newTestDatabase(b)
+	db.transferHistoryChannel = make(chan TransferHistoryDelta)
+	db.reload(0, true)
+	db.Torrents["infohash1"].Seeders["seeder"] = &Peer{UserId: 1, TorrentId: 1, Seeding: true}
+
+	deleted := make(chan bool)
+	go func() {
+		db.DeleteTorrent("infohash1")
+		close(deleted)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Announces to other torrents shouldn't wait for the flush queue
+	locked := make(chan bool)
+	go func() {
+		db.TorrentsMutex.RLock()
+		db.TorrentsMutex.RUnlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Error("Torrents lock held while recording the evicted peers")
+	}
+
+	if delta := <-db.transferHistoryChannel; delta.TorrentId != 1 || delta.Active {
+		t.Errorf("Evicted peer not recorded as inactive: %+v", delta)
+	}
+	<-deleted
+	<-locked
+}
+
+// Meant to be run with -race, swarms change while reloads and purges run
+func TestConcurrentPurgeAndReload(t *testing.T) {
+	b := NewMemoryBackend()
+	b.AddUser("passkey1", &User{Id: 1, Slots: -1})
+	for i := 0; i < 10; i++ {
+		b.AddTorrent(fmt.Sprintf("infohash%d", i), &Torrent{Id: uint64(i + 1)})
+	}
+
+	db := newTestDatabase(b)
+	db.torrentChannel = make(chan TorrentDelta, 1000)
+	db.reload(0, true)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(infoHash string) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				db.TorrentsMutex.RLock()
+				if torrent, exists := db.Torrents[infoHash]; exists {
+					torrent.Lock()
+					torrent.Leechers[fmt.Sprint(j)] = &Peer{UserId: 1, LastAnnounce: int64(j % 2)}
+					torrent.Unlock()
+				}
+				db.TorrentsMutex.RUnlock()
+			}
+		}(fmt.Sprintf("infohash%d", i))
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 10; j++ {
+			db.reload(j+1, j%2 == 0)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 10; j++ {
+			db.removeInactivePeers(1)
+		}
+	}()
+	wg.Wait()
+
+	db.removeInactivePeers(1)
+	for infoHash, torrent := range db.Torrents {
+		for id, peer := range torrent.Leechers {
+			if peer.LastAnnounce < 1 {
+				t.Errorf("Inactive peer %s left on %s", id, infoHash)
+			}
+		}
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/kotoko/chihaya/config"
+)
+
+/*
+ * Batches that fail to flush are kept and retried in the background, waiting FlushRetryWait after the
+ * first failure and twice as long after each one after that, up to 64 times as long. Once the backend has
+ * rejected a batch MaxFlushRetries times, it's split in half and each half gets one more attempt, so rows the
+ * database rejects are narrowed down without holding back the rest of the batch. Single deltas that are still
+ * rejected are written to the dead letter directory, and the admin replay_dead_letters action queues them up for
+ * flushing again. Batches that fail for any other reason, like the database being unreachable, are retried whole
+ * until they succeed.
+ *
+ * Failed deltas stay in the journal until they're flushed or dead lettered, so the retries pending at shutdown
+ * are replayed on the next start. Without a journal, they're dead lettered instead.
+ *
+ * Retried deltas are flushed after ones that were recorded later, so values that replace the stored ones
+ * (such as seeders or last_announce) can be stale until the next delta for the same row is flushed.
+ */
+
+// flushLabels are the labels of the flush channels, in the order they're flushed when replaying.
+var flushLabels = []string{"torrents", "users_main", "transfer_history", "transfer_ips", "snatches"}
+
+func flushSize(label string) int {
+	switch label {
+	case "torrents":
+		return config.Loaded.FlushSizes.Torrent
+	case "users_main":
+		return config.Loaded.FlushSizes.User
+	case "transfer_history":
+		return config.Loaded.FlushSizes.TransferHistory
+	case "transfer_ips":
+		return config.Loaded.FlushSizes.TransferIps
+	}
+	return config.Loaded.FlushSizes.Snatch
+}
+
+type failedBatch struct {
+	entries  []journalEntry // All from the same channel
+	attempts int
+	retryAt  time.Time
+}
+
+func retryWait(attempts int) time.Duration {
+	return config.Current().Intervals.FlushRetryWait.Duration << uint(minInt(attempts-1, 6))
+}
+
+// retryLater queues a batch that failed to flush for the first time.
+func (db *Database) retryLater(label string, entries []journalEntry) {
+	db.queueRetry(label, &failedBatch{entries: entries, attempts: 1, retryAt: time.Now().Add(retryWait(1))})
+}
+
+func (db *Database) queueRetry(label string, batch *failedBatch) {
+	db.failedMutex.Lock()
+	defer db.failedMutex.Unlock()
+
+	if db.failedBatches == nil {
+		db.failedBatches = make(map[string][]*failedBatch)
+	}
+	db.failedBatches[label] = append(db.failedBatches[label], batch)
+}
+
+func (db *Database) retryFlushes() {
+	for db.sleep(time.Second) {
+		now := time.Now()
+		for _, label := range flushLabels {
+			db.retryFailed(label, now)
+		}
+	}
+}
+
+// retryFailed retries the failed batches of a channel that are due.
+func (db *Database) retryFailed(label string, now time.Time) {
+	var due, waiting []*failedBatch
+
+	db.failedMutex.Lock()
+	for _, batch := range db.failedBatches[label] {
+		if now.Before(batch.retryAt) {
+			waiting = append(waiting, batch)
+		} else {
+			due = append(due, batch)
+		}
+	}
+	if len(due) > 0 {
+		db.failedBatches[label] = waiting
+	}
+	db.failedMutex.Unlock()
+
+	for _, batch := range due {
+		err := db.flushBatch(batch.entries)
+		if err == nil {
+			db.commitEntries(batch.entries)
+			flushLogger.Info("Flushed after retrying", "table", label, "count", len(batch.entries), "attempts", batch.attempts+1)
+			continue
+		}
+
+		flushLogger.Critical("Retrying flush failed", "table", label, "count", len(batch.entries), "attempts", batch.attempts+1, "err", err)
+		flushFailures.Inc(label)
+		batch.attempts++
+
+		_, rejected := err.(*RejectedError)
+		switch {
+		case !rejected || batch.attempts < config.Current().MaxFlushRetries:
+			batch.retryAt = now.Add(retryWait(batch.attempts))
+			db.queueRetry(label, batch)
+		case len(batch.entries) > 1:
+			half := len(batch.entries) / 2
+			db.queueRetry(label, &failedBatch{entries: batch.entries[:half], attempts: batch.attempts - 1, retryAt: now})
+			db.queueRetry(label, &failedBatch{entries: batch.entries[half:], attempts: batch.attempts - 1, retryAt: now})
+		default:
+			db.deadLetter(label, batch.entries)
+		}
+	}
+}
+
+// abandonRetries gives up on the failed batches once flushing has stopped.
+func (db *Database) abandonRetries() {
+	db.failedMutex.Lock()
+	batches := db.failedBatches
+	db.failedBatches = nil
+	db.failedMutex.Unlock()
+
+	for label, batches := range batches {
+		count := 0
+		for _, batch := range batches {
+			if db.journal == nil {
+				db.deadLetter(label, batch.entries)
+			}
+			count += len(batch.entries)
+		}
+		if db.journal != nil && count > 0 {
+			flushLogger.Warning("Deltas that failed to flush will be replayed from the journal", "table", label, "count", count)
+		}
+	}
+}
+
+func (db *Database) commitEntries(entries []journalEntry) {
+	for i := range entries {
+		db.journal.commit(entries[i].segment())
+	}
+}
+
+// flushBatch flushes entries from a single channel.
+func (db *Database) flushBatch(entries []journalEntry) error {
+	switch entries[0].label() {
+	case "torrents":
+		deltas := make([]TorrentDelta, len(entries))
+		for i := range entries {
+			deltas[i] = *entries[i].Torrent
+		}
+		return db.backend.FlushTorrents(coalesceTorrents(deltas))
+	case "users_main":
+		deltas := make([]UserDelta, len(entries))
+		for i := range entries {
+			deltas[i] = *entries[i].User
+		}
+		return db.backend.FlushUsers(coalesceUsers(deltas))
+	case "transfer_history":
+		deltas := make([]TransferHistoryDelta, len(entries))
+		for i := range entries {
+			deltas[i] = *entries[i].TransferHistory
+		}
+		return db.backend.FlushTransferHistory(coalesceTransferHistory(deltas))
+	case "transfer_ips":
+		deltas := make([]TransferIpDelta, len(entries))
+		for i := range entries {
+			deltas[i] = *entries[i].TransferIp
+		}
+		return db.backend.FlushTransferIps(deltas)
+	}
+	deltas := make([]SnatchDelta, len(entries))
+	for i := range entries {
+		deltas[i] = *entries[i].Snatch
+	}
+	return db.backend.FlushSnatches(deltas)
+}
+
+/*
+ * The flush routines reuse their batches, so failed ones are copied before they're queued
+ */
+
+func torrentEntries(deltas []TorrentDelta) []journalEntry {
+	copied := append([]TorrentDelta(nil), deltas...)
+	entries := make([]journalEntry, len(copied))
+	for i := range copied {
+		entries[i].Torrent = &copied[i]
+	}
+	return entries
+}
+
+func userEntries(deltas []UserDelta) []journalEntry {
+	copied := append([]UserDelta(nil), deltas...)
+	entries := make([]journalEntry, len(copied))
+	for i := range copied {
+		entries[i].User = &copied[i]
+	}
+	return entries
+}
+
+func transferHistoryEntries(deltas []TransferHistoryDelta) []journalEntry {
+	copied := append([]TransferHistoryDelta(nil), deltas...)
+	entries := make([]journalEntry, len(copied))
+	for i := range copied {
+		entries[i].TransferHistory = &copied[i]
+	}
+	return entries
+}
+
+func transferIpEntries(deltas []TransferIpDelta) []journalEntry {
+	copied := append([]TransferIpDelta(nil), deltas...)
+	entries := make([]journalEntry, len(copied))
+	for i := range copied {
+		entries[i].TransferIp = &copied[i]
+	}
+	return entries
+}
+
+func snatchEntries(deltas []SnatchDelta) []journalEntry {
+	copied := append([]SnatchDelta(nil), deltas...)
+	entries := make([]journalEntry, len(copied))
+	for i := range copied {
+		entries[i].Snatch = &copied[i]
+	}
+	return entries
+}
+
+/*
+ * Dead letters are written as journal segments, numbered after the ones already in the directory
+ */
+
+func (db *Database) deadLetter(label string, entries []journalEntry) {
+	if config.Loaded.DeadLetterPath == "" {
+		flushLogger.Critical("Dropped deltas that couldn't be flushed", "table", label, "count", len(entries))
+		db.commitEntries(entries)
+		return
+	}
+
+	if err := db.writeDeadLetters(entries); err != nil {
+		flushLogger.Critical("Failed to write dead letters", "table", label, "count", len(entries), "err", err)
+		return
+	}
+	deadLetters.Add(label, uint64(len(entries)))
+	db.commitEntries(entries)
+	flushLogger.Critical("Wrote deltas that couldn't be flushed to the dead letters", "table", label, "count", len(entries))
+}
+
+func (db *Database) writeDeadLetters(entries []journalEntry) error {
+	db.deadLetterMutex.Lock()
+	defer db.deadLetterMutex.Unlock()
+
+	dir := os.ExpandEnv(config.Loaded.DeadLetterPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	next := uint64(1)
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+	}
+	return writeSegment(segmentPath(dir, next), entries)
+}
+
+// ReplayDeadLetters queues the dead letters for flushing again, and returns how many there were.
+func (db *Database) ReplayDeadLetters() (int, error) {
+	if config.Loaded.DeadLetterPath == "" {
+		return 0, nil
+	}
+
+	if !db.startRecording("dead_letters") {
+		return 0, errors.New("database is terminated")
+	}
+	defer db.recording.RUnlock()
+
+	db.deadLetterMutex.Lock()
+
+	dir := os.ExpandEnv(config.Loaded.DeadLetterPath)
+	segments, err := listSegments(dir)
+	if err != nil {
+		db.deadLetterMutex.Unlock()
+		return 0, err
+	}
+
+	var entries []journalEntry
+	for _, segment := range segments {
+		read, err := readSegment(segmentPath(dir, segment))
+		if err != nil {
+			db.deadLetterMutex.Unlock()
+			return 0, err
+		}
+		entries = append(entries, read...)
+	}
+
+	// They're journaled before the dead letters are removed, so they can't be lost in between
+	for i := range entries {
+		entries[i].setSegment(db.journal.append(&entries[i]))
+	}
+	for _, segment := range segments {
+		os.Remove(segmentPath(dir, segment))
+	}
+
+	// Queueing can block until the flush routines catch up, which may need to write dead letters
+	db.deadLetterMutex.Unlock()
+
+	db.queueEntries(entries)
+	flushLogger.Info("Queued dead letters for flushing", "count", len(entries))
+	return len(entries), nil
+}
+
+// queueEntries queues journaled entries for flushing. The caller must hold the recording read lock.
+func (db *Database) queueEntries(entries []journalEntry) {
+	for i := range entries {
+		switch entry := entries[i]; entry.label() {
+		case "torrents":
+			db.torrentChannel <- *entry.Torrent
+		case "users_main":
+			db.userChannel <- *entry.User
+		case "transfer_history":
+			db.transferHistoryChannel <- *entry.TransferHistory
+		case "transfer_ips":
+			db.transferIpsChannel <- *entry.TransferIp
+		case "snatches":
+			db.snatchChannel <- *entry.Snatch
+		}
+	}
+}
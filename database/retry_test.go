@@ -0,0 +1,169 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kotoko/chihaya/config"
+)
+
+// unreliableBackend fails user flushes while it's down, and ones that include the poisoned user.
+type unreliableBackend struct {
+	*MemoryBackend
+	down     bool
+	poisoned uint64
+}
+
+func (b *unreliableBackend) FlushUsers(deltas []UserDelta) error {
+	if b.down {
+		return errors.New("database unavailable")
+	}
+	for _, delta := range deltas {
+		if delta.Id == b.poisoned {
+			return &RejectedError{errors.New("rejected row")}
+		}
+	}
+	return b.MemoryBackend.FlushUsers(deltas)
+}
+
+func retryUntilDone(t *testing.T, db *Database) {
+	now := time.Now()
+	for i := 0; i < 50; i++ {
+		now = now.Add(time.Hour)
+		db.retryFailed("users_main", now)
+		if len(db.failedBatches["users_main"]) == 0 {
+			return
+		}
+	}
+	t.Fatalf("Still retrying %d batches", len(db.failedBatches["users_main"]))
+}
+
+func TestRetryIsolatesPoisonedRows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dead_letters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(path string, retries int) {
+		config.Loaded.DeadLetterPath = path
+		config.Loaded.MaxFlushRetries = retries
+	}(config.Loaded.DeadLetterPath, config.Loaded.MaxFlushRetries)
+	config.Loaded.DeadLetterPath = dir
+	config.Loaded.MaxFlushRetries = 3
+
+	b := &unreliableBackend{MemoryBackend: newKeepingBackend(), poisoned: 5}
+	db := newTestDatabase(b)
+	db.userChannel = make(chan UserDelta, 100)
+
+	var deltas []UserDelta
+	for id := uint64(1); id <= 8; id++ {
+		deltas = append(deltas, UserDelta{Id: id, DeltaUpload: 100})
+	}
+	db.retryLater("users_main", userEntries(deltas))
+	retryUntilDone(t, db)
+
+	flushed := b.UserDeltas()
+	if len(flushed) != 7 {
+		t.Fatalf("Flushed %d deltas, want every one but the poisoned one", len(flushed))
+	}
+	for _, delta := range flushed {
+		if delta.Id == b.poisoned {
+			t.Error("Poisoned delta flushed")
+		}
+	}
+
+	// The poisoned delta goes through the flush channel again once it's replayed
+	b.poisoned = 0
+	count, err := db.ReplayDeadLetters()
+	if err != nil || count != 1 {
+		t.Fatalf("Replayed %d dead letters (%v), want 1", count, err)
+	}
+	if delta := <-db.userChannel; delta.Id != 5 || delta.DeltaUpload != 100 {
+		t.Errorf("Replayed %+v, want the poisoned delta", delta)
+	}
+	if count, _ = db.ReplayDeadLetters(); count != 0 {
+		t.Errorf("Replayed %d dead letters twice", count)
+	}
+}
+
+func TestRetryWhileDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dead_letters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(path string, retries int) {
+		config.Loaded.DeadLetterPath = path
+		config.Loaded.MaxFlushRetries = retries
+	}(config.Loaded.DeadLetterPath, config.Loaded.MaxFlushRetries)
+	config.Loaded.DeadLetterPath = dir
+	config.Loaded.MaxFlushRetries = 3
+
+	b := &unreliableBackend{MemoryBackend: newKeepingBackend(), down: true}
+	db := newTestDatabase(b)
+
+	var deltas []UserDelta
+	for id := uint64(1); id <= 8; id++ {
+		deltas = append(deltas, UserDelta{Id: id, DeltaUpload: 100})
+	}
+	db.retryLater("users_main", userEntries(deltas))
+
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		now = now.Add(time.Hour)
+		db.retryFailed("users_main", now)
+	}
+	if batches := db.failedBatches["users_main"]; len(batches) != 1 || len(batches[0].entries) != 8 {
+		t.Fatalf("Batch split up while the backend was down: %d batches", len(batches))
+	}
+	if segments, _ := listSegments(dir); len(segments) != 0 {
+		t.Fatalf("Dead lettered %d segments while the backend was down", len(segments))
+	}
+
+	b.down = false
+	retryUntilDone(t, db)
+	if flushed := b.UserDeltas(); len(flushed) != 8 {
+		t.Errorf("Flushed %d deltas after the backend came back, want 8", len(flushed))
+	}
+}
+
+func TestRetryCommitsJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { config.Loaded.JournalPath = "" }()
+
+	b := &unreliableBackend{MemoryBackend: newKeepingBackend(), down: true}
+	db := newJournalDatabase(t, b, dir)
+
+	user := &User{Id: 1}
+	db.RecordUser(user, 10, 10, 10, 10)
+	db.RecordUser(user, 20, 20, 20, 20)
+	db.retryLater("users_main", userEntries([]UserDelta{<-db.userChannel, <-db.userChannel}))
+
+	db.retryFailed("users_main", time.Now().Add(time.Hour))
+	if len(db.failedBatches["users_main"]) != 1 || len(b.UserDeltas()) != 0 {
+		t.Fatal("Failed retry not queued again")
+	}
+
+	b.down = false
+	retryUntilDone(t, db)
+	if deltas := b.UserDeltas(); len(deltas) != 1 || deltas[0].RawDeltaUpload != 30 {
+		t.Errorf("Flushed %+v after the backend came back, want both deltas", deltas)
+	}
+	if size := journalSize(t, dir); size != 0 {
+		t.Errorf("Journal is %d bytes after the retry succeeded", size)
+	}
+	db.journal.close()
+}
@@ -5,8 +5,6 @@
 package database
 
 import (
-	"encoding/gob"
-	"log"
 	"os"
 	"time"
 
@@ -14,97 +12,133 @@ import (
 )
 
 func (db *Database) startSerializing() {
-	go func() {
-		for !db.terminate {
-			time.Sleep(config.Loaded.Intervals.DatabaseSerialization.Duration)
+	db.startWorker(func() {
+		for db.sleep(config.Current().Intervals.DatabaseSerialization.Duration) {
 			db.serialize()
 		}
-	}()
+	})
 }
 
+const (
+	torrentCachePath = "torrent-cache.gob"
+	userCachePath    = "user-cache.gob"
+)
+
 func (db *Database) serialize() {
-	torrentFile, err := os.OpenFile("torrent-cache.gob", os.O_WRONLY|os.O_CREATE, 0600)
+	start := time.Now()
+	compress := config.Current().SnapshotCompression
+
+	logger.Info("Serializing database to cache file")
+
+	// The caches are only locked while they're copied or encoded, not while the snapshots are written
+	payload, err := encodeSnapshot(db.copyTorrents())
+	if err == nil {
+		err = writeSnapshot(torrentCachePath, payload, compress)
+	}
 	if err != nil {
-		log.Println("!!! CRITICAL !!! Couldn't open torrent cache file for writing! ", err)
-		return
+		logger.Critical("Failed to serialize torrent cache, keeping the previous one", "err", err)
 	}
 
-	userFile, err := os.OpenFile("user-cache.gob", os.O_WRONLY|os.O_CREATE, 0600)
+	db.UsersMutex.RLock()
+	payload, err = encodeSnapshot(db.Users)
+	db.UsersMutex.RUnlock()
+	if err == nil {
+		err = writeSnapshot(userCachePath, payload, compress)
+	}
 	if err != nil {
-		log.Println("!!! CRITICAL !!! Couldn't open user cache file for writing! ", err)
-		return
+		logger.Critical("Failed to serialize user cache, keeping the previous one", "err", err)
 	}
 
-	defer torrentFile.Close()
-	defer userFile.Close()
-
-	start := time.Now()
-
-	log.Printf("Serializing database to cache file")
+	logger.Info("Done serializing", "duration_ms", time.Now().Sub(start).Nanoseconds()/1000000)
+}
 
+// copyTorrents copies the swarms to be serialized. Each torrent is read locked while it's copied,
+// so only announces to that torrent wait.
+func (db *Database) copyTorrents() map[string]*Torrent {
 	db.TorrentsMutex.RLock()
-	gob.NewEncoder(torrentFile).Encode(db.Torrents)
-	db.TorrentsMutex.RUnlock()
-
-	db.UsersMutex.RLock()
-	gob.NewEncoder(userFile).Encode(db.Users)
-	db.UsersMutex.RUnlock()
+	defer db.TorrentsMutex.RUnlock()
+
+	torrents := make(map[string]*Torrent, len(db.Torrents))
+	for infoHash, torrent := range db.Torrents {
+		torrent.RLock()
+		torrents[infoHash] = &Torrent{
+			Id:             torrent.Id,
+			UpMultiplier:   torrent.UpMultiplier,
+			DownMultiplier: torrent.DownMultiplier,
+			Seeders:        copyPeers(torrent.Seeders),
+			Leechers:       copyPeers(torrent.Leechers),
+			Snatched:       torrent.Snatched,
+			Status:         torrent.Status,
+			LastAction:     torrent.LastAction,
+		}
+		torrent.RUnlock()
+	}
+	return torrents
+}
 
-	log.Printf("Done serializing (%dms)\n", time.Now().Sub(start).Nanoseconds()/1000000)
+func copyPeers(peers map[string]*Peer) map[string]*Peer {
+	copied := make(map[string]*Peer, len(peers))
+	for id, peer := range peers {
+		p := *peer
+		copied[id] = &p
+	}
+	return copied
 }
 
+// deserialize loads the caches. If that fails the tracker starts without them, they're reloaded from the backend
+// but the peers are lost.
 func (db *Database) deserialize() {
-	torrentFile, err := os.OpenFile("torrent-cache.gob", os.O_RDONLY, 0)
-	if err != nil {
-		log.Println("Torrent cache missing, skipping deserialization")
+	start := time.Now()
+
+	var torrents map[string]*Torrent
+	torrentsCreated, err := readSnapshot(torrentCachePath, &torrents)
+	if os.IsNotExist(err) {
+		logger.Info("Torrent cache missing, skipping deserialization")
 		return
-	}
-	userFile, err := os.OpenFile("user-cache.gob", os.O_RDONLY, 0)
-	if err != nil {
-		log.Println("User cache missing, skipping deserialization")
+	} else if err != nil {
+		logger.Critical("Failed to deserialize torrent cache, starting without it", "err", err)
 		return
 	}
 
-	defer torrentFile.Close()
-	defer userFile.Close()
-
-	start := time.Now()
-
-	log.Printf("Deserializing database from cache file")
-
-	decoder := gob.NewDecoder(torrentFile)
-
-	db.TorrentsMutex.Lock()
-	err = decoder.Decode(&db.Torrents)
-	db.TorrentsMutex.Unlock()
-
-	if err != nil {
-		log.Println("!!! CRITICAL !!! Failed to deserialize torrent cache! You may need to delete it.", err)
-		panic("Torrent deserialization failed")
+	var users map[string]*User
+	usersCreated, err := readSnapshot(userCachePath, &users)
+	if os.IsNotExist(err) {
+		logger.Info("User cache missing, skipping deserialization")
+		return
+	} else if err != nil {
+		logger.Critical("Failed to deserialize user cache, starting without it", "err", err)
+		return
 	}
 
-	decoder = gob.NewDecoder(userFile)
-
-	db.UsersMutex.Lock()
-	err = decoder.Decode(&db.Users)
-	db.UsersMutex.Unlock()
+	logger.Info("Deserializing database from cache file", "torrents_created", torrentsCreated.UTC().Format(time.RFC3339),
+		"users_created", usersCreated.UTC().Format(time.RFC3339))
 
-	if err != nil {
-		log.Println("!!! CRITICAL !!! Failed to deserialize user cache! You may need to delete it.", err)
-		panic("User deserialization failed")
+	if torrents == nil {
+		torrents = make(map[string]*Torrent)
+	}
+	if users == nil {
+		users = make(map[string]*User)
 	}
 
-	db.TorrentsMutex.RLock()
+	// Gob leaves out empty maps
 	peers := 0
-	torrents := len(db.Torrents)
-	for _, t := range db.Torrents {
+	for _, t := range torrents {
+		if t.Seeders == nil {
+			t.Seeders = make(map[string]*Peer)
+		}
+		if t.Leechers == nil {
+			t.Leechers = make(map[string]*Peer)
+		}
 		peers += len(t.Leechers) + len(t.Seeders)
 	}
-	db.TorrentsMutex.RUnlock()
 
-	db.UsersMutex.RLock()
-	users := len(db.Users)
-	db.UsersMutex.RUnlock()
+	db.TorrentsMutex.Lock()
+	db.Torrents = torrents
+	db.TorrentsMutex.Unlock()
+
+	db.UsersMutex.Lock()
+	db.Users = users
+	db.UsersMutex.Unlock()
 
-	log.Printf("Loaded %d users, %d torrents, %d peers (%dms)\n", users, torrents, peers, time.Now().Sub(start).Nanoseconds()/1000000)
+	logger.Info("Loaded cache", "users", len(users), "torrents", len(torrents), "peers", peers, "duration_ms", time.Now().Sub(start).Nanoseconds()/1000000)
 }
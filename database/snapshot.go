@@ -0,0 +1,224 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+ * Snapshots of the caches are written to a temporary file, which replaces the old snapshot once it's complete,
+ * so a crash while serializing leaves the previous snapshot intact.
+ *
+ * A snapshot starts with a header, followed by the gob encoded cache, which may be gzip compressed:
+ *   magic     4 bytes, "CHSN"
+ *   version   uint16, of the snapshot format
+ *   flags     uint16, snapshotGzip
+ *   created   int64, unix time in nanoseconds
+ *   length    uint64, of the payload as stored
+ *   checksum  uint32, CRC-32C of the payload as stored
+ *
+ * Gob matches struct fields by name, so fields can be added to or removed from the cached types without
+ * invalidating old snapshots, as long as the type of a field doesn't change.
+ * Files without a header are snapshots from before the format was versioned, and are read as plain gob.
+ */
+
+const (
+	snapshotMagic   = "CHSN"
+	snapshotVersion = 1
+
+	snapshotGzip = 1 << 0
+
+	snapshotHeaderSize = 28
+)
+
+var (
+	snapshotTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errSnapshotChecksum  = errors.New("checksum mismatch, the snapshot is corrupt")
+	errSnapshotTruncated = errors.New("snapshot is truncated")
+)
+
+type snapshotHeader struct {
+	Version  uint16
+	Flags    uint16
+	Created  int64
+	Length   uint64
+	Checksum uint32
+}
+
+// encodeSnapshot gob encodes value into the payload of a snapshot. Only encoding needs the cache locked,
+// the payload is compressed and written by writeSnapshot once the lock is released.
+func encodeSnapshot(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeSnapshot writes an encoded payload into a snapshot at path, replacing the previous one once it's complete.
+func writeSnapshot(path string, payload []byte, compress bool) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	// The header is written once the length and checksum are known
+	if _, err = f.Write(make([]byte, snapshotHeaderSize)); err != nil {
+		return err
+	}
+
+	header := snapshotHeader{Version: snapshotVersion, Created: time.Now().UnixNano()}
+	checksum := crc32.New(snapshotTable)
+	counter := &countingWriter{w: io.MultiWriter(f, checksum)}
+	buffered := bufio.NewWriter(counter)
+
+	if compress {
+		header.Flags |= snapshotGzip
+		gz, _ := gzip.NewWriterLevel(buffered, gzip.BestSpeed)
+		if _, err = gz.Write(payload); err != nil {
+			return err
+		}
+		if err = gz.Close(); err != nil {
+			return err
+		}
+	} else if _, err = buffered.Write(payload); err != nil {
+		return err
+	}
+	if err = buffered.Flush(); err != nil {
+		return err
+	}
+
+	header.Length = counter.n
+	header.Checksum = checksum.Sum32()
+	if _, err = f.WriteAt(header.encode(), 0); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	// Makes the rename itself durable
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// readSnapshot decodes the snapshot at path into value, and returns when it was created.
+func readSnapshot(path string, value interface{}) (created time.Time, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(f)
+	magic, err := reader.Peek(len(snapshotMagic))
+	if err != nil || string(magic) != snapshotMagic {
+		// Written before snapshots were versioned
+		return info.ModTime(), gob.NewDecoder(reader).Decode(value)
+	}
+
+	raw := make([]byte, snapshotHeaderSize)
+	if _, err = io.ReadFull(reader, raw); err != nil {
+		return created, errSnapshotTruncated
+	}
+	header := decodeSnapshotHeader(raw)
+	created = time.Unix(0, header.Created)
+
+	if header.Version > snapshotVersion {
+		return created, fmt.Errorf("snapshot format version %d is newer than the supported %d", header.Version, snapshotVersion)
+	}
+	if uint64(info.Size()-snapshotHeaderSize) < header.Length {
+		return created, errSnapshotTruncated
+	}
+
+	// The checksum is verified before decoding anything, so a corrupt snapshot can't be partially loaded
+	checksum := crc32.New(snapshotTable)
+	if _, err = io.Copy(checksum, io.LimitReader(reader, int64(header.Length))); err != nil {
+		return
+	}
+	if checksum.Sum32() != header.Checksum {
+		return created, errSnapshotChecksum
+	}
+
+	if _, err = f.Seek(snapshotHeaderSize, io.SeekStart); err != nil {
+		return
+	}
+	var decoded io.Reader = bufio.NewReader(io.LimitReader(f, int64(header.Length)))
+	if header.Flags&snapshotGzip != 0 {
+		gz, err := gzip.NewReader(decoded)
+		if err != nil {
+			return created, err
+		}
+		defer gz.Close()
+		decoded = gz
+	}
+	return created, gob.NewDecoder(decoded).Decode(value)
+}
+
+func (h *snapshotHeader) encode() []byte {
+	buf := make([]byte, snapshotHeaderSize)
+	copy(buf, snapshotMagic)
+	binary.BigEndian.PutUint16(buf[4:], h.Version)
+	binary.BigEndian.PutUint16(buf[6:], h.Flags)
+	binary.BigEndian.PutUint64(buf[8:], uint64(h.Created))
+	binary.BigEndian.PutUint64(buf[16:], h.Length)
+	binary.BigEndian.PutUint32(buf[24:], h.Checksum)
+	return buf
+}
+
+func decodeSnapshotHeader(buf []byte) snapshotHeader {
+	return snapshotHeader{
+		Version:  binary.BigEndian.Uint16(buf[4:]),
+		Flags:    binary.BigEndian.Uint16(buf[6:]),
+		Created:  int64(binary.BigEndian.Uint64(buf[8:])),
+		Length:   binary.BigEndian.Uint64(buf[16:]),
+		Checksum: binary.BigEndian.Uint32(buf[24:]),
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += uint64(n)
+	return n, err
+}
@@ -0,0 +1,175 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSwarm() map[string]*Torrent {
+	peer := &Peer{Id: "peer", UserId: 1, TorrentId: 2, Port: 6881, Ip: "10.0.0.1", Addr: []byte{10, 0, 0, 1, 0x1a, 0xe1}, Left: 100}
+	return map[string]*Torrent{
+		"infohash": {Id: 2, Seeders: map[string]*Peer{}, Leechers: map[string]*Peer{"peer": peer}, Snatched: 3},
+	}
+}
+
+func encodedSwarm(t *testing.T) []byte {
+	payload, err := encodeSnapshot(testSwarm())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "torrent-cache.gob")
+	for _, compress := range []bool{false, true} {
+		before := time.Now()
+		if err = writeSnapshot(path, encodedSwarm(t), compress); err != nil {
+			t.Fatalf("Write failed (compress=%v): %v", compress, err)
+		}
+
+		var torrents map[string]*Torrent
+		created, err := readSnapshot(path, &torrents)
+		if err != nil {
+			t.Fatalf("Read failed (compress=%v): %v", compress, err)
+		}
+		if created.Before(before.Add(-time.Second)) {
+			t.Errorf("Snapshot created at %v, before it was written", created)
+		}
+		peer := torrents["infohash"].Leechers["peer"]
+		if !reflect.DeepEqual(peer, testSwarm()["infohash"].Leechers["peer"]) {
+			t.Errorf("Read %+v, want the written peer", peer)
+		}
+	}
+
+	if names, _ := filepath.Glob(filepath.Join(dir, "*.tmp*")); len(names) != 0 {
+		t.Errorf("Temporary files %v left behind", names)
+	}
+}
+
+func TestSnapshotCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "torrent-cache.gob")
+	if err = writeSnapshot(path, encodedSwarm(t), true); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path)
+
+	corrupt := func(name string, modify func([]byte) []byte, expected string) {
+		modified := modify(append([]byte(nil), data...))
+		if err := ioutil.WriteFile(path, modified, 0600); err != nil {
+			t.Fatal(err)
+		}
+		var torrents map[string]*Torrent
+		if _, err := readSnapshot(path, &torrents); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Reading a %s snapshot returned %v, want %q", name, err, expected)
+		}
+		if torrents != nil {
+			t.Errorf("Torrents decoded from a %s snapshot", name)
+		}
+	}
+
+	corrupt("flipped", func(b []byte) []byte { b[len(b)-5] ^= 0xff; return b }, "checksum mismatch")
+	corrupt("truncated", func(b []byte) []byte { return b[:len(b)-10] }, "truncated")
+	corrupt("newer", func(b []byte) []byte { b[5] = snapshotVersion + 1; return b }, "newer than the supported")
+}
+
+func TestSnapshotCompatibility(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A cache from before snapshots were versioned, when peers had fewer fields
+	type oldPeer struct {
+		Id   string
+		Port uint
+		Ip   string
+	}
+	type oldTorrent struct {
+		Id       uint64
+		Leechers map[string]*oldPeer
+	}
+	path := filepath.Join(dir, "torrent-cache.gob")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := map[string]*oldTorrent{"infohash": {Id: 2, Leechers: map[string]*oldPeer{"peer": {"peer", 6881, "10.0.0.1"}}}}
+	if err = gob.NewEncoder(f).Encode(old); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	var torrents map[string]*Torrent
+	if _, err = readSnapshot(path, &torrents); err != nil {
+		t.Fatalf("Failed to read an old cache: %v", err)
+	}
+	if peer := torrents["infohash"].Leechers["peer"]; peer.Port != 6881 || peer.Ip != "10.0.0.1" || peer.Addr != nil {
+		t.Errorf("Read %+v from an old cache", peer)
+	}
+}
+
+// Meant to be run with -race, announces change the swarms while they're copied
+func TestCopyTorrents(t *testing.T) {
+	db := &Database{Torrents: testSwarm()}
+	torrent := db.Torrents["infohash"]
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			db.TorrentsMutex.RLock()
+			torrent.Lock()
+			torrent.Leechers["peer"].Uploaded = uint64(i)
+			torrent.Seeders[strconv.Itoa(i%10)] = &Peer{Id: strconv.Itoa(i % 10), Seeding: true}
+			torrent.LastAction = int64(i)
+			torrent.Unlock()
+			db.TorrentsMutex.RUnlock()
+		}
+	}()
+
+	var copied map[string]*Torrent
+	for i := 0; i < 100; i++ {
+		copied = db.copyTorrents()
+	}
+	close(stop)
+	<-stopped
+
+	c := copied["infohash"]
+	if c == torrent || c.Leechers["peer"] == torrent.Leechers["peer"] {
+		t.Fatal("Swarm not copied")
+	}
+	if c.Id != torrent.Id || c.Snatched != torrent.Snatched || c.Leechers["peer"].Addr == nil {
+		t.Errorf("Copied %+v from %+v", c, torrent)
+	}
+}
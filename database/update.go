@@ -0,0 +1,219 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package database
+
+import (
+	"sync/atomic"
+)
+
+/*
+ * These apply single changes pushed by the site straight to the caches, so they take effect without waiting for a reload.
+ * Like reloads, existing records are updated in place to keep the state that isn't stored in the backend.
+ */
+
+// update copies the fields stored in the backend from user.
+func (u *User) update(user *User) {
+	u.Id = user.Id
+	u.DownMultiplier = user.DownMultiplier
+	u.UpMultiplier = user.UpMultiplier
+	atomic.StoreInt64(&u.Slots, user.Slots)
+}
+
+// update copies the fields stored in the backend from torrent.
+func (t *Torrent) update(torrent *Torrent) {
+	t.Id = torrent.Id
+	t.DownMultiplier = torrent.DownMultiplier
+	t.UpMultiplier = torrent.UpMultiplier
+	t.Snatched = torrent.Snatched
+	t.Status = torrent.Status
+}
+
+// fields returns a copy of the fields stored in the backend.
+func (u *User) fields() User {
+	return User{Id: u.Id, DownMultiplier: u.DownMultiplier, UpMultiplier: u.UpMultiplier, Slots: atomic.LoadInt64(&u.Slots)}
+}
+
+// fields returns a copy of the fields stored in the backend.
+func (t *Torrent) fields() Torrent {
+	return Torrent{Id: t.Id, DownMultiplier: t.DownMultiplier, UpMultiplier: t.UpMultiplier, Snatched: t.Snatched, Status: t.Status}
+}
+
+func (db *Database) SetUser(passkey string, user *User) {
+	db.UpdateUser(passkey, user.Id, func(u *User) { *u = user.fields() })
+}
+
+// UpdateUser applies change to the fields stored in the backend of the user with the ID. A user whose passkey
+// changed is moved to the new one, and a new user starts with the defaults of a new row in the database.
+func (db *Database) UpdateUser(passkey string, id uint64, change func(user *User)) {
+	db.UsersMutex.Lock()
+	defer db.UsersMutex.Unlock()
+
+	user, exists := db.Users[passkey]
+	if !exists || user == nil || user.Id != id {
+		user = nil
+		for oldPasskey, old := range db.Users {
+			if old != nil && old.Id == id {
+				delete(db.Users, oldPasskey)
+				user = old
+				break
+			}
+		}
+	}
+	if user == nil {
+		user = &User{Id: id, DownMultiplier: 1, UpMultiplier: 1, Slots: -1}
+	}
+	db.Users[passkey] = user
+
+	fields := user.fields()
+	change(&fields)
+	fields.Id = id
+	user.update(&fields)
+}
+
+func (db *Database) DeleteUser(passkey string) {
+	db.UsersMutex.Lock()
+	defer db.UsersMutex.Unlock()
+
+	delete(db.Users, passkey)
+}
+
+func (db *Database) SetTorrent(infoHash string, torrent *Torrent) {
+	db.UpdateTorrent(infoHash, torrent.Id, func(t *Torrent) { *t = torrent.fields() })
+}
+
+// UpdateTorrent applies change to the fields stored in the backend of the torrent with the info hash.
+// A new torrent starts with the defaults of a new row in the database.
+func (db *Database) UpdateTorrent(infoHash string, id uint64, change func(torrent *Torrent)) {
+	db.TorrentsMutex.Lock()
+	defer db.TorrentsMutex.Unlock()
+
+	torrent, exists := db.Torrents[infoHash]
+	if !exists || torrent == nil {
+		torrent = &Torrent{
+			Id:             id,
+			DownMultiplier: 1,
+			UpMultiplier:   1,
+			Seeders:        make(map[string]*Peer),
+			Leechers:       make(map[string]*Peer),
+		}
+		db.Torrents[infoHash] = torrent
+	}
+
+	fields := torrent.fields()
+	change(&fields)
+	fields.Id = id
+	torrent.update(&fields)
+}
+
+func (db *Database) DeleteTorrent(infoHash string) {
+	var evicted []eviction
+
+	db.TorrentsMutex.Lock()
+	torrent, exists := db.Torrents[infoHash]
+	if exists {
+		delete(db.Torrents, infoHash)
+		evicted = append(evicted, evictTorrent(torrent))
+	}
+	db.TorrentsMutex.Unlock()
+
+	db.recordEvictions(evicted)
+}
+
+// AddWhitelist allows every version of the clients with the peer ID prefix.
+func (db *Database) AddWhitelist(peerId string) {
+	db.ClientsMutex.Lock()
+	defer db.ClientsMutex.Unlock()
+
+	rules := db.Clients.Rules()
+	for _, rule := range rules {
+		if rule == (ClientRule{Prefix: peerId}) {
+			return
+		}
+	}
+	db.Clients, _ = NewClientPolicy(append(append([]ClientRule(nil), rules...), ClientRule{Prefix: peerId}))
+}
+
+// DeleteWhitelist removes every rule on the peer ID prefix.
+func (db *Database) DeleteWhitelist(peerId string) {
+	db.ClientsMutex.Lock()
+	defer db.ClientsMutex.Unlock()
+
+	var rules []ClientRule
+	for _, rule := range db.Clients.Rules() {
+		if rule.Prefix != peerId {
+			rules = append(rules, rule)
+		}
+	}
+	db.Clients, _ = NewClientPolicy(rules)
+}
+
+/*
+ * A torrent removed from the cache takes its peers with it, so they are marked inactive and their slots are released.
+ *
+ * evictTorrent is called with the torrents write lock held and only takes the peers off the torrent. The evictions
+ * are recorded by recordEvictions once the lock is released, since recording blocks when the flush queues are full,
+ * and releasing slots takes the users lock.
+ */
+
+// An eviction is a torrent removed from the cache, with the peers it had.
+type eviction struct {
+	torrent  *Torrent
+	peers    []*Peer
+	leechers []uint64 // User IDs
+}
+
+func evictTorrent(torrent *Torrent) eviction {
+	evicted := eviction{
+		torrent:  torrent,
+		peers:    make([]*Peer, 0, len(torrent.Seeders)+len(torrent.Leechers)),
+		leechers: make([]uint64, 0, len(torrent.Leechers)),
+	}
+	for _, peer := range torrent.Leechers {
+		evicted.leechers = append(evicted.leechers, peer.UserId)
+		evicted.peers = append(evicted.peers, peer)
+	}
+	for _, peer := range torrent.Seeders {
+		evicted.peers = append(evicted.peers, peer)
+	}
+
+	torrent.Seeders = make(map[string]*Peer)
+	torrent.Leechers = make(map[string]*Peer)
+	return evicted
+}
+
+// recordEvictions is called without the torrents lock. The evicted torrents aren't in the cache anymore,
+// so nothing else reads or changes them.
+func (db *Database) recordEvictions(evicted []eviction) {
+	var leechers []uint64
+	for _, e := range evicted {
+		for _, peer := range e.peers {
+			db.RecordTransferHistory(peer, 0, 0, 0, 0, false)
+		}
+		db.recordDeletedTorrent(e.torrent)
+		leechers = append(leechers, e.leechers...)
+
+		logger.Info("Torrent deleted", "torrent_id", e.torrent.Id, "evicted", len(e.peers))
+	}
+	db.releaseSlots(leechers)
+}
+
+func (db *Database) releaseSlots(userIds []uint64) {
+	if len(userIds) == 0 {
+		return
+	}
+
+	released := make(map[uint64]int64, len(userIds))
+	for _, userId := range userIds {
+		released[userId]++
+	}
+
+	db.UsersMutex.RLock()
+	for _, user := range db.Users {
+		if count, exists := released[user.Id]; exists {
+			atomic.AddInt64(&user.UsedSlots, -count)
+		}
+	}
+	db.UsersMutex.RUnlock()
+}
@@ -12,6 +12,14 @@ func maxInt(a int, b int) int {
 	return b
 }
 
+// MinInt returns the smaller of the two integers provided.
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 // Btoa converts a boolean value into the string form "1" or "0".
 func btoa(a bool) string {
 	if a {
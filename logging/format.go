@@ -0,0 +1,88 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"unicode"
+)
+
+/*
+ * Fields are key/value pairs. Errors and Stringers are written as their strings, numbers and booleans as they are,
+ * and anything else as formatted by fmt.
+ */
+
+func stringValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(value)
+}
+
+// See https://brandur.org/logfmt
+func formatLogfmt(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(stringValue(fields[i]))
+		buf.WriteByte('=')
+
+		value := stringValue(fields[i+1])
+		if needsQuoting(value) {
+			buf.WriteString(strconv.Quote(value))
+		} else {
+			buf.WriteString(value)
+		}
+	}
+}
+
+func needsQuoting(value string) bool {
+	if value == "" {
+		return true
+	}
+	for _, r := range value {
+		if r <= ' ' || r == '=' || r == '"' || r == '\\' || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatJSON(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeJSON(buf, stringValue(fields[i]))
+		buf.WriteByte(':')
+
+		switch value := fields[i+1].(type) {
+		case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+			writeJSON(buf, value)
+		default:
+			writeJSON(buf, stringValue(value))
+		}
+	}
+	buf.WriteByte('}')
+}
+
+func writeJSON(buf *bytes.Buffer, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		// Only happens for NaN and infinities
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(data)
+}
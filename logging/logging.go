@@ -0,0 +1,221 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package logging implements leveled, structured logging for the tracker.
+//
+// Each subsystem has its own Logger, and every line carries the subsystem along with the message and
+// key/value fields, formatted as logfmt or JSON:
+//
+//	logger.Info("User load complete", "rows", len(users), "duration_ms", ms)
+//
+// The format, output and the level of each subsystem are set in the logging section of the config file.
+// Until Configure is called, logs are written to stderr as logfmt at the info level.
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kotoko/chihaya/config"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warning
+	Critical
+)
+
+var levelNames = []string{"debug", "info", "warning", "critical"}
+
+func (l Level) String() string {
+	if l < Debug || l > Critical {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q", name)
+}
+
+var (
+	configMutex sync.RWMutex
+	format      = "logfmt"
+	level       = Info
+	levels      map[string]Level // Per subsystem, overriding level
+	out         sink             = writerSink{os.Stderr}
+
+	writeMutex sync.Mutex
+	buf        bytes.Buffer
+
+	now = time.Now // Replaced in tests
+)
+
+// Configure applies the logging section of the current config. It can be called again after the config changed,
+// which reopens the output.
+func Configure() error {
+	cfg := config.Current().Logging
+
+	newLevel, newLevels, err := parseLevels(cfg)
+	if err != nil {
+		return err
+	}
+	newOut, err := openSink(cfg)
+	if err != nil {
+		return err
+	}
+
+	configMutex.Lock()
+	oldOut := out
+	format, level, levels, out = cfg.Format, newLevel, newLevels, newOut
+	configMutex.Unlock()
+
+	writeMutex.Lock()
+	oldOut.close()
+	writeMutex.Unlock()
+	return nil
+}
+
+// Check returns an error if the logging section of a config can't be applied, without opening the output.
+func Check(cfg config.TrackerLogging) error {
+	_, _, err := parseLevels(cfg)
+	return err
+}
+
+func parseLevels(cfg config.TrackerLogging) (Level, map[string]Level, error) {
+	if cfg.Format != "logfmt" && cfg.Format != "json" {
+		return Info, nil, fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+	newLevel, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return Info, nil, err
+	}
+	newLevels := make(map[string]Level)
+	for subsystem, name := range cfg.Levels {
+		if newLevels[subsystem], err = ParseLevel(name); err != nil {
+			return Info, nil, fmt.Errorf("%s: %v", subsystem, err)
+		}
+	}
+	return newLevel, newLevels, nil
+}
+
+/*
+ * Loggers
+ */
+
+type Logger struct {
+	subsystem string
+	fields    []interface{} // Added to every line
+}
+
+// New returns the logger of a subsystem, whose level can be set in the config file.
+func New(subsystem string) *Logger {
+	return &Logger{subsystem: subsystem}
+}
+
+// With returns a logger that adds the given key/value pairs to every line.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(append(fields, l.fields...), keyvals...)
+	return &Logger{subsystem: l.subsystem, fields: fields}
+}
+
+// Enabled reports whether lines of the given level are logged, so expensive fields can be skipped.
+func (l *Logger) Enabled(lineLevel Level) bool {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	minLevel, exists := levels[l.subsystem]
+	if !exists {
+		minLevel = level
+	}
+	return lineLevel >= minLevel
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(Debug, msg, keyvals)
+}
+
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(Info, msg, keyvals)
+}
+
+func (l *Logger) Warning(msg string, keyvals ...interface{}) {
+	l.log(Warning, msg, keyvals)
+}
+
+func (l *Logger) Critical(msg string, keyvals ...interface{}) {
+	l.log(Critical, msg, keyvals)
+}
+
+// Fatal logs at the critical level and exits.
+func (l *Logger) Fatal(msg string, keyvals ...interface{}) {
+	l.log(Critical, msg, keyvals)
+	os.Exit(1)
+}
+
+// Panic logs at the critical level and panics with the message.
+func (l *Logger) Panic(msg string, keyvals ...interface{}) {
+	l.log(Critical, msg, keyvals)
+	panic(msg)
+}
+
+// Writer returns a writer that logs every line written to it, for code that logs through the standard library.
+func (l *Logger) Writer(lineLevel Level) io.Writer {
+	return &lineWriter{l, lineLevel}
+}
+
+type lineWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.logger.log(w.level, line, nil)
+	}
+	return len(p), nil
+}
+
+func (l *Logger) log(lineLevel Level, msg string, keyvals []interface{}) {
+	if !l.Enabled(lineLevel) {
+		return
+	}
+
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	buf.Reset()
+	fields := []interface{}{"time", now().UTC().Format(time.RFC3339Nano), "level", lineLevel.String(), "subsystem", l.subsystem, "msg", msg}
+	fields = append(append(fields, l.fields...), keyvals...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "MISSING")
+	}
+
+	if format == "json" {
+		formatJSON(&buf, fields)
+	} else {
+		formatLogfmt(&buf, fields)
+	}
+	buf.WriteByte('\n')
+
+	if err := out.write(lineLevel, buf.Bytes()); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write log: %v\n", err)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kotoko/chihaya/config"
+)
+
+// capture sends the output to a buffer, and restores the defaults afterwards.
+func capture(t *testing.T, cfg config.TrackerLogging) (*bytes.Buffer, func()) {
+	old := config.Loaded.Logging
+	config.Loaded.Logging = cfg
+	if err := Configure(); err != nil {
+		t.Fatalf("Configure error: %v", err)
+	}
+
+	output := new(bytes.Buffer)
+	configMutex.Lock()
+	out = writerSink{output}
+	configMutex.Unlock()
+	now = func() time.Time { return time.Date(2013, 6, 1, 12, 0, 0, 0, time.UTC) }
+
+	return output, func() {
+		config.Loaded.Logging = old
+		Configure()
+		now = time.Now
+	}
+}
+
+func TestLogfmt(t *testing.T) {
+	output, restore := capture(t, config.TrackerLogging{Format: "logfmt", Level: "info"})
+	defer restore()
+
+	logger := New("database").With("table", "users_main")
+	logger.Info("Flush failed", "count", 3, "err", errors.New(`bad "row"`), "empty", "", "odd")
+
+	expected := `time=2013-06-01T12:00:00Z level=info subsystem=database msg="Flush failed" table=users_main count=3 ` +
+		`err="bad \"row\"" empty="" odd=MISSING` + "\n"
+	if output.String() != expected {
+		t.Errorf("Logged %q, want %q", output.String(), expected)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	output, restore := capture(t, config.TrackerLogging{Format: "json", Level: "info"})
+	defer restore()
+
+	New("server").Warning("Peer count differs", "torrent_id", uint64(5), "ratio", 0.5, "bug", true, "peer", "a\"b")
+
+	expected := `{"time":"2013-06-01T12:00:00Z","level":"warning","subsystem":"server","msg":"Peer count differs",` +
+		`"torrent_id":5,"ratio":0.5,"bug":true,"peer":"a\"b"}` + "\n"
+	if output.String() != expected {
+		t.Errorf("Logged %q, want %q", output.String(), expected)
+	}
+}
+
+func TestLevels(t *testing.T) {
+	output, restore := capture(t, config.TrackerLogging{
+		Format: "logfmt",
+		Level:  "warning",
+		Levels: map[string]string{"flush": "debug", "mysql": "critical"},
+	})
+	defer restore()
+
+	New("server").Info("hidden")
+	New("server").Warning("shown")
+	New("flush").Debug("shown")
+	New("mysql").Warning("hidden")
+	New("mysql").Critical("shown")
+
+	if strings.Contains(output.String(), "hidden") || strings.Count(output.String(), "shown") != 3 {
+		t.Errorf("Levels not applied:\n%s", output.String())
+	}
+	if New("flush").Enabled(Debug) != true || New("server").Enabled(Info) != false {
+		t.Error("Enabled doesn't match the levels")
+	}
+
+	config.Loaded.Logging.Levels["server"] = "verbose"
+	if err := Configure(); err == nil {
+		t.Error("Unknown level accepted")
+	}
+}
+
+func TestFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "chihaya.log")
+	s, err := openFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	line := []byte(strings.Repeat("x", 59) + "\n")
+	for i := 0; i < 5; i++ {
+		if err = s.write(Info, line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if data, err := ioutil.ReadFile(name); err != nil || !bytes.Equal(data, line) {
+			t.Errorf("%s contains %q (%v), want one line", name, data, err)
+		}
+	}
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("More than 2 backups kept")
+	}
+}
+
+func TestFailedRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The backup can't be replaced by the log file
+	path := filepath.Join(dir, "chihaya.log")
+	if err = os.MkdirAll(filepath.Join(path+".1", "taken"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openFile(path, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	line := []byte(strings.Repeat("x", 59) + "\n")
+	s.write(Info, line)
+	if err = s.write(Info, line); err == nil {
+		t.Error("Rotating onto a directory succeeded")
+	}
+	if err = s.write(Info, line); err == nil {
+		t.Error("Rotating onto a directory succeeded")
+	}
+
+	// Every line still went to the old file
+	if data, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(data, bytes.Repeat(line, 3)) {
+		t.Errorf("%s contains %q (%v), want every line", path, data, err)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/kotoko/chihaya/config"
+)
+
+// A sink is where log lines are written to. Writes are serialized by the caller.
+type sink interface {
+	write(level Level, line []byte) error
+	close() error
+}
+
+func openSink(cfg config.TrackerLogging) (sink, error) {
+	switch cfg.Output {
+	case "", "stderr":
+		return writerSink{os.Stderr}, nil
+	case "stdout":
+		return writerSink{os.Stdout}, nil
+	case "syslog":
+		return openSyslog()
+	}
+	return openFile(os.ExpandEnv(cfg.Output), int64(cfg.MaxSize)<<20, cfg.MaxBackups)
+}
+
+type writerSink struct {
+	w io.Writer
+}
+
+func (s writerSink) write(level Level, line []byte) error {
+	_, err := s.w.Write(line)
+	return err
+}
+
+func (s writerSink) close() error {
+	return nil
+}
+
+/*
+ * Files are rotated once they grow past maxSize, by renaming them to path.1, the previous path.1 to path.2
+ * and so on, keeping maxBackups old files
+ */
+
+type fileSink struct {
+	path       string
+	maxSize    int64 // 0 disables rotation
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+func openFile(path string, maxSize int64, maxBackups int) (*fileSink, error) {
+	s := &fileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *fileSink) write(level Level, line []byte) error {
+	var rotateErr error
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		rotateErr = s.rotate()
+	}
+
+	// If rotating failed, the line still goes to the old file
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return err
+}
+
+// rotate moves the file to the first backup and starts a new one. The file is renamed while it's still open,
+// and only closed once the new one opened, so if anything fails the sink keeps writing to the old file.
+// Where open files can't be renamed, like on Windows, the file isn't rotated.
+func (s *fileSink) rotate() error {
+	if _, err := os.Stat(s.path); err != nil {
+		return err
+	}
+
+	if s.maxBackups > 0 {
+		for i := s.maxBackups - 1; i > 0; i-- {
+			os.Rename(backupPath(s.path, i), backupPath(s.path, i+1))
+		}
+		if err := os.Rename(s.path, backupPath(s.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+
+	old := s.file
+	if err := s.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+func backupPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+func (s *fileSink) close() error {
+	return s.file.Close()
+}
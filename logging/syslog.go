@@ -0,0 +1,40 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package logging
+
+import (
+	"log/syslog"
+)
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func openSyslog() (sink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "chihaya")
+	if err != nil {
+		return nil, err
+	}
+	return syslogSink{w}, nil
+}
+
+func (s syslogSink) write(level Level, line []byte) error {
+	switch level {
+	case Debug:
+		return s.w.Debug(string(line))
+	case Info:
+		return s.w.Info(string(line))
+	case Warning:
+		return s.w.Warning(string(line))
+	}
+	return s.w.Crit(string(line))
+}
+
+func (s syslogSink) close() error {
+	return s.w.Close()
+}
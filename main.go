@@ -5,43 +5,102 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strings"
+	"syscall"
 
 	"github.com/kotoko/chihaya/config"
+	"github.com/kotoko/chihaya/logging"
 	"github.com/kotoko/chihaya/server"
 )
 
+var logger = logging.New("main")
+
 var (
-	profile    bool
-	configFile string
+	profile     bool
+	configFile  string
+	checkConfig bool
+	handoff     string
 )
 
+// Flags overriding config values, which take precedence over the config file and CHIHAYA_ environment variables
+var configFlags = []struct {
+	name, key, usage string
+	file             bool
+}{
+	{"addr", "addr", "Address to listen on", false},
+	{"db-addr", "database.addr", "Address of the database", false},
+	{"db-user", "database.user", "Database user", false},
+	{"db-pass-file", "database.pass", "File holding the database password", true},
+}
+
 func init() {
 	flag.BoolVar(&profile, "profile", false, "Generate profiling data for pprof into chihaya.cpu")
 	flag.StringVar(&configFile, "config", "", "The location of a valid configuration file.")
+	flag.BoolVar(&checkConfig, "check-config", false, "Print the effective configuration and exit, non-zero if it's invalid")
+	flag.StringVar(&handoff, "handoff", "", "Sockets passed by the process restarting the tracker, used internally")
+
+	for _, f := range configFlags {
+		flag.String(f.name, "", f.usage)
+	}
+}
+
+func setConfigFlags() {
+	flag.Visit(func(set *flag.Flag) {
+		for _, f := range configFlags {
+			if f.name == set.Name {
+				config.Flags = append(config.Flags, config.Override{Source: "-" + f.name, Key: f.key, Value: set.Value.String(), File: f.file})
+			}
+		}
+	})
 }
 
 func main() {
 	flag.Parse()
 	runtime.GOMAXPROCS(runtime.NumCPU())
+	setConfigFlags()
 
+	if checkConfig {
+		os.Exit(printConfig())
+	}
+
+	if err := config.LoadConfig(configFile); err != nil {
+		logger.Fatal("Failed to load configuration", "path", configFile, "err", err)
+	}
 	if configFile != "" {
-		err := config.LoadConfig(configFile)
-		if err != nil {
-			log.Fatalf("Failed to load configuration file")
+		logger.Info("Successfully loaded config file", "path", configFile)
+	}
+
+	if err := logging.Configure(); err != nil {
+		logger.Fatal("Failed to configure logging", "err", err)
+	}
+	for _, name := range config.UnknownEnv() {
+		logger.Warning("Ignoring environment variable that doesn't name a config value", "name", name)
+	}
+
+	// Anything logged through the standard library, like errors from net/http, goes to the same output
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logging.Warning))
+
+	if handoff != "" {
+		if err := server.InheritListeners(handoff); err != nil {
+			logger.Fatal("Failed to take over from the old process", "err", err)
 		}
 	}
 
 	if profile {
-		log.Println("Running with profiling enabled")
+		logger.Info("Running with profiling enabled")
 		f, err := os.Create("chihaya.cpu")
 		if err != nil {
-			log.Fatalf("Failed to create profile file: %s\n", err)
+			logger.Fatal("Failed to create profile file", "err", err)
 		}
 		defer f.Close()
 		pprof.StartCPUProfile(f)
@@ -49,18 +108,96 @@ func main() {
 
 	go func() {
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		<-c
+		signal.Notify(c, syscall.SIGHUP)
+		for range c {
+			reloadConfig()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		sig := <-c
 
 		if profile {
 			pprof.StopCPUProfile()
 		}
 
-		log.Println("Caught interrupt, shutting down..")
-		server.Stop()
+		logger.Info("Caught signal, shutting down..", "signal", sig)
+		cancel()
 		<-c
-		os.Exit(0)
+		logger.Warning("Caught another signal, exiting without finishing the shutdown")
+		os.Exit(1)
 	}()
 
-	server.Start()
+	if handoffSignal != nil {
+		go func() {
+			c := make(chan os.Signal, 1)
+			signal.Notify(c, handoffSignal)
+			for range c {
+				if err := server.Handoff(); err != nil {
+					logger.Critical("Failed to hand off to a new process, still serving", "err", err)
+					continue
+				}
+				cancel()
+				return
+			}
+		}()
+	}
+
+	server.Start(ctx)
+}
+
+// reloadConfig applies a changed config file without restarting, which would drop the peers held in memory
+func reloadConfig() {
+	if configFile == "" {
+		logger.Warning("Caught SIGHUP, but no config file to reload")
+		return
+	}
+
+	restart, err := config.Reload(configFile)
+	if err != nil {
+		logger.Critical("Failed to reload config file, keeping the current config", "path", configFile, "err", err)
+		return
+	}
+	if err = logging.Configure(); err != nil {
+		logger.Critical("Failed to reconfigure logging, keeping the current logging", "err", err)
+	}
+	for _, key := range restart {
+		logger.Warning("Config value changed, but needs a restart to apply", "key", key)
+	}
+	logger.Info("Reloaded config file", "path", configFile)
+}
+
+// printConfig prints the defaults merged with the config file and overrides, with secrets left out, and returns the exit code
+func printConfig() int {
+	if err := config.LoadConfig(configFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+	if err := logging.Check(config.Loaded.Logging); err != nil {
+		fmt.Fprintf(os.Stderr, "logging: %v\n", err)
+		return 1
+	}
+	if unknown := config.UnknownEnv(); len(unknown) > 0 {
+		fmt.Fprintf(os.Stderr, "Unknown environment variables: %s\n", strings.Join(unknown, ", "))
+		return 1
+	}
+
+	cfg := config.Loaded
+	if cfg.Database.Password != "" {
+		cfg.Database.Password = "(set)"
+	}
+	if cfg.AdminKey != "" {
+		cfg.AdminKey = "(set)"
+	}
+
+	out, err := json.MarshalIndent(&cfg, "", "    ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	fmt.Printf("%s\n", out)
+	return 0
 }
@@ -0,0 +1,287 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package metrics implements counters and histograms that are exposed in the Prometheus text format.
+// Metrics are registered when they're created, and Write outputs all of them in that order.
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DurationBuckets are the default histogram buckets, in seconds.
+var DurationBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60}
+
+type metric interface {
+	write(buf *bytes.Buffer)
+}
+
+var (
+	registry      []metric
+	registryMutex sync.Mutex
+)
+
+func register(m metric) {
+	registryMutex.Lock()
+	registry = append(registry, m)
+	registryMutex.Unlock()
+}
+
+// Write outputs every registered metric.
+func Write(buf *bytes.Buffer) {
+	registryMutex.Lock()
+	metrics := registry
+	registryMutex.Unlock()
+
+	for _, m := range metrics {
+		m.write(buf)
+	}
+}
+
+/*
+ * Counters
+ */
+
+type Counter struct {
+	name  string
+	help  string
+	value uint64
+}
+
+func NewCounter(name string, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) write(buf *bytes.Buffer) {
+	writeHeader(buf, c.name, c.help, "counter")
+	writeSample(buf, c.name, "", "", float64(atomic.LoadUint64(&c.value)))
+}
+
+// CounterVec is a set of counters partitioned by the value of a single label.
+type CounterVec struct {
+	name  string
+	help  string
+	label string
+
+	values map[string]*uint64
+	mutex  sync.RWMutex
+}
+
+func NewCounterVec(name string, help string, label string) *CounterVec {
+	c := &CounterVec{name: name, help: help, label: label, values: make(map[string]*uint64)}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValue string) {
+	c.Add(labelValue, 1)
+}
+
+func (c *CounterVec) Add(labelValue string, n uint64) {
+	c.mutex.RLock()
+	value, exists := c.values[labelValue]
+	c.mutex.RUnlock()
+
+	if !exists {
+		c.mutex.Lock()
+		value, exists = c.values[labelValue]
+		if !exists {
+			value = new(uint64)
+			c.values[labelValue] = value
+		}
+		c.mutex.Unlock()
+	}
+	atomic.AddUint64(value, n)
+}
+
+func (c *CounterVec) write(buf *bytes.Buffer) {
+	writeHeader(buf, c.name, c.help, "counter")
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for _, labelValue := range sortedKeys(c.values) {
+		writeSample(buf, c.name, c.label, labelValue, float64(atomic.LoadUint64(c.values[labelValue])))
+	}
+}
+
+/*
+ * Histograms
+ */
+
+type histogram struct {
+	counts []uint64 // Per bucket, the cumulative counts are calculated when writing
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec is a set of histograms partitioned by the value of a single label.
+type HistogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+
+	values map[string]*histogram
+	mutex  sync.Mutex
+}
+
+func NewHistogramVec(name string, help string, label string, buckets []float64) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, label: label, buckets: buckets, values: make(map[string]*histogram)}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(labelValue string, value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	hist, exists := h.values[labelValue]
+	if !exists {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[labelValue] = hist
+	}
+
+	i := sort.SearchFloat64s(h.buckets, value)
+	if i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.sum += value
+	hist.count++
+}
+
+// ObserveSince observes the time elapsed since start, in seconds.
+func (h *HistogramVec) ObserveSince(labelValue string, start time.Time) {
+	h.Observe(labelValue, time.Now().Sub(start).Seconds())
+}
+
+func (h *HistogramVec) write(buf *bytes.Buffer) {
+	writeHeader(buf, h.name, h.help, "histogram")
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, labelValue := range sortedKeys(h.values) {
+		hist := h.values[labelValue]
+		labels := h.label + `="` + escape(labelValue) + `",le="`
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			writeLabels(buf, h.name+"_bucket", labels+formatFloat(bound)+`"`, float64(cumulative))
+		}
+		writeLabels(buf, h.name+"_bucket", labels+`+Inf"`, float64(hist.count))
+
+		writeSample(buf, h.name+"_sum", h.label, labelValue, hist.sum)
+		writeSample(buf, h.name+"_count", h.label, labelValue, float64(hist.count))
+	}
+}
+
+/*
+ * Gauges only make sense for a point in time, so they are written directly by whoever owns the value
+ */
+
+func WriteGauge(buf *bytes.Buffer, name string, help string, value float64) {
+	writeHeader(buf, name, help, "gauge")
+	writeSample(buf, name, "", "", value)
+}
+
+func WriteGaugeVec(buf *bytes.Buffer, name string, help string, label string, values map[string]float64) {
+	writeHeader(buf, name, help, "gauge")
+
+	for _, labelValue := range sortedKeys(values) {
+		writeSample(buf, name, label, labelValue, values[labelValue])
+	}
+}
+
+/*
+ * Text format, see https://prometheus.io/docs/instrumenting/exposition_formats/
+ */
+
+func writeHeader(buf *bytes.Buffer, name string, help string, metricType string) {
+	buf.WriteString("# HELP ")
+	buf.WriteString(name)
+	buf.WriteRune(' ')
+	buf.WriteString(strings.Replace(strings.Replace(help, `\`, `\\`, -1), "\n", `\n`, -1))
+	buf.WriteString("\n# TYPE ")
+	buf.WriteString(name)
+	buf.WriteRune(' ')
+	buf.WriteString(metricType)
+	buf.WriteRune('\n')
+}
+
+func writeSample(buf *bytes.Buffer, name string, label string, labelValue string, value float64) {
+	if label == "" {
+		writeLabels(buf, name, "", value)
+	} else {
+		writeLabels(buf, name, label+`="`+escape(labelValue)+`"`, value)
+	}
+}
+
+func writeLabels(buf *bytes.Buffer, name string, labels string, value float64) {
+	buf.WriteString(name)
+	if labels != "" {
+		buf.WriteRune('{')
+		buf.WriteString(labels)
+		buf.WriteRune('}')
+	}
+	buf.WriteRune(' ')
+	buf.WriteString(formatFloat(value))
+	buf.WriteRune('\n')
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escape(labelValue string) string {
+	labelValue = strings.Replace(labelValue, `\`, `\\`, -1)
+	labelValue = strings.Replace(labelValue, `"`, `\"`, -1)
+	return strings.Replace(labelValue, "\n", `\n`, -1)
+}
+
+func sortedKeys(values interface{}) []string {
+	var keys []string
+	switch v := values.(type) {
+	case map[string]*uint64:
+		for key := range v {
+			keys = append(keys, key)
+		}
+	case map[string]*histogram:
+		for key := range v {
+			keys = append(keys, key)
+		}
+	case map[string]float64:
+		for key := range v {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,63 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("test_requests_total", "Test requests.", "result")
+	c.Inc("ok")
+	c.Inc("ok")
+	c.Add("failure", 3)
+	c.Inc(`say "hi"`)
+
+	var buf bytes.Buffer
+	c.write(&buf)
+
+	expected := "# HELP test_requests_total Test requests.\n" +
+		"# TYPE test_requests_total counter\n" +
+		"test_requests_total{result=\"failure\"} 3\n" +
+		"test_requests_total{result=\"ok\"} 2\n" +
+		"test_requests_total{result=\"say \\\"hi\\\"\"} 1\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected counter output:\n%s\nwant:\n%s", buf.String(), expected)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec("test_duration_seconds", "Test durations.", "action", []float64{0.1, 1})
+	h.Observe("announce", 0.05)
+	h.Observe("announce", 0.1)
+	h.Observe("announce", 0.5)
+	h.Observe("announce", 2)
+
+	var buf bytes.Buffer
+	h.write(&buf)
+
+	expected := "# HELP test_duration_seconds Test durations.\n" +
+		"# TYPE test_duration_seconds histogram\n" +
+		"test_duration_seconds_bucket{action=\"announce\",le=\"0.1\"} 2\n" +
+		"test_duration_seconds_bucket{action=\"announce\",le=\"1\"} 3\n" +
+		"test_duration_seconds_bucket{action=\"announce\",le=\"+Inf\"} 4\n" +
+		"test_duration_seconds_sum{action=\"announce\"} 2.65\n" +
+		"test_duration_seconds_count{action=\"announce\"} 4\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected histogram output:\n%s\nwant:\n%s", buf.String(), expected)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	NewCounter("test_retries_total", "Test retries.").Inc()
+
+	var buf bytes.Buffer
+	Write(&buf)
+	if !strings.Contains(buf.String(), "\ntest_retries_total 1\n") {
+		t.Errorf("Registered counter missing from output:\n%s", buf.String())
+	}
+}
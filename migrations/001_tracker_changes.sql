@@ -0,0 +1,39 @@
+-- Filled by the triggers below, so the tracker only has to reload users and torrents that changed.
+-- Old rows can be deleted by the site once they are older than the full reload interval.
+CREATE TABLE IF NOT EXISTS tracker_changes
+  (
+      id      BIGINT(20) UNSIGNED NOT NULL auto_increment,
+      kind    ENUM('user', 'torrent') NOT NULL,
+      row_id  INT(10) UNSIGNED NOT NULL,
+     PRIMARY KEY ( id )
+  )
+engine=innodb
+DEFAULT charset=utf8;
+
+DELIMITER //
+
+CREATE TRIGGER users_main_insert AFTER INSERT ON users_main FOR EACH ROW
+  INSERT INTO tracker_changes (kind, row_id) VALUES ('user', NEW.id)//
+
+CREATE TRIGGER users_main_update AFTER UPDATE ON users_main FOR EACH ROW
+  IF NOT (NEW.torrent_pass <=> OLD.torrent_pass AND NEW.enabled <=> OLD.enabled AND NEW.slots <=> OLD.slots
+          AND NEW.downmultiplier <=> OLD.downmultiplier AND NEW.upmultiplier <=> OLD.upmultiplier) THEN
+    INSERT INTO tracker_changes (kind, row_id) VALUES ('user', NEW.id);
+  END IF//
+
+CREATE TRIGGER users_main_delete AFTER DELETE ON users_main FOR EACH ROW
+  INSERT INTO tracker_changes (kind, row_id) VALUES ('user', OLD.id)//
+
+CREATE TRIGGER torrents_insert AFTER INSERT ON torrents FOR EACH ROW
+  INSERT INTO tracker_changes (kind, row_id) VALUES ('torrent', NEW.id)//
+
+CREATE TRIGGER torrents_update AFTER UPDATE ON torrents FOR EACH ROW
+  IF NOT (NEW.info_hash <=> OLD.info_hash AND NEW.status <=> OLD.status
+          AND NEW.downmultiplier <=> OLD.downmultiplier AND NEW.upmultiplier <=> OLD.upmultiplier) THEN
+    INSERT INTO tracker_changes (kind, row_id) VALUES ('torrent', NEW.id);
+  END IF//
+
+CREATE TRIGGER torrents_delete AFTER DELETE ON torrents FOR EACH ROW
+  INSERT INTO tracker_changes (kind, row_id) VALUES ('torrent', OLD.id)//
+
+DELIMITER ;
@@ -0,0 +1,10 @@
+-- Banned IP addresses and CIDR ranges, see README.md. Without it only the ban file is used.
+CREATE TABLE IF NOT EXISTS tracker_bans
+  (
+      id     INT(10) UNSIGNED NOT NULL auto_increment,
+      ip     VARCHAR(43) NOT NULL,
+      notes  VARCHAR(1000) DEFAULT NULL,
+     PRIMARY KEY ( id )
+  )
+engine=innodb
+DEFAULT charset=utf8;
@@ -0,0 +1,8 @@
+-- Deny rules and version ranges for approved clients, see README.md. Without them every row allows its prefix.
+-- A prefix can have several rules, like allowing -TR but denying versions below 2.0, so the unique key covers all of them.
+ALTER TABLE xbt_client_whitelist
+  ADD COLUMN action       ENUM('allow', 'deny') NOT NULL DEFAULT 'allow',
+  ADD COLUMN min_version  VARCHAR(20) NOT NULL DEFAULT '',
+  ADD COLUMN max_version  VARCHAR(20) NOT NULL DEFAULT '',
+  DROP KEY peer_id,
+  ADD UNIQUE KEY peer_id ( peer_id, action, min_version, max_version );
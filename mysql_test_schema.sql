@@ -42,11 +42,24 @@ DEFAULT charset=utf8;
 CREATE TABLE IF NOT EXISTS  sample_database.xbt_client_whitelist
   (
       id       INT(10) UNSIGNED NOT NULL auto_increment,
-      peer_id  VARCHAR(20) DEFAULT NULL,
-      vstring  VARCHAR(200) DEFAULT '',
-      notes    VARCHAR(1000) DEFAULT NULL,
+      peer_id      VARCHAR(20) DEFAULT NULL,
+      vstring      VARCHAR(200) DEFAULT '',
+      notes        VARCHAR(1000) DEFAULT NULL,
+      action       ENUM('allow', 'deny') NOT NULL DEFAULT 'allow',
+      min_version  VARCHAR(20) NOT NULL DEFAULT '',
+      max_version  VARCHAR(20) NOT NULL DEFAULT '',
      PRIMARY KEY ( id ),
-     UNIQUE KEY  peer_id  ( peer_id )
+     UNIQUE KEY  peer_id  ( peer_id, action, min_version, max_version )
+  )
+engine=innodb
+DEFAULT charset=utf8;
+
+CREATE TABLE IF NOT EXISTS sample_database.tracker_bans
+  (
+      id     INT(10) UNSIGNED NOT NULL auto_increment,
+      ip     VARCHAR(43) NOT NULL,
+      notes  VARCHAR(1000) DEFAULT NULL,
+     PRIMARY KEY ( id )
   )
 engine=innodb
 DEFAULT charset=utf8;
@@ -83,3 +96,43 @@ CREATE TABLE IF NOT EXISTS sample_database.transfer_history
 engine=innodb
 DEFAULT charset=utf8;
 
+
+-- Filled by the triggers below, so the tracker only has to reload users and torrents that changed.
+-- Old rows can be deleted by the site once they are older than the full reload interval.
+CREATE TABLE IF NOT EXISTS sample_database.tracker_changes
+  (
+      id      BIGINT(20) UNSIGNED NOT NULL auto_increment,
+      kind    ENUM('user', 'torrent') NOT NULL,
+      row_id  INT(10) UNSIGNED NOT NULL,
+     PRIMARY KEY ( id )
+  )
+engine=innodb
+DEFAULT charset=utf8;
+
+DELIMITER //
+
+CREATE TRIGGER sample_database.users_main_insert AFTER INSERT ON sample_database.users_main FOR EACH ROW
+  INSERT INTO sample_database.tracker_changes (kind, row_id) VALUES ('user', NEW.id)//
+
+CREATE TRIGGER sample_database.users_main_update AFTER UPDATE ON sample_database.users_main FOR EACH ROW
+  IF NOT (NEW.torrent_pass <=> OLD.torrent_pass AND NEW.enabled <=> OLD.enabled AND NEW.slots <=> OLD.slots
+          AND NEW.downmultiplier <=> OLD.downmultiplier AND NEW.upmultiplier <=> OLD.upmultiplier) THEN
+    INSERT INTO sample_database.tracker_changes (kind, row_id) VALUES ('user', NEW.id);
+  END IF//
+
+CREATE TRIGGER sample_database.users_main_delete AFTER DELETE ON sample_database.users_main FOR EACH ROW
+  INSERT INTO sample_database.tracker_changes (kind, row_id) VALUES ('user', OLD.id)//
+
+CREATE TRIGGER sample_database.torrents_insert AFTER INSERT ON sample_database.torrents FOR EACH ROW
+  INSERT INTO sample_database.tracker_changes (kind, row_id) VALUES ('torrent', NEW.id)//
+
+CREATE TRIGGER sample_database.torrents_update AFTER UPDATE ON sample_database.torrents FOR EACH ROW
+  IF NOT (NEW.info_hash <=> OLD.info_hash AND NEW.status <=> OLD.status
+          AND NEW.downmultiplier <=> OLD.downmultiplier AND NEW.upmultiplier <=> OLD.upmultiplier) THEN
+    INSERT INTO sample_database.tracker_changes (kind, row_id) VALUES ('torrent', NEW.id);
+  END IF//
+
+CREATE TRIGGER sample_database.torrents_delete AFTER DELETE ON sample_database.torrents FOR EACH ROW
+  INSERT INTO sample_database.tracker_changes (kind, row_id) VALUES ('torrent', OLD.id)//
+
+DELIMITER ;
@@ -0,0 +1,145 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/kotoko/chihaya/config"
+	cdb "github.com/kotoko/chihaya/database"
+	"github.com/kotoko/chihaya/logging"
+)
+
+var adminLogger = logging.New("admin")
+
+/*
+ * The admin endpoint lets the site push changes to single users, torrents and whitelisted clients
+ * instead of waiting for the next reload, e.g. /admin/update_torrent?info_hash=<info hash>&id=123&status=1
+ *
+ * The admin key is sent in the X-Admin-Key header or as key in a POST body, so it doesn't end up in access logs.
+ *
+ * update_user and update_torrent only change the values that are given, and add the record if it doesn't exist yet,
+ * with what a new row in the database would get for the rest. update_user finds the user by ID, so a changed
+ * passkey replaces the old one.
+ *
+ * replay_dead_letters queues the deltas that couldn't be flushed for flushing again.
+ */
+func (handler *httpHandler) admin(r *http.Request, buf *bytes.Buffer) {
+	if config.Current().AdminKey == "" {
+		failure("Unknown action", buf)
+		return
+	}
+
+	params, err := parseQuery(r.URL.RawQuery)
+	if err != nil {
+		failure("Error parsing query", buf)
+		return
+	}
+
+	key := r.Header.Get("X-Admin-Key")
+	if key == "" && r.Method == "POST" {
+		key = r.PostFormValue("key")
+	}
+	if key == "" || subtle.ConstantTimeCompare([]byte(key), []byte(config.Current().AdminKey)) != 1 {
+		failure("Invalid admin key", buf)
+		return
+	}
+
+	db := handler.db
+	_, action := path.Split(r.URL.Path)
+
+	switch action {
+	case "update_user":
+		passkey, _ := params.get("passkey")
+		id, idExists := params.getUint64("id")
+		if len(passkey) != 32 || !idExists {
+			failure("Malformed request", buf)
+			return
+		}
+		db.UpdateUser(passkey, id, func(user *cdb.User) {
+			if upMultiplier, exists := params.getFloat64("up_multiplier"); exists {
+				user.UpMultiplier = upMultiplier
+			}
+			if downMultiplier, exists := params.getFloat64("down_multiplier"); exists {
+				user.DownMultiplier = downMultiplier
+			}
+			if slots, exists := params.getInt64("slots"); exists {
+				user.Slots = slots
+			}
+		})
+		adminLogger.Info("Updated user", "user_id", id)
+	case "delete_user":
+		passkey, _ := params.get("passkey")
+		if len(passkey) != 32 {
+			failure("Malformed request", buf)
+			return
+		}
+		db.DeleteUser(passkey)
+		adminLogger.Info("Deleted user", "passkey", passkey)
+	case "update_torrent":
+		infoHash, _ := params.get("info_hash")
+		id, idExists := params.getUint64("id")
+		if len(infoHash) != 20 || !idExists {
+			failure("Malformed request", buf)
+			return
+		}
+		db.UpdateTorrent(infoHash, id, func(torrent *cdb.Torrent) {
+			if upMultiplier, exists := params.getFloat64("up_multiplier"); exists {
+				torrent.UpMultiplier = upMultiplier
+			}
+			if downMultiplier, exists := params.getFloat64("down_multiplier"); exists {
+				torrent.DownMultiplier = downMultiplier
+			}
+			if snatched, exists := params.getUint64("snatched"); exists {
+				torrent.Snatched = uint(snatched)
+			}
+			if status, exists := params.getInt64("status"); exists {
+				torrent.Status = status
+			}
+		})
+		adminLogger.Info("Updated torrent", "torrent_id", id)
+	case "delete_torrent":
+		infoHash, _ := params.get("info_hash")
+		if len(infoHash) != 20 {
+			failure("Malformed request", buf)
+			return
+		}
+		db.DeleteTorrent(infoHash)
+		adminLogger.Info("Deleted torrent", "info_hash", fmt.Sprintf("%x", infoHash))
+	case "add_whitelist":
+		peerId, _ := params.get("peer_id")
+		if peerId == "" {
+			failure("Malformed request", buf)
+			return
+		}
+		db.AddWhitelist(peerId)
+		adminLogger.Info("Whitelisted client", "peer_id", peerId)
+	case "delete_whitelist":
+		peerId, _ := params.get("peer_id")
+		if peerId == "" {
+			failure("Malformed request", buf)
+			return
+		}
+		db.DeleteWhitelist(peerId)
+		adminLogger.Info("Removed client from whitelist", "peer_id", peerId)
+	case "replay_dead_letters":
+		count, err := db.ReplayDeadLetters()
+		if err != nil {
+			adminLogger.Critical("Failed to replay dead letters", "err", err)
+			failure("Failed to replay dead letters", buf)
+			return
+		}
+		adminLogger.Info("Replayed dead letters", "count", count)
+	default:
+		failure("Unknown action", buf)
+		return
+	}
+
+	buf.WriteString("OK")
+}
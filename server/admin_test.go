@@ -0,0 +1,134 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/kotoko/chihaya/config"
+)
+
+func testAdmin(t *testing.T, action string, key string, query string) string {
+	var resultBuf bytes.Buffer
+	testReq, err := http.NewRequest("GET", "http://tracker/admin/"+action+"?"+query, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest error=%v", err)
+	}
+	testReq.Header.Set("X-Admin-Key", key)
+	testHandler.admin(testReq, &resultBuf)
+	return resultBuf.String()
+}
+
+func TestAdmin(t *testing.T) {
+	initTestDatabase(t)
+	db := testHandler.db
+
+	config.Loaded.AdminKey = ""
+	if resp := testAdmin(t, "delete_user", "", "passkey="+passkey); resp == "OK" {
+		t.Errorf("Admin endpoint enabled without a key")
+	}
+
+	config.Loaded.AdminKey = "secret"
+	defer func() { config.Loaded.AdminKey = "" }()
+
+	if resp := testAdmin(t, "update_user", "wrong", "passkey=45678912345678912345678912345678&id=3"); !strings.Contains(resp, "Invalid admin key") {
+		t.Errorf("Wrong admin key accepted: %q", resp)
+	}
+	if resp := testAdmin(t, "update_user", "", "key=secret&passkey=45678912345678912345678912345678&id=3"); !strings.Contains(resp, "Invalid admin key") {
+		t.Errorf("Admin key accepted in the query string: %q", resp)
+	}
+
+	var resultBuf bytes.Buffer
+	testReq, _ := http.NewRequest("POST", "http://tracker/admin/delete_user?passkey=45678912345678912345678912345678", strings.NewReader("key=secret"))
+	testReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if testHandler.admin(testReq, &resultBuf); resultBuf.String() != "OK" {
+		t.Errorf("Admin key not accepted in a POST body: %q", resultBuf.String())
+	}
+
+	if resp := testAdmin(t, "update_user", "secret", "passkey=45678912345678912345678912345678&id=3&slots=5"); resp != "OK" {
+		t.Fatalf("update_user failed: %q", resp)
+	}
+	db.UsersMutex.RLock()
+	user, exists := db.Users["45678912345678912345678912345678"]
+	db.UsersMutex.RUnlock()
+	if !exists || user.Id != 3 || user.Slots != 5 || user.UpMultiplier != 1 {
+		t.Errorf("User not added: %+v", user)
+	}
+
+	// Only the given values change
+	if resp := testAdmin(t, "update_user", "secret", "passkey=45678912345678912345678912345678&id=3&up_multiplier=2"); resp != "OK" {
+		t.Fatalf("update_user failed: %q", resp)
+	}
+	if user.Slots != 5 || user.UpMultiplier != 2 {
+		t.Errorf("User not partially updated: %+v", user)
+	}
+
+	// A new passkey replaces the old one
+	if resp := testAdmin(t, "update_user", "secret", "passkey=56789123456789123456789123456789&id=3"); resp != "OK" {
+		t.Fatalf("update_user failed: %q", resp)
+	}
+	db.UsersMutex.RLock()
+	_, oldExists := db.Users["45678912345678912345678912345678"]
+	moved := db.Users["56789123456789123456789123456789"]
+	db.UsersMutex.RUnlock()
+	if oldExists || moved != user || user.Slots != 5 {
+		t.Errorf("Passkey not changed: old passkey kept %v, user %+v", oldExists, moved)
+	}
+
+	if resp := testAdmin(t, "delete_user", "secret", "passkey=56789123456789123456789123456789"); resp != "OK" {
+		t.Fatalf("delete_user failed: %q", resp)
+	}
+	db.UsersMutex.RLock()
+	_, exists = db.Users["56789123456789123456789123456789"]
+	db.UsersMutex.RUnlock()
+	if exists {
+		t.Errorf("User not deleted")
+	}
+
+	infoHash := "abcdefghij0123456789"
+	if resp := testAdmin(t, "update_torrent", "secret", "info_hash="+url.QueryEscape(infoHash)+"&id=10&down_multiplier=0"); resp != "OK" {
+		t.Fatalf("update_torrent failed: %q", resp)
+	}
+	db.TorrentsMutex.RLock()
+	torrent, exists := db.Torrents[infoHash]
+	db.TorrentsMutex.RUnlock()
+	if !exists || torrent.Id != 10 || torrent.DownMultiplier != 0 || torrent.Seeders == nil {
+		t.Errorf("Torrent not added: %+v", torrent)
+	}
+
+	if resp := testAdmin(t, "update_torrent", "secret", "info_hash="+url.QueryEscape(infoHash)+"&id=10&status=1"); resp != "OK" {
+		t.Fatalf("update_torrent failed: %q", resp)
+	}
+	if torrent.DownMultiplier != 0 || torrent.UpMultiplier != 1 || torrent.Status != 1 {
+		t.Errorf("Torrent not partially updated: %+v", torrent)
+	}
+
+	if resp := testAdmin(t, "delete_torrent", "secret", "info_hash="+url.QueryEscape(infoHash)); resp != "OK" {
+		t.Fatalf("delete_torrent failed: %q", resp)
+	}
+	db.TorrentsMutex.RLock()
+	_, exists = db.Torrents[infoHash]
+	db.TorrentsMutex.RUnlock()
+	if exists {
+		t.Errorf("Torrent not deleted")
+	}
+
+	if resp := testAdmin(t, "add_whitelist", "secret", "peer_id=-qB"); resp != "OK" {
+		t.Fatalf("add_whitelist failed: %q", resp)
+	}
+	if approved, _ := db.CheckClient("-qB3300-000000000000"); !approved {
+		t.Errorf("Client not whitelisted")
+	}
+	if resp := testAdmin(t, "delete_whitelist", "secret", "peer_id=-qB"); resp != "OK" {
+		t.Fatalf("delete_whitelist failed: %q", resp)
+	}
+	if approved, _ := db.CheckClient("-qB3300-000000000000"); approved {
+		t.Errorf("Client still whitelisted")
+	}
+}
@@ -7,7 +7,6 @@ package server
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"strconv"
 	"sync/atomic"
 	"time"
@@ -16,33 +15,154 @@ import (
 	cdb "github.com/kotoko/chihaya/database"
 )
 
-func whitelisted(peerId string, db *cdb.Database) bool {
-	db.WhitelistMutex.RLock()
-	defer db.WhitelistMutex.RUnlock()
-
-	var widLen int
-	var i int
-	var matched bool
-
-	for _, whitelistedId := range db.Whitelist {
-		widLen = len(whitelistedId)
-		if widLen <= len(peerId) {
-			matched = true
-			for i = 0; i < widLen; i++ {
-				if peerId[i] != whitelistedId[i] {
-					matched = false
-					break
+// Announce times are truncated to seconds, so clients announcing right at the min interval can seem early
+const minAnnounceSlack = 2 * time.Second
+
+// clock is the time announces are recorded at, replaced by tests.
+var clock = time.Now
+
+// announceWriter serializes the outcome of an announce for a particular wire protocol.
+// It is called with the torrent mutex held, so implementations must not block.
+type announceWriter interface {
+	failure(reason string)
+	warning(message string) // Added to the following announce response, if the protocol has room for it
+	announce(torrent *cdb.Torrent, peer *cdb.Peer, numWant int, active bool)
+}
+
+// httpAnnounceWriter writes bencoded announce responses for the HTTP protocol.
+type httpAnnounceWriter struct {
+	buf            *bytes.Buffer
+	compact        bool
+	warningMessage string
+}
+
+type announceResponse struct {
+	Complete    int         `bencode:"complete"`
+	Incomplete  int         `bencode:"incomplete"`
+	Interval    int64       `bencode:"interval"`
+	MinInterval int64       `bencode:"min interval"`
+	Peers       interface{} `bencode:"peers,omitempty"` // Compact []byte, or []peerDict
+	Peers6      []byte      `bencode:"peers6,omitempty"`
+	Warning     string      `bencode:"warning message,omitempty"`
+}
+
+type peerDict struct {
+	IP     string `bencode:"ip"`
+	PeerId string `bencode:"peer id"`
+	Port   uint   `bencode:"port"`
+}
+
+func (w *httpAnnounceWriter) failure(reason string) {
+	failure(reason, w.buf)
+}
+
+func (w *httpAnnounceWriter) warning(message string) {
+	w.warningMessage = message
+}
+
+func (w *httpAnnounceWriter) announce(torrent *cdb.Torrent, peer *cdb.Peer, numWant int, active bool) {
+	response := announceResponse{
+		Complete:    len(torrent.Seeders),
+		Incomplete:  len(torrent.Leechers),
+		Interval:    int64(config.Current().Intervals.Announce.Duration / time.Second),
+		MinInterval: int64(config.Current().Intervals.MinAnnounce.Duration / time.Second),
+		Warning:     w.warningMessage,
+	}
+
+	if numWant > 0 && active {
+		if w.compact {
+			peers := make([]byte, 0, numWant*6)
+			peers6 := make([]byte, 0, numWant*18)
+
+			eachPeer(torrent, peer, numWant, func(p *cdb.Peer) bool {
+				peers = append(peers, p.Addr...)
+				peers6 = append(peers6, p.Addr6...)
+				return true
+			})
+
+			response.Peers = peers
+			response.Peers6 = peers6
+		} else {
+			peers := make([]peerDict, 0, peerCount(torrent, peer, numWant))
+
+			// Dual-stack peers are listed once per address
+			eachPeer(torrent, peer, numWant, func(p *cdb.Peer) bool {
+				if p.Ip != "" {
+					peers = append(peers, peerDict{p.Ip, p.Id, p.Port})
+				}
+				if p.Ip6 != "" {
+					peers = append(peers, peerDict{p.Ip6, p.Id, p.Port})
 				}
-			}
-			if matched {
 				return true
+			})
+
+			response.Peers = peers
+		}
+	}
+
+	writeBencode(response, w.buf)
+}
+
+// peerCount returns the number of peers eachPeer will visit for the given announcing peer.
+func peerCount(torrent *cdb.Torrent, peer *cdb.Peer, numWant int) int {
+	if peer.Seeding {
+		return minInt(numWant, len(torrent.Leechers))
+	}
+	return minInt(numWant, len(torrent.Leechers)+len(torrent.Seeders)-1)
+}
+
+// eachPeer calls fn for up to numWant peers of the torrent that are useful to the announcing peer.
+// Peers fn returns false for were skipped, and don't count toward numWant.
+// Seeders only get leechers, leechers get seeders first and then the other leechers.
+func eachPeer(torrent *cdb.Torrent, peer *cdb.Peer, numWant int, fn func(*cdb.Peer) bool) {
+	count := 0
+
+	if peer.Seeding {
+		for _, leech := range torrent.Leechers {
+			if count >= numWant {
+				break
+			}
+			if fn(leech) {
+				count++
+			}
+		}
+	} else {
+		/*
+		 * The iteration is already "random" as of Go 1 (so we don't need to randomize ourselves):
+		 * Each time an element is inserted into the map, it gets a some arbitrary position for iteration
+		 * Each time you range over the map, it starts at a random offset into the map's elements
+		 * See http://code.google.com/p/go/source/browse/src/pkg/runtime/hashmap.c?name=release-branch.go1#614
+		 *
+		 * Their fastrand1 function (for the random offset) is somewhat shitty though,
+		 * so I'm not 100% sure if this randomness is sufficient for rotating seeds
+		 * TODO: May want to look into / test this more though
+		 */
+
+		for _, seed := range torrent.Seeders {
+			if count >= numWant {
+				break
+			}
+			if fn(seed) {
+				count++
+			}
+		}
+
+		for _, leech := range torrent.Leechers {
+			if count >= numWant {
+				break
+			}
+			if leech != peer && fn(leech) {
+				count++
 			}
 		}
 	}
-	return false
+
+	if expected := peerCount(torrent, peer, numWant); expected != count {
+		logger.Warning("Calculated peer count differs from real count, this is a bug", "torrent_id", torrent.Id, "expected", expected, "count", count)
+	}
 }
 
-func announce(params *queryParams, user *cdb.User, ip string, db *cdb.Database, buf *bytes.Buffer) {
+func announce(params *queryParams, user *cdb.User, ip clientIP, db *cdb.Database, w announceWriter) {
 	var exists bool
 
 	// Mandatory parameters
@@ -54,35 +174,39 @@ func announce(params *queryParams, user *cdb.User, ip string, db *cdb.Database,
 	left, leftExists := params.getUint64("left")
 
 	if !(infoHash != "" && peerId != "" && portExists && uploadedExists && downloadedExists && leftExists) {
-		failure("Malformed request", buf)
+		w.failure("Malformed request")
 		return
 	}
 
-	if !whitelisted(peerId, db) {
-		failure("Your client is not approved", buf)
+	if approved, reason := db.CheckClient(peerId); !approved {
+		w.failure(reason)
 		return
 	}
 
-	// TODO: better synchronization strategy for announces (like per user mutexes)
-	db.TorrentsMutex.Lock()
-	defer db.TorrentsMutex.Unlock()
+	// The map is read locked for the whole announce, so the torrent can't be deleted or reloaded from under us,
+	// while announces on other torrents proceed in parallel
+	db.TorrentsMutex.RLock()
+	defer db.TorrentsMutex.RUnlock()
 
 	torrent, exists := db.Torrents[infoHash]
 	if !exists {
-		failure("This torrent does not exist", buf)
+		w.failure("This torrent does not exist")
 		return
 	}
 
+	torrent.Lock()
+	defer torrent.Unlock()
+
 	if torrent.Status == 1 && left == 0 {
-		log.Printf("Unpruning torrent %d", torrent.Id)
+		logger.Info("Unpruning torrent", "torrent_id", torrent.Id)
 		db.UnPrune(torrent)
 		torrent.Status = 0
 	} else if torrent.Status != 0 {
-		failure(fmt.Sprintf("This torrent does not exist (status: %d, left: %d)", torrent.Status, left), buf)
+		w.failure(fmt.Sprintf("This torrent does not exist (status: %d, left: %d)", torrent.Status, left))
 		return
 	}
 
-	now := time.Now().Unix()
+	now := clock().Unix()
 
 	// Optional parameters
 	event, _ := params.get("event")
@@ -101,6 +225,25 @@ func announce(params *queryParams, user *cdb.User, ip string, db *cdb.Database,
 		}
 	}
 
+	/*
+	 * Regular announces sooner than the min interval get the peer list, but aren't recorded.
+	 * The peer keeps its stats and last announce time, so the transfer and seed time of the early announce
+	 * are accounted at the next one, and announcing often doesn't add database writes.
+	 */
+	if event == "" {
+		peer, exists := torrent.Seeders[peerId]
+		if !exists {
+			peer, exists = torrent.Leechers[peerId]
+		}
+		minAnnounce := config.Current().Intervals.MinAnnounce.Duration - minAnnounceSlack
+		if exists && peer.UserId == user.Id && time.Duration(now-peer.LastAnnounce)*time.Second < minAnnounce {
+			earlyAnnounceCount.Inc()
+			w.warning("Announced before the min interval, stats are recorded at the next announce")
+			w.announce(torrent, peer, numWant, true)
+			return
+		}
+	}
+
 	// Match or create peer
 	var peer *cdb.Peer
 	newPeer := false
@@ -149,11 +292,11 @@ func announce(params *queryParams, user *cdb.User, ip string, db *cdb.Database,
 
 	// Update peer info/stats
 	if newPeer {
-		if user.Slots != -1 && config.Loaded.SlotsEnabled && !seeding {
-			if user.UsedSlots >= user.Slots {
-				failure("You don't have enough slots free. Stop downloading something and try again.", buf)
-				return
-			}
+		// Nothing fails after this, so the slot doesn't have to be given back
+		if !seeding && !user.TakeSlot(config.Current().SlotsEnabled) {
+			delete(torrent.Leechers, peerId)
+			w.failure("You don't have enough slots free. Stop downloading something and try again.")
+			return
 		}
 
 		peer.Id = peerId
@@ -163,10 +306,6 @@ func announce(params *queryParams, user *cdb.User, ip string, db *cdb.Database,
 		peer.LastAnnounce = now
 		peer.Uploaded = uploaded
 		peer.Downloaded = downloaded
-
-		if !seeding {
-			atomic.AddInt64(&user.UsedSlots, 1)
-		}
 	}
 
 	rawDeltaUpload := int64(uploaded) - int64(peer.Uploaded)
@@ -215,44 +354,31 @@ func announce(params *queryParams, user *cdb.User, ip string, db *cdb.Database,
 	} else if completed {
 		db.RecordSnatch(peer, now)
 		deltaSnatch = 1
+
+		// Torrents are only fully reloaded every so often, so keep the count up to date here
+		torrent.Snatched++
 	}
 
-	/*
-	 * Generate compact ip/port
-	 * Future TODO: possible IPv6 support
-	 */
-	if active && ip != peer.Ip || uint(port) != peer.Port {
-		peer.Addr = []byte{0, 0, 0, 0, 0, 0}
+	// Generate compact ip/port
+	var ip4, ip6 string
+	if ip.v4 != nil {
+		ip4 = ip.v4.String()
+	}
+	if ip.v6 != nil {
+		ip6 = ip.v6.String()
+	}
+	if active && (ip4 != peer.Ip || ip6 != peer.Ip6 || uint(port) != peer.Port) {
 		peer.Port = uint(port)
-		peer.Ip = ip
-		var val byte
-		val = 0
-		k := 0
-		for i := 0; i < len(ip); i++ {
-			if ip[i] == '.' {
-				if k > 2 {
-					failure("Malformed IP address", buf)
-					return
-				}
-				peer.Addr[k] = val
-				val = 0
-				k++
-			} else if ip[i] >= '0' && ip[i] <= '9' {
-				val = val*10 + ip[i] - '0'
-			} else {
-				failure("IPv4 address required (sorry!)", buf)
-				return
-			}
-		}
-		if k != 3 {
-			failure("Malformed IP address", buf)
-			return
-		}
-		peer.Addr[3] = val
-		peer.Addr[4] = byte(port >> 8)
-		peer.Addr[5] = byte(port & 0xff)
+		peer.Ip = ip4
+		peer.Ip6 = ip6
+		peer.Addr = compactAddr(ip.v4, port)
+		peer.Addr6 = compactAddr(ip.v6, port)
 		shouldFlushAddr = true
 	}
+	if active {
+		peer.IpFrom = ip.v4From
+		peer.Ip6From = ip.v6From
+	}
 
 	// If the channels are already full, record* blocks until a flush occurs
 	db.RecordTorrent(torrent, deltaSnatch)
@@ -266,126 +392,12 @@ func announce(params *queryParams, user *cdb.User, ip string, db *cdb.Database,
 	// Although slots used are still calculated for users with no restriction,
 	// we don't care as much about consistency for them. If they suddenly get a restriction,
 	// their slot count will be cleaned up on their next announce
-	if user.SlotsLastChecked+config.Loaded.Intervals.VerifyUsedSlots < now && user.Slots != -1 && config.Loaded.SlotsEnabled {
+	if atomic.LoadInt64(&user.SlotsLastChecked)+config.Current().Intervals.VerifyUsedSlots < now &&
+		atomic.LoadInt64(&user.Slots) != -1 && config.Current().SlotsEnabled {
 		db.VerifyUsedSlots(user)
 		atomic.StoreInt64(&user.SlotsLastChecked, now)
 	}
 
 	// Generate response
-	seedCount := len(torrent.Seeders)
-	leechCount := len(torrent.Leechers)
-
-	buf.WriteRune('d')
-	bencode("complete", buf)
-	bencode(seedCount, buf)
-	bencode("incomplete", buf)
-	bencode(leechCount, buf)
-	bencode("interval", buf)
-	bencode(config.Loaded.Intervals.Announce.Duration, buf)
-	bencode("min interval", buf)
-	bencode(config.Loaded.Intervals.MinAnnounce.Duration, buf)
-
-	if numWant > 0 && active {
-		bencode("peers", buf)
-
-		compactString, exists := params.get("compact")
-		compact := exists && compactString == "1"
-
-		var peerCount int
-		count := 0
-
-		if compact {
-			if seeding {
-				peerCount = minInt(numWant, leechCount)
-			} else {
-				peerCount = minInt(numWant, leechCount+seedCount-1)
-			}
-			buf.WriteString(strconv.Itoa(peerCount * 6))
-			buf.WriteRune(':')
-		} else {
-			buf.WriteRune('l')
-		}
-
-		if seeding {
-			for _, leech := range torrent.Leechers {
-				if count >= numWant {
-					break
-				}
-				if compact {
-					buf.Write(leech.Addr)
-				} else {
-					buf.WriteRune('d')
-					bencode("ip", buf)
-					bencode(leech.Ip, buf)
-					bencode("peer id", buf)
-					bencode(leech.Id, buf)
-					bencode("port", buf)
-					bencode(leech.Port, buf)
-					buf.WriteRune('e')
-				}
-				count++
-			}
-		} else {
-			/*
-			 * The iteration is already "random" as of Go 1 (so we don't need to randomize ourselves):
-			 * Each time an element is inserted into the map, it gets a some arbitrary position for iteration
-			 * Each time you range over the map, it starts at a random offset into the map's elements
-			 * See http://code.google.com/p/go/source/browse/src/pkg/runtime/hashmap.c?name=release-branch.go1#614
-			 *
-			 * Their fastrand1 function (for the random offset) is somewhat shitty though,
-			 * so I'm not 100% sure if this randomness is sufficient for rotating seeds
-			 * TODO: May want to look into / test this more though
-			 */
-
-			for _, seed := range torrent.Seeders {
-				if count >= numWant {
-					break
-				}
-				if compact {
-					buf.Write(seed.Addr)
-				} else {
-					buf.WriteRune('d')
-					bencode("ip", buf)
-					bencode(seed.Ip, buf)
-					bencode("peer id", buf)
-					bencode(seed.Id, buf)
-					bencode("port", buf)
-					bencode(seed.Port, buf)
-					buf.WriteRune('e')
-				}
-				count++
-			}
-
-			for _, leech := range torrent.Leechers {
-				if count >= numWant {
-					break
-				}
-				if leech != peer {
-					if compact {
-						buf.Write(leech.Addr)
-					} else {
-						buf.WriteRune('d')
-						bencode("ip", buf)
-						bencode(leech.Ip, buf)
-						bencode("peer id", buf)
-						bencode(leech.Id, buf)
-						bencode("port", buf)
-						bencode(leech.Port, buf)
-						buf.WriteRune('e')
-					}
-					count++
-				}
-			}
-		}
-
-		if compact && peerCount != count {
-			log.Printf("!!! WARNING/BUG !!! Calculated peer count (%d) != real count (%d) !!!\n", peerCount, count)
-		}
-
-		if !compact {
-			buf.WriteRune('e')
-		}
-	}
-
-	buf.WriteRune('e')
+	w.announce(torrent, peer, numWant, active)
 }
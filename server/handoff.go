@@ -0,0 +1,279 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kotoko/chihaya/config"
+)
+
+/*
+ * Restarting without downtime hands the listening sockets over to a new process:
+ *   1. The old process starts the new binary with the -handoff flag, passing it the sockets and two pipes
+ *   2. The new process reports it started through the first pipe, and waits on the second one
+ *   3. The old process stops accepting, lets the requests in flight finish and writes the snapshot
+ *   4. Writing to the second pipe lets the new process load the snapshot and start serving on the sockets,
+ *      while it reloads the backend in the background
+ *   5. The old process flushes its queues, and closes the second pipe once it's done, after which the new
+ *      process queues whatever the old one left in its journal
+ *
+ * Connections arriving between 3 and 4 wait in the socket's backlog, rather than being refused.
+ */
+
+const (
+	handoffReadyFd   = 3 // Written by the new process once it started
+	handoffReleaseFd = 4 // Written by the old process once the snapshot is written, closed once it shut down
+	handoffSocketFd  = 5 // First of the sockets, in the order named by the -handoff flag
+
+	handoffTimeout = 30 * time.Second
+)
+
+var (
+	handoffMutex sync.Mutex
+	tcpListener  *net.TCPListener // Set once the tracker is serving
+	udpListener  *net.UDPConn     // nil if UDP is disabled
+	release      *os.File         // Set once a new process took over
+
+	// Taken over from the old process by InheritListeners
+	inherited struct {
+		tcp     net.Listener
+		udp     net.PacketConn
+		release *os.File
+	}
+)
+
+// Handoff starts a new tracker process that takes over the sockets, and returns once it started.
+// The tracker should then be shut down, and the new process starts serving as soon as announces stopped.
+func Handoff() error {
+	handoffMutex.Lock()
+	defer handoffMutex.Unlock()
+
+	if tcpListener == nil {
+		return errors.New("tracker isn't serving yet")
+	}
+	if release != nil {
+		return errors.New("already handed off")
+	}
+
+	var sockets []*os.File
+	var names []string
+	f, err := tcpListener.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sockets, names = append(sockets, f), append(names, "tcp")
+
+	if udpListener != nil {
+		f, err := udpListener.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		sockets, names = append(sockets, f), append(names, "udp")
+	}
+
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyRead.Close()
+	releaseRead, releaseWrite, err := os.Pipe()
+	if err != nil {
+		readyWrite.Close()
+		return err
+	}
+	defer releaseRead.Close()
+
+	// The binary is looked up again, so a deploy that replaced it starts the new one
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		readyWrite.Close()
+		releaseWrite.Close()
+		return err
+	}
+	cmd := exec.Command(path, append(handoffArgs(os.Args[1:]), "-handoff", strings.Join(names, ","))...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append([]*os.File{readyWrite, releaseRead}, sockets...)
+
+	err = cmd.Start()
+	readyWrite.Close() // So the read fails if the new process exits
+	if err != nil {
+		releaseWrite.Close()
+		return err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyRead.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(handoffTimeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		releaseWrite.Close()
+		return fmt.Errorf("new process didn't start: %v", err)
+	}
+
+	release = releaseWrite
+	logger.Info("New process started, handing off", "pid", cmd.Process.Pid, "sockets", strings.Join(names, ","))
+	return nil
+}
+
+// handoffArgs drops the -handoff flag a process that was handed off to was started with.
+func handoffArgs(args []string) []string {
+	var ret []string
+	for i := 0; i < len(args); i++ {
+		switch arg := strings.TrimPrefix(args[i], "-"); {
+		case arg == "-handoff" || arg == "handoff":
+			i++ // Skip the value
+		case strings.HasPrefix(arg, "-handoff=") || strings.HasPrefix(arg, "handoff="):
+		default:
+			ret = append(ret, args[i])
+		}
+	}
+	return ret
+}
+
+// handingOff returns true once a new process started to take over.
+func handingOff() bool {
+	handoffMutex.Lock()
+	defer handoffMutex.Unlock()
+
+	return release != nil
+}
+
+// releaseHandoff lets the new process start serving, once the snapshot is written.
+func releaseHandoff() {
+	handoffMutex.Lock()
+	defer handoffMutex.Unlock()
+
+	if _, err := release.Write([]byte{1}); err != nil {
+		logger.Critical("Failed to release the new process", "err", err)
+		return
+	}
+	logger.Info("Handed off to the new process")
+}
+
+// finishHandoff tells the new process that the tracker shut down, so nothing else writes to the journal.
+func finishHandoff() {
+	handoffMutex.Lock()
+	defer handoffMutex.Unlock()
+
+	if release != nil {
+		release.Close()
+	}
+}
+
+// InheritListeners takes over the sockets of the process handing off (see Handoff), given the value of the
+// -handoff flag, and reports that this process started. Start waits for the old process's snapshot before serving.
+func InheritListeners(sockets string) error {
+	for i, name := range strings.Split(sockets, ",") {
+		fd := handoffSocketFd + i
+		f, err := inheritFile(fd, name+" socket", true)
+		if err != nil {
+			return err
+		}
+
+		switch name {
+		case "tcp":
+			inherited.tcp, err = net.FileListener(f)
+		case "udp":
+			inherited.udp, err = net.FilePacketConn(f)
+		default:
+			err = errors.New("unknown socket")
+		}
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s socket (fd %d): %v", name, fd, err)
+		}
+	}
+
+	// Both pipes are checked before reporting, so the old process doesn't shut down for nothing
+	ready, err := inheritFile(handoffReadyFd, "ready pipe", false)
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	if inherited.release, err = inheritFile(handoffReleaseFd, "release pipe", false); err != nil {
+		return err
+	}
+
+	if _, err = ready.Write([]byte{1}); err != nil {
+		return fmt.Errorf("ready pipe (fd %d): %v", handoffReadyFd, err)
+	}
+	return nil
+}
+
+// inheritFile returns the file passed as fd, once it's checked to be a socket or a pipe as expected.
+// File descriptors that aren't are left alone, since they may belong to something else.
+func inheritFile(fd int, name string, socket bool) (*os.File, error) {
+	if err := checkFd(fd, socket); err != nil {
+		return nil, fmt.Errorf("%s (fd %d) not passed: %v", name, fd, err)
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// waitForHandoff returns once the process handing off wrote its snapshot, or nil if nothing was handed off.
+// The returned channel is closed once the old process shut down.
+func waitForHandoff() <-chan struct{} {
+	if inherited.release == nil {
+		return nil
+	}
+
+	logger.Info("Waiting for the old process to stop serving")
+	if _, err := inherited.release.Read(make([]byte, 1)); err != nil {
+		// It exited without writing the snapshot, so the last one it wrote is used
+		logger.Warning("Old process shut down before handing off", "err", err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, inherited.release)
+		inherited.release.Close()
+		close(exited)
+	}()
+	return exited
+}
+
+// listen opens the sockets, unless they were inherited, and registers them for a handoff.
+func listen() (net.Listener, net.PacketConn, error) {
+	var err error
+	tcp, udp := inherited.tcp, inherited.udp
+
+	if tcp == nil {
+		if tcp, err = net.Listen("tcp", config.Loaded.BindAddress); err != nil {
+			return nil, nil, err
+		}
+	}
+	if udp == nil && config.Loaded.UDPBindAddress != "" {
+		if udp, err = net.ListenPacket("udp", config.Loaded.UDPBindAddress); err != nil {
+			tcp.Close()
+			return nil, nil, err
+		}
+	}
+
+	handoffMutex.Lock()
+	tcpListener, _ = tcp.(*net.TCPListener)
+	udpListener, _ = udp.(*net.UDPConn)
+	handoffMutex.Unlock()
+	return tcp, udp, nil
+}
@@ -0,0 +1,13 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+//go:build windows || plan9
+// +build windows plan9
+
+package server
+
+// checkFd can't tell what a file descriptor is on this platform, where handoffs aren't supported anyway.
+func checkFd(fd int, socket bool) error {
+	return nil
+}
@@ -0,0 +1,25 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHandoffArgs(t *testing.T) {
+	args := map[string][]string{
+		"-config c.json":                           {"-config", "c.json"},
+		"-config c.json -handoff tcp,udp":          {"-config", "c.json"},
+		"-handoff=tcp -addr :34000":                {"-addr", ":34000"},
+		"--handoff tcp -profile --handoff=tcp,udp": {"-profile"},
+	}
+	for in, expected := range args {
+		if out := handoffArgs(strings.Fields(in)); !reflect.DeepEqual(out, expected) {
+			t.Errorf("handoffArgs(%s) = %v, want %v", in, out, expected)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package server
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// checkFd returns an error if fd isn't open, or isn't a socket or a pipe as expected.
+func checkFd(fd int, socket bool) error {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return err
+	}
+
+	kind := uint32(st.Mode) & syscall.S_IFMT
+	if socket && kind != syscall.S_IFSOCK {
+		return fmt.Errorf("not a socket (mode %o)", kind)
+	}
+	if !socket && kind != syscall.S_IFIFO {
+		return fmt.Errorf("not a pipe (mode %o)", kind)
+	}
+	return nil
+}
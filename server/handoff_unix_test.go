@@ -0,0 +1,60 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckFd(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	socket, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	regular, err := ioutil.TempFile("", "handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(regular.Name())
+	defer regular.Close()
+
+	if err = checkFd(int(socket.Fd()), true); err != nil {
+		t.Errorf("Socket rejected: %v", err)
+	}
+	if err = checkFd(int(w.Fd()), false); err != nil {
+		t.Errorf("Pipe rejected: %v", err)
+	}
+	if err = checkFd(int(regular.Fd()), true); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("Checking a regular file returned %v", err)
+	}
+	if err = checkFd(int(socket.Fd()), false); err == nil || !strings.Contains(err.Error(), "not a pipe") {
+		t.Errorf("Checking a socket as a pipe returned %v", err)
+	}
+
+	if _, err = inheritFile(1000, "ready pipe", false); err == nil || !strings.Contains(err.Error(), "ready pipe (fd 1000) not passed") {
+		t.Errorf("Inheriting a closed fd returned %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/kotoko/chihaya/metrics"
+)
+
+var (
+	announceCount      = metrics.NewCounterVec("chihaya_announces_total", "Announces answered, by result.", "result")
+	scrapeCount        = metrics.NewCounterVec("chihaya_scrapes_total", "Scrapes answered, by result.", "result")
+	failureCount       = metrics.NewCounterVec("chihaya_failures_total", "Failed requests, by failure reason.", "reason")
+	earlyAnnounceCount = metrics.NewCounter("chihaya_early_announces_total", "Announces sooner than the min interval, answered without being recorded.")
+	rateLimitedCount   = metrics.NewCounterVec("chihaya_rate_limited_total", "Announces and scrapes refused for going over a rate limit, by limit.", "limit")
+	requestDuration    = metrics.NewHistogramVec("chihaya_request_duration_seconds", "Time taken to answer requests, by action.", "action", metrics.DurationBuckets)
+)
+
+// observeRequest records the outcome of a request once it has been answered.
+// Other actions are left out, since the label values would be whatever clients send.
+func observeRequest(action string, failed bool, start time.Time) {
+	var count *metrics.CounterVec
+	switch action {
+	case "announce":
+		count = announceCount
+	case "scrape":
+		count = scrapeCount
+	default:
+		return
+	}
+
+	if failed {
+		count.Inc("failure")
+	} else {
+		count.Inc("ok")
+	}
+	requestDuration.ObserveSince(action, start)
+}
+
+func countFailure(reason string) {
+	// Some reasons carry details, which would give every torrent its own series
+	if i := strings.Index(reason, " ("); i != -1 {
+		reason = reason[:i]
+	}
+	failureCount.Inc(reason)
+}
+
+func (handler *httpHandler) metrics(buf *bytes.Buffer) {
+	metrics.WriteGauge(buf, "chihaya_uptime_seconds", "Time since the tracker was started.", time.Now().Sub(handler.startTime).Seconds())
+	handler.db.WriteMetrics(buf)
+	metrics.Write(buf)
+}
@@ -0,0 +1,112 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kotoko/chihaya/config"
+	cdb "github.com/kotoko/chihaya/database"
+)
+
+/*
+ * Behind a proxy, the address a request came from is the proxy's, and the client's is in a header.
+ * Headers are only honored on requests from trusted proxies, since anyone else could send them.
+ * Proxies append the address they received the request from to X-Forwarded-For and Forwarded, so these are
+ * read from the end, skipping trusted proxies, and the first address that isn't one is the client's.
+ * Forwarded (RFC 7239) is preferred over X-Forwarded-For, which is preferred over X-Real-Ip.
+ */
+
+// trustedProxies caches the parsed trusted_proxies of the config in effect.
+type trustedProxies struct {
+	cfg      *config.TrackerConfig
+	networks []*net.IPNet
+}
+
+var proxyCache atomic.Value // trustedProxies
+
+func trustedNetworks() []*net.IPNet {
+	cfg := config.Current()
+	if cached, ok := proxyCache.Load().(trustedProxies); ok && cached.cfg == cfg {
+		return cached.networks
+	}
+
+	// Validated when the config was loaded
+	networks, _ := config.ParseNetworks(cfg.TrustedProxies)
+	proxyCache.Store(trustedProxies{cfg, networks})
+	return networks
+}
+
+func trusted(ip net.IP, networks []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceIP returns the address the request came from, which is nil if it's unknown, and where it was found.
+func sourceIP(r *http.Request) (net.IP, string) {
+	var remote net.IP
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remote = net.ParseIP(host)
+	}
+
+	networks := trustedNetworks()
+	if !trusted(remote, networks) {
+		return remote, cdb.IpFromConnection
+	}
+
+	var chain []string
+	if values := r.Header["Forwarded"]; len(values) > 0 {
+		chain = forwardedFor(values)
+	} else if values := r.Header["X-Forwarded-For"]; len(values) > 0 {
+		for _, value := range values {
+			chain = append(chain, strings.Split(value, ",")...)
+		}
+	} else if values := r.Header["X-Real-Ip"]; len(values) > 0 {
+		chain = values[:1]
+	}
+
+	ip, from := remote, cdb.IpFromConnection
+	for i := len(chain) - 1; i >= 0 && trusted(ip, networks); i-- {
+		hop := parseIP(strings.TrimSpace(chain[i]))
+		if hop == nil {
+			// Obfuscated or unknown, so the last trusted proxy is as close to the client as we get
+			break
+		}
+		ip, from = hop, cdb.IpFromProxy
+	}
+	return ip, from
+}
+
+// forwardedFor returns the for parameters of the elements of Forwarded headers, like for="[2001:db8::1]:4711".
+func forwardedFor(values []string) (addrs []string) {
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			addr := ""
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					addr = strings.Trim(kv[1], "\"")
+				}
+			}
+
+			// A bracketed IPv6 address without a port doesn't parse as either form
+			if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+				addr = addr[1 : len(addr)-1]
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	return
+}
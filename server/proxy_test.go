@@ -0,0 +1,78 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kotoko/chihaya/config"
+	cdb "github.com/kotoko/chihaya/database"
+)
+
+func TestSourceIP(t *testing.T) {
+	// The cache is keyed by the config, which is modified in place here
+	defer func(proxies []string) {
+		config.Loaded.TrustedProxies = proxies
+		proxyCache = atomic.Value{}
+	}(config.Loaded.TrustedProxies)
+	config.Loaded.TrustedProxies = []string{"127.0.0.1", "10.0.0.0/8"}
+	proxyCache = atomic.Value{}
+
+	tests := []struct {
+		remote   string
+		header   string
+		value    string
+		expected string
+		from     string
+	}{
+		{"192.0.2.1:6881", "", "", "192.0.2.1", cdb.IpFromConnection},
+		{"192.0.2.1:6881", "X-Real-Ip", "198.51.100.1", "192.0.2.1", cdb.IpFromConnection}, // Not a trusted proxy
+		{"127.0.0.1:6881", "X-Real-Ip", "198.51.100.1", "198.51.100.1", cdb.IpFromProxy},
+		{"127.0.0.1:6881", "X-Forwarded-For", "203.0.113.9, 198.51.100.1, 10.1.2.3", "198.51.100.1", cdb.IpFromProxy},
+		{"127.0.0.1:6881", "X-Forwarded-For", "10.0.0.2, 10.1.2.3", "10.0.0.2", cdb.IpFromProxy},
+		{"127.0.0.1:6881", "X-Forwarded-For", "garbage, 10.1.2.3", "10.1.2.3", cdb.IpFromProxy},
+		{"127.0.0.1:6881", "Forwarded", `for=198.51.100.1;proto=http, for="[2001:db8::1]:4711"`, "2001:db8::1", cdb.IpFromProxy},
+		{"127.0.0.1:6881", "Forwarded", `For="[2001:db8::1]"`, "2001:db8::1", cdb.IpFromProxy},
+		{"127.0.0.1:6881", "Forwarded", "for=unknown", "127.0.0.1", cdb.IpFromConnection},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/announce", nil)
+		req.RemoteAddr = test.remote
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		ip, from := sourceIP(req)
+		if !ip.Equal(net.ParseIP(test.expected)) || from != test.from {
+			t.Errorf("%s from %s resolved to %s (%s), want %s (%s)", test.header, test.remote, ip, from, test.expected, test.from)
+		}
+	}
+}
+
+func TestIPParamPolicy(t *testing.T) {
+	defer config.Swap(config.Current())
+	params := &queryParams{params: map[string]string{"ip": "198.51.100.1", "ipv6": "2001:db8::1"}}
+	source := net.ParseIP("192.0.2.1")
+
+	policies := map[string]struct {
+		v4, v4From string
+		v6         bool
+	}{
+		"never":       {"192.0.2.1", cdb.IpFromConnection, false},
+		"same_family": {"198.51.100.1", cdb.IpFromParam, false},
+		"always":      {"198.51.100.1", cdb.IpFromParam, true},
+	}
+	for policy, expected := range policies {
+		cfg := *config.Current()
+		cfg.IPParam = policy
+		config.Swap(&cfg)
+		ip := resolveIP(params, source, cdb.IpFromConnection)
+		if !ip.v4.Equal(net.ParseIP(expected.v4)) || ip.v4From != expected.v4From || (ip.v6 != nil) != expected.v6 {
+			t.Errorf("With %s, resolved %+v", policy, ip)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/kotoko/chihaya/config"
+)
+
+var (
+	passkeyLimiter = newRateLimiter()
+	ipLimiter      = newRateLimiter()
+)
+
+/*
+ * Rate limits are token buckets: every request takes a token, and tokens are added back at the limit's rate,
+ * up to its burst. Buckets that filled up again are pruned every so often, so the maps only hold the keys
+ * that made requests recently.
+ */
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from the bucket of key, or returns how long it takes until one is available.
+func (l *rateLimiter) allow(key string, limit config.TrackerRateLimit, now time.Time) (ok bool, retryIn time.Duration) {
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+	burst := float64(limit.Burst)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.lastPrune) >= time.Minute {
+		l.prune(limit, now)
+	}
+
+	bucket, exists := l.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+func (l *rateLimiter) prune(limit config.TrackerRateLimit, now time.Time) {
+	full := time.Duration(float64(limit.Burst) / limit.Rate * float64(time.Second))
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+// rateLimited takes a token for key, and returns how long the client should wait if there was none left.
+func rateLimited(limiter *rateLimiter, name string, key string, limit config.TrackerRateLimit) (retryIn time.Duration, limited bool) {
+	ok, retryIn := limiter.allow(key, limit, time.Now())
+	if !ok {
+		rateLimitedCount.Inc(name)
+	}
+	return retryIn, !ok
+}
+
+// retryMinutes rounds a wait up to whole minutes, the unit of the BEP 31 retry in key.
+func retryMinutes(retryIn time.Duration) int64 {
+	minutes := int64((retryIn + time.Minute - 1) / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+	return minutes
+}
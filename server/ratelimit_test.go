@@ -0,0 +1,99 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kotoko/chihaya/bufferpool"
+	"github.com/kotoko/chihaya/config"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter()
+	limit := config.TrackerRateLimit{Rate: 0.5, Burst: 3}
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.allow("a", limit, now); !ok {
+			t.Fatalf("Request %d within the burst refused", i+1)
+		}
+	}
+	ok, retryIn := limiter.allow("a", limit, now)
+	if ok {
+		t.Fatal("Request over the burst allowed")
+	}
+	if retryIn != 2*time.Second {
+		t.Errorf("Retry in %v, want 2s", retryIn)
+	}
+	if ok, _ = limiter.allow("b", limit, now); !ok {
+		t.Error("Other key limited")
+	}
+
+	// Refills at the rate
+	if ok, _ = limiter.allow("a", limit, now.Add(time.Second)); ok {
+		t.Error("Allowed before a token was added")
+	}
+	if ok, _ = limiter.allow("a", limit, now.Add(2*time.Second)); !ok {
+		t.Error("Refused after a token was added")
+	}
+
+	// Full buckets are pruned
+	limiter.allow("c", limit, now.Add(time.Hour))
+	if len(limiter.buckets) != 1 {
+		t.Errorf("%d buckets left after pruning, want 1", len(limiter.buckets))
+	}
+
+	// A rate of 0 disables the limit
+	for i := 0; i < 100; i++ {
+		if ok, _ = limiter.allow("d", config.TrackerRateLimit{}, now); !ok {
+			t.Fatal("Disabled limit refused a request")
+		}
+	}
+}
+
+func TestRetryMinutes(t *testing.T) {
+	for retryIn, expected := range map[time.Duration]int64{
+		time.Second:                      1,
+		time.Minute:                      1,
+		time.Minute + time.Second:        2,
+		10*time.Minute - time.Nanosecond: 10,
+	} {
+		if minutes := retryMinutes(retryIn); minutes != expected {
+			t.Errorf("retryMinutes(%v) = %d, want %d", retryIn, minutes, expected)
+		}
+	}
+}
+
+func TestRespondRateLimited(t *testing.T) {
+	initTestDatabase(t)
+	testHandler.bufferPool = bufferpool.New(5, 5)
+	defer func(limits config.TrackerRateLimits) { config.Loaded.RateLimits = limits }(config.Loaded.RateLimits)
+	config.Loaded.RateLimits = config.TrackerRateLimits{IP: config.TrackerRateLimit{Rate: 0.001, Burst: 1}}
+
+	scrape := func(key string) string {
+		var buf bytes.Buffer
+		req, _ := http.NewRequest("GET", "http://tracker/"+key+"/scrape?info_hash=x", nil)
+		req.RemoteAddr = "192.0.2.10:6881"
+		testHandler.respond(req, &buf)
+		return buf.String()
+	}
+
+	// Unknown passkeys use up the limit of the address too
+	if resp := scrape("00000000000000000000000000000000"); !strings.Contains(resp, "Passkey not found") {
+		t.Fatalf("Unexpected first response: %q", resp)
+	}
+	resp := scrape(passkey)
+	if !strings.HasPrefix(resp, failurePrefix) || !strings.Contains(resp, "from your IP address") {
+		t.Errorf("Request over the limit answered with %q", resp)
+	}
+	if !strings.Contains(resp, "8:retry ini17e") {
+		t.Errorf("Missing retry in hint: %q", resp)
+	}
+}
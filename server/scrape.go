@@ -10,36 +10,48 @@ import (
 	cdb "github.com/kotoko/chihaya/database"
 )
 
-func writeScrapeInfo(torrent *cdb.Torrent, buf *bytes.Buffer) {
-	buf.WriteRune('d')
-	bencode("complete", buf)
-	bencode(len(torrent.Seeders), buf)
-	bencode("downloaded", buf)
-	bencode(torrent.Snatched, buf)
-	bencode("incomplete", buf)
-	bencode(len(torrent.Leechers), buf)
-	buf.WriteRune('e')
+type scrapeInfo struct {
+	Complete   int  `bencode:"complete"`
+	Downloaded uint `bencode:"downloaded"`
+	Incomplete int  `bencode:"incomplete"`
 }
 
-func scrape(params *queryParams, db *cdb.Database, buf *bytes.Buffer) {
-	buf.WriteRune('d')
-	bencode("files", buf)
+type scrapeResponse struct {
+	Files map[string]scrapeInfo `bencode:"files"`
+}
+
+// scrapeTorrents calls fn for each info hash in order, with a nil torrent if it isn't known.
+// Each torrent is read locked while fn is called.
+func scrapeTorrents(infoHashes []string, db *cdb.Database, fn func(infoHash string, torrent *cdb.Torrent)) {
 	db.TorrentsMutex.RLock()
-	if params.infoHashes != nil {
-		for _, infoHash := range params.infoHashes {
-			torrent, exists := db.Torrents[infoHash]
-			if exists {
-				bencode(infoHash, buf)
-				writeScrapeInfo(torrent, buf)
-			}
-		}
-	} else if infoHash, exists := params.get("info_hash"); exists {
+	defer db.TorrentsMutex.RUnlock()
+
+	for _, infoHash := range infoHashes {
 		torrent, exists := db.Torrents[infoHash]
-		if exists {
-			bencode(infoHash, buf)
-			writeScrapeInfo(torrent, buf)
+		if !exists {
+			fn(infoHash, nil)
+			continue
 		}
+
+		torrent.RLock()
+		fn(infoHash, torrent)
+		torrent.RUnlock()
 	}
-	db.TorrentsMutex.RUnlock()
-	buf.WriteRune('e')
+}
+
+func scrape(params *queryParams, db *cdb.Database, buf *bytes.Buffer) {
+	infoHashes := params.infoHashes
+	if infoHashes == nil {
+		if infoHash, exists := params.get("info_hash"); exists {
+			infoHashes = []string{infoHash}
+		}
+	}
+
+	response := scrapeResponse{make(map[string]scrapeInfo, len(infoHashes))}
+	scrapeTorrents(infoHashes, db, func(infoHash string, torrent *cdb.Torrent) {
+		if torrent != nil {
+			response.Files[infoHash] = scrapeInfo{len(torrent.Seeders), torrent.Snatched, len(torrent.Leechers)}
+		}
+	})
+	writeBencode(response, buf)
 }
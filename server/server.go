@@ -7,13 +7,14 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,14 +22,17 @@ import (
 	"github.com/kotoko/chihaya/bufferpool"
 	"github.com/kotoko/chihaya/config"
 	cdb "github.com/kotoko/chihaya/database"
+	"github.com/kotoko/chihaya/logging"
 )
 
+var logger = logging.New("server")
+
 type httpHandler struct {
 	db         *cdb.Database
 	bufferPool *bufferpool.BufferPool
 	waitGroup  sync.WaitGroup
 	startTime  time.Time
-	terminate  bool
+	terminate  int32 // Set once the database is terminated, accessed atomically
 
 	// Internal stats
 	deltaRequests int64
@@ -58,12 +62,49 @@ func (p *queryParams) getUint64(which string) (ret uint64, exists bool) {
 	return
 }
 
+func (p *queryParams) getInt64(which string) (ret int64, exists bool) {
+	str, exists := p.params[which]
+	if exists {
+		var err error
+		exists = false
+		ret, err = strconv.ParseInt(str, 10, 64)
+		if err == nil {
+			exists = true
+		}
+	}
+	return
+}
+
+func (p *queryParams) getFloat64(which string) (ret float64, exists bool) {
+	str, exists := p.params[which]
+	if exists {
+		var err error
+		exists = false
+		ret, err = strconv.ParseFloat(str, 64)
+		if err == nil {
+			exists = true
+		}
+	}
+	return
+}
+
+// The failure reason sorts before any other key, so every failure response starts with this
+const failurePrefix = "d14:failure reason"
+
+type failureResponse struct {
+	Reason  string `bencode:"failure reason"`
+	RetryIn int64  `bencode:"retry in,omitempty"` // Minutes, as per BEP 31
+}
+
 func failure(err string, buf *bytes.Buffer) {
-	buf.WriteString("d14:failure reason")
-	buf.WriteString(strconv.Itoa(len(err)))
-	buf.WriteRune(':')
-	buf.WriteString(err)
-	buf.WriteRune('e')
+	countFailure(err)
+	writeBencode(failureResponse{Reason: err}, buf)
+}
+
+// retryFailure is a failure telling the client when to try again, rather than at its next announce interval.
+func retryFailure(err string, retryIn time.Duration, buf *bytes.Buffer) {
+	countFailure(err)
+	writeBencode(failureResponse{Reason: err, RetryIn: retryMinutes(retryIn)}, buf)
 }
 
 /*
@@ -139,8 +180,78 @@ func parseQuery(query string) (ret *queryParams, err error) {
 	return
 }
 
+// clientIP holds the addresses a peer can be reached at, and where they came from (see cdb.IpFromConnection).
+// Either of them may be nil, but not both.
+type clientIP struct {
+	v4     net.IP
+	v6     net.IP
+	v4From string
+	v6From string
+}
+
+// add sets the slot matching the address family of addr, unless it was already set.
+func (ip *clientIP) add(addr net.IP, from string) {
+	if addr == nil {
+		return
+	}
+	if addr4 := addr.To4(); addr4 != nil {
+		if ip.v4 == nil {
+			ip.v4, ip.v4From = addr4, from
+		}
+	} else if ip.v6 == nil {
+		ip.v6, ip.v6From = addr, from
+	}
+}
+
+// parseIP parses a bare IP address, also accepting the "[address]:port" form BEP 7 allows for ipv6.
+func parseIP(str string) net.IP {
+	if ip := net.ParseIP(str); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(str); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+/*
+ * Addresses given by the client (ip, ipv4 and ipv6 as per BEP 7) take precedence, if the ip_param policy allows them.
+ * The address the request came from (see sourceIP) fills in the remaining address family,
+ * so a dual-stack client announcing over IPv6 with an ipv4 parameter is reachable over both.
+ */
+func resolveIP(params *queryParams, source net.IP, sourceFrom string) (ip clientIP) {
+	for _, param := range []string{"ip", "ipv4", "ipv6"} {
+		if str, exists := params.get(param); exists {
+			if addr := parseIP(str); ipParamAllowed(addr, source) {
+				ip.add(addr, cdb.IpFromParam)
+			}
+		}
+	}
+
+	ip.add(source, sourceFrom)
+	return
+}
+
+// ipParamAllowed returns whether an address given by the client may be used, given the address the request came from.
+func ipParamAllowed(addr net.IP, source net.IP) bool {
+	switch config.Current().IPParam {
+	case "always":
+		return true
+	case "same_family":
+		return addr != nil && source != nil && (addr.To4() == nil) == (source.To4() == nil)
+	}
+	return false
+}
+
 func (handler *httpHandler) respond(r *http.Request, buf *bytes.Buffer) {
+	start := time.Now()
 	dir, action := path.Split(r.URL.Path)
+
+	// Failures are recognized from the response, so every early return is counted
+	defer func() {
+		observeRequest(action, bytes.HasPrefix(buf.Bytes(), []byte(failurePrefix)), start)
+	}()
+
 	if len(dir) != 34 {
 		failure("Your passkey is invalid", buf)
 		return
@@ -148,6 +259,16 @@ func (handler *httpHandler) respond(r *http.Request, buf *bytes.Buffer) {
 
 	passkey := dir[1:33]
 
+	// Limited before looking up the passkey, so guessing passkeys is limited too
+	limits := config.Current().RateLimits
+	source, sourceFrom := sourceIP(r)
+	if source != nil {
+		if retryIn, limited := rateLimited(ipLimiter, "ip", source.String(), limits.IP); limited {
+			retryFailure("Too many requests from your IP address", retryIn, buf)
+			return
+		}
+	}
+
 	params, err := parseQuery(r.URL.RawQuery)
 
 	if err != nil {
@@ -155,6 +276,12 @@ func (handler *httpHandler) respond(r *http.Request, buf *bytes.Buffer) {
 		return
 	}
 
+	ip := resolveIP(params, source, sourceFrom)
+	if handler.db.Banned(source, ip.v4, ip.v6) {
+		failure(config.Current().Bans.Message, buf)
+		return
+	}
+
 	handler.db.UsersMutex.RLock()
 	user, exists := handler.db.Users[passkey]
 	handler.db.UsersMutex.RUnlock()
@@ -163,33 +290,20 @@ func (handler *httpHandler) respond(r *http.Request, buf *bytes.Buffer) {
 		return
 	}
 
-	ip, exists := params.get("ip")
-	if !exists {
-		ip, exists = params.get("ipv4")
-		if !exists {
-			ips, exists := r.Header["X-Real-Ip"]
-			if exists && len(ips) > 0 {
-				ip = ips[0]
-			} else {
-				portIndex := len(r.RemoteAddr) - 1
-				for ; portIndex >= 0; portIndex-- {
-					if r.RemoteAddr[portIndex] == ':' {
-						break
-					}
-				}
-				if portIndex != -1 {
-					ip = r.RemoteAddr[0:portIndex]
-				} else {
-					failure("Failed to parse IP address", buf)
-					return
-				}
-			}
-		}
+	if retryIn, limited := rateLimited(passkeyLimiter, "passkey", passkey, limits.Passkey); limited {
+		retryFailure("Too many requests for your passkey", retryIn, buf)
+		return
+	}
+
+	if ip.v4 == nil && ip.v6 == nil {
+		failure("Failed to parse IP address", buf)
+		return
 	}
 
 	switch action {
 	case "announce":
-		announce(params, user, ip, handler.db, buf)
+		compact, _ := params.get("compact")
+		announce(params, user, ip, handler.db, &httpAnnounceWriter{buf: buf, compact: compact == "1"})
 		return
 	case "scrape":
 		scrape(params, handler.db, buf)
@@ -200,10 +314,19 @@ func (handler *httpHandler) respond(r *http.Request, buf *bytes.Buffer) {
 }
 
 var handler *httpHandler
-var listener net.Listener
+
+func (handler *httpHandler) terminating() bool {
+	return atomic.LoadInt32(&handler.terminate) != 0
+}
 
 func (handler *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if handler.terminate {
+	// Requests arriving after the database was terminated, once the shutdown timeout passed
+	if handler.terminating() {
+		var buf bytes.Buffer
+		failure("Tracker is shutting down", &buf)
+		w.Header().Add("Connection", "close")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(buf.Bytes())
 		return
 	}
 	handler.waitGroup.Add(1)
@@ -212,14 +335,14 @@ func (handler *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		err := recover()
 		if err != nil {
-			log.Printf("!!! ServeHTTP panic !!! %v", err)
+			logger.Critical("ServeHTTP panic", "err", err)
 		}
 	}()
 
 	buf := handler.bufferPool.Take()
 	defer handler.bufferPool.Give(buf)
 
-	//log.Println(r.URL)
+	//logger.Debug("Request", "url", r.URL)
 
 	if r.URL.Path == "/stats" {
 		db := handler.db
@@ -229,7 +352,9 @@ func (handler *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		db.TorrentsMutex.RLock()
 
 		for _, t := range db.Torrents {
+			t.RLock()
 			peers += len(t.Leechers) + len(t.Seeders)
+			t.RUnlock()
 		}
 
 		buf.WriteString(fmt.Sprintf("Uptime: %f\nUsers: %d\nTorrents: %d\nPeers: %d\nThroughput (last minute): %f req/s\n",
@@ -242,6 +367,10 @@ func (handler *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		db.UsersMutex.RUnlock()
 		db.TorrentsMutex.RUnlock()
+	} else if r.URL.Path == "/metrics" {
+		handler.metrics(buf)
+	} else if strings.HasPrefix(r.URL.Path, "/admin/") {
+		handler.admin(r, buf)
 	} else {
 		handler.respond(r, buf)
 	}
@@ -268,9 +397,8 @@ func (handler *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.(http.Flusher).Flush()
 }
 
-func Start() {
-	var err error
-
+// Start runs the tracker until the context is canceled, and then shuts it down gracefully.
+func Start(ctx context.Context) {
 	handler = &httpHandler{db: &cdb.Database{}, startTime: time.Now()}
 
 	bufferPool := bufferpool.New(500, 500)
@@ -283,32 +411,81 @@ func Start() {
 
 	go collectStatistics()
 
-	handler.db.Init()
+	// After a handoff, the old process's snapshot is current once it stopped serving
+	if previous := waitForHandoff(); previous != nil {
+		handler.db.InitHandedOff(cdb.OpenBackend(), previous)
+	} else {
+		handler.db.Init(cdb.OpenBackend())
+	}
 
-	listener, err = net.Listen("tcp", config.Loaded.BindAddress)
+	listener, udpConn, err := listen()
 
 	if err != nil {
 		panic(err)
 	}
 
+	if udpConn != nil {
+		udpServer = newUDPHandler(handler, udpConn)
+		go udpServer.serve()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		shutdown(server)
+		close(done)
+	}()
+
 	/*
 	 * Behind the scenes, this works by spawning a new goroutine for each client.
 	 * This is pretty fast and scalable since goroutines are nice and efficient.
 	 */
-	server.Serve(listener)
+	if err = server.Serve(listener); err != http.ErrServerClosed {
+		logger.Critical("HTTP server failed", "err", err)
+	}
 
-	// Wait for active connections to finish processing
-	handler.waitGroup.Wait()
+	<-done
+	logger.Info("Shutdown complete")
+}
 
-	handler.db.Terminate()
+/*
+ * Shutting down stops accepting requests, and gives the ones in flight until the shutdown timeout to finish.
+ * The database is terminated after that either way, which flushes the queues and serializes the caches.
+ * Requests still running then have their deltas dropped, and the ones arriving late are refused.
+ * When handing off, the caches are serialized before flushing instead, so the new process can start serving.
+ */
+func shutdown(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Current().Intervals.ShutdownTimeout.Duration)
+	defer cancel()
 
-	log.Println("Shutdown complete")
-}
+	if udpServer != nil {
+		udpServer.conn.Close()
+		<-udpServer.stopped
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warning("Shutdown timeout passed with HTTP requests in flight", "err", err)
+	}
 
-func Stop() {
-	// Closing the listener stops accepting connections and causes Serve to return
-	listener.Close()
-	handler.terminate = true
+	// UDP requests aren't tracked by the HTTP server
+	drained := make(chan struct{})
+	go func() {
+		handler.waitGroup.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		logger.Warning("Shutdown timeout passed with requests in flight")
+	}
+
+	atomic.StoreInt32(&handler.terminate, 1)
+	if handingOff() {
+		// The new process starts serving from the snapshot, while this one flushes its queues
+		handler.db.HandOff()
+		releaseHandoff()
+	}
+	handler.db.Terminate()
+	finishHandoff()
 }
 
 func collectStatistics() {
@@ -319,7 +496,7 @@ func collectStatistics() {
 		handler.throughput = float64(handler.deltaRequests) / duration.Seconds()
 		atomic.StoreInt64(&handler.deltaRequests, 0)
 
-		log.Printf("Throughput last minute: %4f req/s\n", handler.throughput)
+		logger.Info("Throughput last minute", "requests_per_second", handler.throughput)
 		lastTime = time.Now()
 	}
 }
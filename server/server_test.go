@@ -2,26 +2,51 @@ package server
 
 import (
 	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/kotoko/chihaya/bencode"
 	"github.com/kotoko/chihaya/bufferpool"
+	"github.com/kotoko/chihaya/config"
 	"github.com/kotoko/chihaya/database"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-var testUser database.User
-
-//requires db to be correctly setup and for config.json to be valid
+//seeded from testdata/fixture.json, so no database server is needed
+var testBackend = database.NewMemoryBackend()
 var testHandler = &httpHandler{db: &database.Database{}, startTime: time.Now()}
 var dbInit = false
 
-//works around db access
+//user 1 in the fixture
 var passkey = "23456789123456789123456789123456"
 
+func initTestDatabase(tb testing.TB) {
+	if dbInit {
+		return
+	}
+	if err := testBackend.LoadFixture("testdata/fixture.json"); err != nil {
+		tb.Fatalf("Failed to load fixture: %v", err)
+	}
+	testBackend.KeepDeltas = true
+	config.Loaded.Intervals.FlushSleep.Duration = 10 * time.Millisecond
+	config.Loaded.JournalPath = ""
+	// The tests announce far more often than any client
+	config.Loaded.RateLimits = config.TrackerRateLimits{}
+	config.Loaded.Intervals.MinAnnounce.Duration = 0
+	// Requests made in the tests have no source address, they announce with the ip parameter instead
+	config.Loaded.IPParam = "always"
+	testHandler.db.Init(testBackend)
+	dbInit = true
+}
+
 //used for comparison benchmarking
 var parseRequestURLTests = []struct {
 	url           string
@@ -169,6 +194,27 @@ func TestParseQuery(t *testing.T) {
 	}
 }
 
+var compactAddrTests = []struct {
+	ip   string
+	port uint64
+	out  []byte
+}{
+	{"127.0.0.1", 6881, []byte{127, 0, 0, 1, 0x1a, 0xe1}},
+	{"::ffff:10.0.0.1", 80, []byte{10, 0, 0, 1, 0, 80}},
+	{"2607:f0d0:1002:51::4", 6881, []byte{0x26, 0x07, 0xf0, 0xd0, 0x10, 0x02, 0, 0x51, 0, 0, 0, 0, 0, 0, 0, 4, 0x1a, 0xe1}},
+}
+
+func TestCompactAddr(t *testing.T) {
+	for _, test := range compactAddrTests {
+		if addr := compactAddr(net.ParseIP(test.ip), test.port); !bytes.Equal(addr, test.out) {
+			t.Errorf("compactAddr(%s, %d) = %v, want %v", test.ip, test.port, addr, test.out)
+		}
+	}
+	if addr := compactAddr(nil, 6881); addr != nil {
+		t.Errorf("compactAddr(nil) = %v, want nil", addr)
+	}
+}
+
 const invalidPasskeyErrorStr = "passkey is invalid"
 const missingPasskeyErrorStr = "Passkey not found"
 const ipAddrErrorStr = "Failed to parse IP address"
@@ -186,8 +232,10 @@ var respondErrorTests = []struct {
 	{"http://www.bing.com/02345678912345678912345678912345/error", missingPasskeyErrorStr},
 	{"http://www.bing.com/2345678912345678912345678912345O/error", missingPasskeyErrorStr},
 	{"http://www.bing.com/23456789123456789123456789123456/error", ipAddrErrorStr},
-	{"http://www.bing.com/23456789123456789123456789123456/error&ipv6=2607:f0d0:1002:0051:0000:0000:0000:0004", ipAddrErrorStr},
-	{"http://www.bing.com/23456789123456789123456789123456/error&ipv6=2607:f0d0:1002:51::4", ipAddrErrorStr},
+	{"http://www.bing.com/23456789123456789123456789123456/error&ipv6=2607:f0d0:1002:0051:0000:0000:0000:0004", badRequestErrorStr},
+	{"http://www.bing.com/23456789123456789123456789123456/error&ipv6=2607:f0d0:1002:51::4", badRequestErrorStr},
+	{"http://www.bing.com/23456789123456789123456789123456/error&ipv6=[2607:f0d0:1002:51::4]:6881", badRequestErrorStr},
+	{"http://www.bing.com/23456789123456789123456789123456/error&ipv6=not.an.ip", ipAddrErrorStr},
 	{"http://www.bing.com/23456789123456789123456789123456/error&ip=127.0.0.1", badRequestErrorStr},
 	{"http://www.bing.com/23456789123456789123456789123456/error&ipv4=127.0.0.1", badRequestErrorStr},
 	{"http://www.bing.com/23456789123456789123456789123456/error&ip=2607:f0d0:1002:51::4", badRequestErrorStr},
@@ -195,14 +243,9 @@ var respondErrorTests = []struct {
 }
 
 func TestRespondErrors(t *testing.T) {
-	if !dbInit {
-		testHandler.db.Init()
-		dbInit = true
-	}
-	testHandler.db.Users[passkey] = &testUser
-	usr, ex := testHandler.db.Users[passkey]
-	if !ex {
-		t.Errorf("Cannot mock user(%s) passkey %v", usr, passkey)
+	initTestDatabase(t)
+	if _, ex := testHandler.db.Users[passkey]; !ex {
+		t.Errorf("Cannot find user with passkey %v", passkey)
 	}
 	for _, reqText := range respondErrorTests {
 		var resultBuf bytes.Buffer
@@ -227,21 +270,51 @@ func TestRespondErrors(t *testing.T) {
 	}
 }
 
+func TestRespondBanned(t *testing.T) {
+	initTestDatabase(t)
+	db := testHandler.db
+	db.BansMutex.Lock()
+	previous := db.Bans
+	db.Bans, _ = database.NewBanList([]string{"192.0.2.0/24", "2001:db8::1"})
+	db.BansMutex.Unlock()
+	defer func() {
+		db.BansMutex.Lock()
+		db.Bans = previous
+		db.BansMutex.Unlock()
+	}()
+
+	requests := map[string]bool{
+		"192.0.2.7:6881|":                    true,
+		"198.51.100.1:6881|":                 false,
+		"198.51.100.1:6881|&ipv6=2001:db8::1": true,
+	}
+	for request, banned := range requests {
+		parts := strings.Split(request, "|")
+		var buf bytes.Buffer
+		req, _ := http.NewRequest("GET", "http://tracker/00000000000000000000000000000000/scrape?info_hash=x"+parts[1], nil)
+		req.RemoteAddr = parts[0]
+		testHandler.respond(req, &buf)
+
+		// The ban is checked before the passkey
+		if strings.Contains(buf.String(), config.Current().Bans.Message) != banned {
+			t.Errorf("Request from %s answered with %q", request, buf.String())
+		}
+	}
+}
+
 func TestServeHTTP(t *testing.T) {
 	testWriter := httptest.NewRecorder()
-	if !dbInit {
-		testHandler.db.Init()
-		dbInit = true
-	}
+	initTestDatabase(t)
 	testHandler.bufferPool = bufferpool.New(5, 5)
 	testReq, _ := http.NewRequest("GET", "www.bing.com/stats", nil)
-	testHandler.terminate = true
-	testHandler.ServeHTTP(testWriter, testReq)
-	if testWriter.Header().Get("Connection") != "" {
-		t.Error("HTTP server not terminated")
+	terminatedWriter := httptest.NewRecorder()
+	atomic.StoreInt32(&testHandler.terminate, 1)
+	testHandler.ServeHTTP(terminatedWriter, testReq)
+	if terminatedWriter.Code != http.StatusServiceUnavailable || !strings.Contains(terminatedWriter.Body.String(), "shutting down") {
+		t.Errorf("HTTP server not terminated. Code=%v, response=%v", terminatedWriter.Code, terminatedWriter.Body)
 	}
 
-	testHandler.terminate = false
+	atomic.StoreInt32(&testHandler.terminate, 0)
 	testHandler.ServeHTTP(testWriter, testReq)
 	if conHeader := testWriter.Header().Get("Connection"); conHeader != "close" {
 		t.Errorf("Unexpected HTTP header value. Connection=%v", conHeader)
@@ -262,16 +335,343 @@ func TestServeHTTP(t *testing.T) {
 	}
 }
 
+func testAnnounce(t *testing.T, key string, infoHash string, query string) string {
+	var resultBuf bytes.Buffer
+	testReq, err := http.NewRequest("GET", "http://tracker/"+key+"/announce?info_hash="+url.QueryEscape(infoHash)+"&"+query, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest error=%v", err)
+	}
+	testHandler.respond(testReq, &resultBuf)
+	return resultBuf.String()
+}
+
+type testAnnounceResponse struct {
+	Failure     string      `bencode:"failure reason"`
+	Complete    int         `bencode:"complete"`
+	Incomplete  int         `bencode:"incomplete"`
+	Interval    int64       `bencode:"interval"`
+	MinInterval int64       `bencode:"min interval"`
+	Peers       interface{} `bencode:"peers"` // string if compact, list of dictionaries otherwise
+	Peers6      string      `bencode:"peers6"`
+	Warning     string      `bencode:"warning message"`
+}
+
+func decodeAnnounce(t *testing.T, resp string) (decoded testAnnounceResponse) {
+	if err := bencode.Unmarshal([]byte(resp), &decoded); err != nil {
+		t.Errorf("Invalid announce response %q: %v", resp, err)
+	}
+	return
+}
+
+// dictPeerIPs returns the IPs in a non-compact peer list.
+func dictPeerIPs(peers interface{}) (ips []string) {
+	list, _ := peers.([]interface{})
+	for _, peer := range list {
+		if dict, ok := peer.(map[string]interface{}); ok {
+			ip, _ := dict["ip"].(string)
+			ips = append(ips, ip)
+		}
+	}
+	return
+}
+
+func TestAnnounce(t *testing.T) {
+	initTestDatabase(t)
+	infoHash, _ := hex.DecodeString("0123456789abcdef0123456789abcdef01234567")
+	prunedInfoHash, _ := hex.DecodeString("76543210fedcba9876543210fedcba9876543210")
+
+	resp := decodeAnnounce(t, testAnnounce(t, passkey, string(infoHash), "peer_id=-XX0001-000000000001&port=6881&uploaded=0&downloaded=0&left=100&compact=1&ip=10.0.0.1"))
+	if resp.Failure != "Your client is not approved" {
+		t.Errorf("Unapproved client accepted: %+v", resp)
+	}
+
+	resp = decodeAnnounce(t, testAnnounce(t, passkey, string(infoHash), "peer_id=-TR1920-000000000001&port=6881&uploaded=0&downloaded=0&left=100&compact=1&ip=10.0.0.1"))
+	if resp.Failure != "Please update Transmission" {
+		t.Errorf("Denied client version accepted: %+v", resp)
+	}
+
+	resp = decodeAnnounce(t, testAnnounce(t, passkey, string(infoHash), "peer_id=-TR2820-000000000001&port=6881&uploaded=0&downloaded=0&left=100&compact=1&ip=10.0.0.1"))
+	if resp.Failure != "" || resp.Complete != 0 || resp.Incomplete != 1 || resp.Peers != "" {
+		t.Errorf("Unexpected announce response for leecher: %+v", resp)
+	}
+
+	resp = decodeAnnounce(t, testAnnounce(t, passkey, string(infoHash), "peer_id=-DE1350-000000000002&port=6882&uploaded=0&downloaded=0&left=0&compact=1&ip=10.0.0.2&ipv6=2607:f0d0:1002:51::4"))
+	if resp.Complete != 1 || resp.Incomplete != 1 || resp.Peers != "\x0a\x00\x00\x01\x1a\xe1" || resp.Peers6 != "" {
+		t.Errorf("Unexpected announce response for seeder: %+v", resp)
+	}
+
+	resp = decodeAnnounce(t, testAnnounce(t, passkey, string(infoHash), "peer_id=-TR2820-000000000001&port=6881&uploaded=0&downloaded=100&left=100&compact=1&ip=10.0.0.1"))
+	if resp.Peers != "\x0a\x00\x00\x02\x1a\xe2" || len(resp.Peers6) != 18 || !strings.HasPrefix(resp.Peers6, "\x26\x07") {
+		t.Errorf("Seeder missing from announce response: %+v", resp)
+	}
+
+	resp = decodeAnnounce(t, testAnnounce(t, "34567891234567891234567891234567", string(infoHash), "peer_id=-TR2820-000000000003&port=6883&uploaded=0&downloaded=0&left=100&ip=10.0.0.3"))
+	if ips := dictPeerIPs(resp.Peers); len(ips) != 3 || ips[0] != "10.0.0.2" || ips[1] != "2607:f0d0:1002:51::4" {
+		t.Errorf("Unexpected dictionary announce response: %+v", resp)
+	}
+
+	resp = decodeAnnounce(t, testAnnounce(t, "34567891234567891234567891234567", string(prunedInfoHash), "peer_id=-TR2820-000000000003&port=6883&uploaded=0&downloaded=0&left=100&ip=10.0.0.3"))
+	if !strings.HasPrefix(resp.Failure, "This torrent does not exist") {
+		t.Errorf("Announce to pruned torrent accepted: %+v", resp)
+	}
+
+	resp = decodeAnnounce(t, testAnnounce(t, "34567891234567891234567891234567", string(prunedInfoHash), "peer_id=-TR2820-000000000003&port=6883&uploaded=0&downloaded=0&left=0&ip=10.0.0.3"))
+	if resp.Failure != "" || resp.Complete != 1 {
+		t.Errorf("Seeder failed to unprune torrent: %+v", resp)
+	}
+
+	// Flushing is asynchronous, and deltas for the same user are merged
+	found := false
+	deadline := time.Now().Add(5 * time.Second)
+	for !found && time.Now().Before(deadline) {
+		for _, delta := range testBackend.UserDeltas() {
+			if delta.Id == 1 && delta.RawDeltaDownload == 100 && delta.DeltaDownload == 100 {
+				found = true
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !found {
+		t.Errorf("Download not recorded: %+v", testBackend.UserDeltas())
+	}
+
+	if unPruned := testBackend.UnPruned(); len(unPruned) != 1 || unPruned[0] != 2 {
+		t.Errorf("Unexpected unpruned torrents: %v", unPruned)
+	}
+
+	torrent := testHandler.db.Torrents[string(infoHash)]
+	torrent.RLock()
+	if peer := torrent.Seeders["-DE1350-000000000002"]; peer.IpFrom != database.IpFromParam || peer.Ip6From != database.IpFromParam {
+		t.Errorf("Addresses came from %q and %q, want the parameters", peer.IpFrom, peer.Ip6From)
+	}
+	torrent.RUnlock()
+}
+
+func TestEarlyAnnounce(t *testing.T) {
+	initTestDatabase(t)
+
+	cfg := *config.Current()
+	cfg.Intervals.MinAnnounce.Duration = 15 * time.Minute
+	defer config.Swap(config.Swap(&cfg))
+
+	start := time.Now()
+	defer func() { clock = time.Now }()
+	clock = func() time.Time { return start }
+
+	// A torrent of its own, so the other tests' peers don't matter
+	infoHash := "earlyannounce0000000"
+	testHandler.db.SetTorrent(infoHash, &database.Torrent{Id: 100, UpMultiplier: 1, DownMultiplier: 1})
+	defer testHandler.db.DeleteTorrent(infoHash)
+	query := "peer_id=-TR2820-early0000001&port=6884&compact=1&ip=10.0.0.4"
+
+	resp := decodeAnnounce(t, testAnnounce(t, passkey, infoHash, query+"&left=100&uploaded=0&downloaded=0&event=started"))
+	if resp.Failure != "" || resp.Warning != "" {
+		t.Fatalf("Unexpected response to the first announce: %+v", resp)
+	}
+
+	// A minute later still isn't the min interval
+	clock = func() time.Time { return start.Add(time.Minute) }
+	resp = decodeAnnounce(t, testAnnounce(t, passkey, infoHash, query+"&left=50&uploaded=0&downloaded=50"))
+	if resp.Failure != "" || !strings.Contains(resp.Warning, "min interval") || resp.Incomplete != 1 {
+		t.Errorf("Unexpected response to an early announce: %+v", resp)
+	}
+	if peer := testPeer(infoHash, "-TR2820-early0000001"); peer.Downloaded != 0 || peer.LastAnnounce != start.Unix() {
+		t.Errorf("Early announce recorded: %+v", peer)
+	}
+
+	// Events are always recorded
+	resp = decodeAnnounce(t, testAnnounce(t, passkey, infoHash, query+"&left=0&uploaded=0&downloaded=100&event=completed"))
+	if resp.Failure != "" || resp.Warning != "" {
+		t.Errorf("Unexpected response to completing early: %+v", resp)
+	}
+	if peer := testPeer(infoHash, "-TR2820-early0000001"); peer.Downloaded != 100 || !peer.Seeding {
+		t.Errorf("Completion not recorded: %+v", peer)
+	}
+
+	// And announces after the min interval
+	clock = func() time.Time { return start.Add(20 * time.Minute) }
+	resp = decodeAnnounce(t, testAnnounce(t, passkey, infoHash, query+"&left=0&downloaded=100&uploaded=30"))
+	if resp.Failure != "" || resp.Warning != "" {
+		t.Errorf("Unexpected response to a regular announce: %+v", resp)
+	}
+	if peer := testPeer(infoHash, "-TR2820-early0000001"); peer.Uploaded != 30 {
+		t.Errorf("Regular announce not recorded: %+v", peer)
+	}
+}
+
+// testPeer returns a copy of a peer in the test database, or a zero peer if it's not in the swarm.
+func testPeer(infoHash string, peerId string) (peer database.Peer) {
+	testHandler.db.TorrentsMutex.RLock()
+	defer testHandler.db.TorrentsMutex.RUnlock()
+
+	torrent := testHandler.db.Torrents[infoHash]
+	torrent.RLock()
+	defer torrent.RUnlock()
+	if p, exists := torrent.Leechers[peerId]; exists {
+		peer = *p
+	} else if p, exists = torrent.Seeders[peerId]; exists {
+		peer = *p
+	}
+	return
+}
+
+func TestScrape(t *testing.T) {
+	initTestDatabase(t)
+	infoHash, _ := hex.DecodeString("0123456789abcdef0123456789abcdef01234567")
+
+	var resultBuf bytes.Buffer
+	testReq, _ := http.NewRequest("GET", "http://tracker/"+passkey+"/scrape?info_hash="+url.QueryEscape(string(infoHash))+"&info_hash=unknown&ip=10.0.0.1", nil)
+	testHandler.respond(testReq, &resultBuf)
+
+	var resp struct {
+		Files map[string]struct {
+			Complete   int `bencode:"complete"`
+			Downloaded int `bencode:"downloaded"`
+			Incomplete int `bencode:"incomplete"`
+		} `bencode:"files"`
+	}
+	if err := bencode.Unmarshal(resultBuf.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid scrape response %q: %v", resultBuf.String(), err)
+	}
+	if len(resp.Files) != 1 {
+		t.Errorf("Unexpected files in scrape response: %+v", resp.Files)
+	}
+	if file, exists := resp.Files[string(infoHash)]; !exists || file.Downloaded < 3 {
+		t.Errorf("Unexpected scrape response: %+v", resp.Files)
+	}
+}
+
+// Meant to be run with -race, announces on different torrents and scrapes run in parallel
+func TestConcurrentAnnounces(t *testing.T) {
+	initTestDatabase(t)
+	testHandler.bufferPool = bufferpool.New(5, 5)
+	infoHash, _ := hex.DecodeString("0123456789abcdef0123456789abcdef01234567")
+	otherInfoHash, _ := hex.DecodeString("76543210fedcba9876543210fedcba9876543210")
+	infoHashes := []string{string(infoHash), string(otherInfoHash)}
+
+	peers := func() (count int) {
+		for _, infoHash := range infoHashes {
+			torrent := testHandler.db.Torrents[infoHash]
+			torrent.RLock()
+			count += len(torrent.Seeders) + len(torrent.Leechers)
+			torrent.RUnlock()
+		}
+		return
+	}
+	before := peers()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var buf bytes.Buffer
+
+			// The other torrent is pruned until a seeder announces, so it only gets seeders
+			query := fmt.Sprintf("http://tracker/%s/announce?info_hash=%s&peer_id=-TR2820-1%011d&port=%d&uploaded=0&downloaded=0&left=%d&compact=1&ip=10.1.0.%d",
+				passkey, url.QueryEscape(infoHashes[i%2]), i, 7000+i, (1-i%2)*100, i+1)
+			for _, event := range []string{"started", "", "stopped"} {
+				buf.Reset()
+				req, _ := http.NewRequest("GET", query+"&event="+event, nil)
+				testHandler.respond(req, &buf)
+				if !strings.HasPrefix(buf.String(), "d8:complete") {
+					t.Errorf("Unexpected announce response: %q", buf.String())
+				}
+			}
+
+			buf.Reset()
+			req, _ := http.NewRequest("GET", "http://tracker/"+passkey+"/scrape?info_hash="+url.QueryEscape(infoHashes[i%2]), nil)
+			testHandler.respond(req, &buf)
+
+			req, _ = http.NewRequest("GET", "/stats", nil)
+			testHandler.ServeHTTP(httptest.NewRecorder(), req)
+		}(i)
+	}
+	wg.Wait()
+
+	if after := peers(); after != before {
+		t.Errorf("%d peers left after stopping, want %d", after, before)
+	}
+
+	t.Run("slots", testConcurrentSlots)
+}
+
+// A user with one slot starts leeching many torrents at once
+func testConcurrentSlots(t *testing.T) {
+
+	cfg := *config.Current()
+	cfg.SlotsEnabled = true
+	defer config.Swap(config.Swap(&cfg))
+
+	const slotPasskey = "56789123456789123456789123456789"
+	testHandler.db.SetUser(slotPasskey, &database.User{Id: 200, UpMultiplier: 1, DownMultiplier: 1, Slots: 1})
+	defer testHandler.db.DeleteUser(slotPasskey)
+	var infoHashes []string
+	for i := 0; i < 20; i++ {
+		infoHash := fmt.Sprintf("slots%015d", i)
+		testHandler.db.SetTorrent(infoHash, &database.Torrent{Id: uint64(200 + i), UpMultiplier: 1, DownMultiplier: 1})
+		defer testHandler.db.DeleteTorrent(infoHash)
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	var wg sync.WaitGroup
+	var started int32
+	for i, infoHash := range infoHashes {
+		wg.Add(1)
+		go func(i int, infoHash string) {
+			defer wg.Done()
+			query := fmt.Sprintf("peer_id=-TR2820-2%011d&port=%d&uploaded=0&downloaded=0&left=100&ip=10.2.0.%d&event=started", i, 7000+i, i+1)
+			if resp := decodeAnnounce(t, testAnnounce(t, slotPasskey, infoHash, query)); resp.Failure == "" {
+				atomic.AddInt32(&started, 1)
+			} else if !strings.Contains(resp.Failure, "slots") {
+				t.Errorf("Unexpected failure: %s", resp.Failure)
+			}
+		}(i, infoHash)
+	}
+	wg.Wait()
+
+	user := testHandler.db.Users[slotPasskey]
+	if started != 1 || atomic.LoadInt64(&user.UsedSlots) != 1 {
+		t.Errorf("Started %d downloads with 1 slot, %d slots used", started, atomic.LoadInt64(&user.UsedSlots))
+	}
+	leechers := 0
+	for _, infoHash := range infoHashes {
+		leechers += len(testHandler.db.Torrents[infoHash].Leechers)
+	}
+	if leechers != 1 {
+		t.Errorf("%d leechers after the announces, want the one that got the slot", leechers)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	initTestDatabase(t)
+	testHandler.bufferPool = bufferpool.New(5, 5)
+
+	testAnnounce(t, "00000000000000000000000000000000", "x", "peer_id=x")
+
+	testWriter := httptest.NewRecorder()
+	testReq, _ := http.NewRequest("GET", "/metrics", nil)
+	testHandler.ServeHTTP(testWriter, testReq)
+
+	body := testWriter.Body.String()
+	for _, expected := range []string{
+		"\nchihaya_flush_queue_length{channel=\"torrents\"} ",
+		"\nchihaya_torrents 2\n",
+		"\nchihaya_failures_total{reason=\"Passkey not found\"} ",
+		"\nchihaya_announces_total{result=\"failure\"} ",
+		"\nchihaya_request_duration_seconds_count{action=\"announce\"} ",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Metrics missing %q:\n%s", expected, body)
+		}
+	}
+}
+
 func BenchmarkRespondErrors_BestCase(b *testing.B) {
 	b.StopTimer()
-	if !dbInit {
-		testHandler.db.Init()
-		dbInit = true
-	}
-	testHandler.db.Users[passkey] = &testUser
-	usr, ex := testHandler.db.Users[passkey]
-	if !ex {
-		b.Fatalf("Cannot mock user(%s) passkey %v", usr, passkey)
+	initTestDatabase(b)
+	if _, ex := testHandler.db.Users[passkey]; !ex {
+		b.Fatalf("Cannot find user with passkey %v", passkey)
 	}
 	var resultBuf bytes.Buffer
 	for i := 0; i < b.N; i++ {
@@ -286,14 +686,9 @@ func BenchmarkRespondErrors_BestCase(b *testing.B) {
 
 func BenchmarkRespondErrors_WorstCase(b *testing.B) {
 	b.StopTimer()
-	if !dbInit {
-		testHandler.db.Init()
-		dbInit = true
-	}
-	testHandler.db.Users[passkey] = &testUser
-	usr, ex := testHandler.db.Users[passkey]
-	if !ex {
-		b.Fatalf("Cannot mock user(%s) passkey %v", usr, passkey)
+	initTestDatabase(b)
+	if _, ex := testHandler.db.Users[passkey]; !ex {
+		b.Fatalf("Cannot find user with passkey %v", passkey)
 	}
 	var resultBuf bytes.Buffer
 	for i := 0; i < b.N; i++ {
@@ -308,14 +703,9 @@ func BenchmarkRespondErrors_WorstCase(b *testing.B) {
 
 func BenchmarkRespondErrors_All(b *testing.B) {
 	b.StopTimer()
-	if !dbInit {
-		testHandler.db.Init()
-		dbInit = true
-	}
-	testHandler.db.Users[passkey] = &testUser
-	usr, ex := testHandler.db.Users[passkey]
-	if !ex {
-		b.Fatalf("Cannot mock user(%s) passkey %v", usr, passkey)
+	initTestDatabase(b)
+	if _, ex := testHandler.db.Users[passkey]; !ex {
+		b.Fatalf("Cannot find user with passkey %v", passkey)
 	}
 	var resultBuf bytes.Buffer
 	for i := 0; i < b.N; i++ {
@@ -0,0 +1,404 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kotoko/chihaya/config"
+	cdb "github.com/kotoko/chihaya/database"
+)
+
+/*
+ * UDP tracker protocol, as specified in BEP 15 (http://www.bittorrent.org/beps/bep_0015.html)
+ *
+ * Since UDP requests have no path, the passkey is taken from the URL data option of BEP 41
+ * (http://www.bittorrent.org/beps/bep_0041.html), which clients fill with the path and query of the announce URL.
+ *
+ * Connection IDs are stateless: they are an HMAC of the client address and the current minute,
+ * so a connection ID is valid for one to two minutes as recommended by the spec.
+ */
+
+const (
+	udpProtocolId = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	udpEventNone      = 0
+	udpEventCompleted = 1
+	udpEventStarted   = 2
+	udpEventStopped   = 3
+
+	udpOptionEndOfOptions = 0
+	udpOptionNOP          = 1
+	udpOptionURLData      = 2
+
+	udpMaxPacketSize    = 2048
+	udpAnnounceSize     = 98
+	udpMaxScrapeHashes  = 74
+	udpConnectionExpiry = 60 // seconds per connection ID epoch
+
+	udpWorkers   = 64   // Packets handled at once
+	udpQueueSize = 1024 // Packets waiting for a worker, more are dropped
+)
+
+type udpHandler struct {
+	handler *httpHandler
+	conn    net.PacketConn
+	secret  []byte
+	packets chan udpPacket
+	stopped chan struct{} // Closed once serve stopped queueing packets
+}
+
+type udpPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+var udpServer *udpHandler
+
+func newUDPHandler(handler *httpHandler, conn net.PacketConn) *udpHandler {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &udpHandler{handler, conn, secret, make(chan udpPacket, udpQueueSize), make(chan struct{})}
+}
+
+/*
+ * Packets are handled by a fixed number of workers, so a flood can't start an unbounded number of goroutines.
+ * When the queue is full, packets are dropped like they would be by a full socket buffer, and clients retry.
+ *
+ * Packets are counted in the handler's wait group before they're queued, and serve stops before the shutdown
+ * waits for it, so the count can't be increased while it's being waited on.
+ */
+func (h *udpHandler) serve() {
+	defer close(h.stopped)
+	defer close(h.packets)
+
+	for i := 0; i < udpWorkers; i++ {
+		go func() {
+			for packet := range h.packets {
+				h.handlePacket(packet.data, packet.addr)
+			}
+		}()
+	}
+
+	for {
+		packet := make([]byte, udpMaxPacketSize)
+		n, addr, err := h.conn.ReadFrom(packet)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Warning("UDP read error", "err", err)
+			continue
+		}
+
+		h.handler.waitGroup.Add(1)
+		select {
+		case h.packets <- udpPacket{packet[:n], addr}:
+		default:
+			h.handler.waitGroup.Done()
+		}
+	}
+}
+
+// handlePacket answers a packet queued by serve, which counted it in the handler's wait group.
+func (h *udpHandler) handlePacket(packet []byte, addr net.Addr) {
+	defer h.handler.waitGroup.Done()
+	if h.handler.terminating() {
+		return
+	}
+
+	defer func() {
+		err := recover()
+		if err != nil {
+			logger.Critical("UDP handler panic", "err", err)
+		}
+	}()
+
+	start := time.Now()
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || len(packet) < 16 {
+		return
+	}
+
+	buf := h.handler.bufferPool.Take()
+	defer h.handler.bufferPool.Give(buf)
+
+	connectionId := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionId := packet[12:16]
+
+	if action == udpActionConnect {
+		if connectionId != udpProtocolId {
+			return
+		}
+		writeUint32(buf, udpActionConnect)
+		buf.Write(transactionId)
+		writeUint64(buf, h.connectionId(udpAddr.IP, time.Now().Unix()/udpConnectionExpiry))
+	} else if !h.validConnectionId(connectionId, udpAddr.IP) {
+		udpFailure("Connection ID expired", transactionId, buf)
+	} else {
+		switch action {
+		case udpActionAnnounce:
+			h.announce(packet, transactionId, udpAddr, buf)
+			observeRequest("announce", udpFailed(buf), start)
+		case udpActionScrape:
+			h.scrape(packet, transactionId, udpAddr, buf)
+			observeRequest("scrape", udpFailed(buf), start)
+		default:
+			udpFailure("Unknown action", transactionId, buf)
+		}
+	}
+
+	h.conn.WriteTo(buf.Bytes(), addr)
+
+	atomic.AddInt64(&h.handler.deltaRequests, 1)
+}
+
+func (h *udpHandler) connectionId(ip net.IP, epoch int64) uint64 {
+	var epochBytes [8]byte
+	binary.BigEndian.PutUint64(epochBytes[:], uint64(epoch))
+
+	mac := hmac.New(sha1.New, h.secret)
+	mac.Write(ip)
+	mac.Write(epochBytes[:])
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func (h *udpHandler) validConnectionId(connectionId uint64, ip net.IP) bool {
+	epoch := time.Now().Unix() / udpConnectionExpiry
+	return connectionId == h.connectionId(ip, epoch) || connectionId == h.connectionId(ip, epoch-1)
+}
+
+func (h *udpHandler) announce(packet []byte, transactionId []byte, addr *net.UDPAddr, buf *bytes.Buffer) {
+	if len(packet) < udpAnnounceSize {
+		udpFailure("Malformed request", transactionId, buf)
+		return
+	}
+	if h.ipRateLimited(addr.IP, transactionId, buf) {
+		return
+	}
+	if h.handler.db.Banned(addr.IP) {
+		udpFailure(config.Current().Bans.Message, transactionId, buf)
+		return
+	}
+
+	urlPath := parseURLData(packet[udpAnnounceSize:])
+	if i := strings.IndexByte(urlPath, '?'); i != -1 {
+		urlPath = urlPath[:i]
+	}
+
+	dir, _ := path.Split(urlPath)
+	if len(dir) != 34 {
+		udpFailure("Your passkey is invalid", transactionId, buf)
+		return
+	}
+
+	passkey := dir[1:33]
+
+	db := h.handler.db
+	db.UsersMutex.RLock()
+	user, exists := db.Users[passkey]
+	db.UsersMutex.RUnlock()
+	if !exists {
+		udpFailure("Passkey not found", transactionId, buf)
+		return
+	}
+
+	// There is no retry in field over UDP, so clients retry at their own pace
+	if _, limited := rateLimited(passkeyLimiter, "passkey", passkey, config.Current().RateLimits.Passkey); limited {
+		udpFailure("Too many requests for your passkey", transactionId, buf)
+		return
+	}
+
+	params := &queryParams{make(map[string]string), nil}
+	params.params["info_hash"] = string(packet[16:36])
+	params.params["peer_id"] = string(packet[36:56])
+	params.params["downloaded"] = strconv.FormatUint(binary.BigEndian.Uint64(packet[56:64]), 10)
+	params.params["left"] = strconv.FormatUint(binary.BigEndian.Uint64(packet[64:72]), 10)
+	params.params["uploaded"] = strconv.FormatUint(binary.BigEndian.Uint64(packet[72:80]), 10)
+	params.params["port"] = strconv.FormatUint(uint64(binary.BigEndian.Uint16(packet[96:98])), 10)
+
+	switch binary.BigEndian.Uint32(packet[80:84]) {
+	case udpEventCompleted:
+		params.params["event"] = "completed"
+	case udpEventStarted:
+		params.params["event"] = "started"
+	case udpEventStopped:
+		params.params["event"] = "stopped"
+	}
+
+	if numWant := int32(binary.BigEndian.Uint32(packet[92:96])); numWant >= 0 {
+		params.params["numwant"] = strconv.FormatInt(int64(numWant), 10)
+	}
+
+	// Like the ip parameter over HTTP, a non-zero IP field overrides the source address if ip_param allows it.
+	// The field is only 32 bits wide, so IPv6 addresses always come from the source address.
+	var ip clientIP
+	if ipField := net.IP(packet[84:88]); binary.BigEndian.Uint32(ipField) != 0 && ipParamAllowed(ipField, addr.IP) {
+		ip.add(ipField, cdb.IpFromParam)
+	}
+	ip.add(addr.IP, cdb.IpFromConnection)
+	if h.handler.db.Banned(ip.v4, ip.v6) {
+		udpFailure(config.Current().Bans.Message, transactionId, buf)
+		return
+	}
+
+	announce(params, user, ip, db, &udpAnnounceWriter{buf, transactionId, addr.IP.To4() == nil})
+}
+
+// The URL data option isn't defined for scrapes, so they can't carry a passkey, and are only answered if enabled.
+func (h *udpHandler) scrape(packet []byte, transactionId []byte, addr *net.UDPAddr, buf *bytes.Buffer) {
+	if !config.Current().UDPScrape {
+		udpFailure("Scrapes are disabled", transactionId, buf)
+		return
+	}
+
+	hashes := packet[16:]
+	if len(hashes) == 0 || len(hashes)%20 != 0 || len(hashes)/20 > udpMaxScrapeHashes {
+		udpFailure("Malformed request", transactionId, buf)
+		return
+	}
+	if h.ipRateLimited(addr.IP, transactionId, buf) {
+		return
+	}
+	if h.handler.db.Banned(addr.IP) {
+		udpFailure(config.Current().Bans.Message, transactionId, buf)
+		return
+	}
+
+	infoHashes := make([]string, len(hashes)/20)
+	for i := range infoHashes {
+		infoHashes[i] = string(hashes[i*20 : (i+1)*20])
+	}
+
+	writeUint32(buf, udpActionScrape)
+	buf.Write(transactionId)
+
+	scrapeTorrents(infoHashes, h.handler.db, func(infoHash string, torrent *cdb.Torrent) {
+		if torrent == nil {
+			writeUint32(buf, 0)
+			writeUint32(buf, 0)
+			writeUint32(buf, 0)
+			return
+		}
+		writeUint32(buf, uint32(len(torrent.Seeders)))
+		writeUint32(buf, uint32(torrent.Snatched))
+		writeUint32(buf, uint32(len(torrent.Leechers)))
+	})
+}
+
+// ipRateLimited writes a failure if the address went over its rate limit. The connection ID proves the client
+// owns the address, so it can't be spoofed to use up someone else's limit.
+func (h *udpHandler) ipRateLimited(ip net.IP, transactionId []byte, buf *bytes.Buffer) bool {
+	_, limited := rateLimited(ipLimiter, "ip", ip.String(), config.Current().RateLimits.IP)
+	if limited {
+		udpFailure("Too many requests from your IP address", transactionId, buf)
+	}
+	return limited
+}
+
+// udpAnnounceWriter writes binary announce responses for the UDP protocol, which are always compact.
+// Requests received over IPv6 get 18 byte IPv6 peers, as there is no room for both address families.
+type udpAnnounceWriter struct {
+	buf           *bytes.Buffer
+	transactionId []byte
+	ipv6          bool
+}
+
+func (w *udpAnnounceWriter) failure(reason string) {
+	udpFailure(reason, w.transactionId, w.buf)
+}
+
+func (w *udpAnnounceWriter) warning(message string) {}
+
+func (w *udpAnnounceWriter) announce(torrent *cdb.Torrent, peer *cdb.Peer, numWant int, active bool) {
+	writeUint32(w.buf, udpActionAnnounce)
+	w.buf.Write(w.transactionId)
+	writeUint32(w.buf, uint32(config.Current().Intervals.Announce.Seconds()))
+	writeUint32(w.buf, uint32(len(torrent.Leechers)))
+	writeUint32(w.buf, uint32(len(torrent.Seeders)))
+
+	if numWant > 0 && active {
+		// Peers without an address of the family being written are skipped, and don't count toward numwant
+		eachPeer(torrent, peer, numWant, func(p *cdb.Peer) bool {
+			addr := p.Addr
+			if w.ipv6 {
+				addr = p.Addr6
+			}
+			w.buf.Write(addr)
+			return len(addr) > 0
+		})
+	}
+}
+
+func udpFailure(err string, transactionId []byte, buf *bytes.Buffer) {
+	countFailure(err)
+
+	writeUint32(buf, udpActionError)
+	buf.Write(transactionId)
+	buf.WriteString(err)
+}
+
+func udpFailed(buf *bytes.Buffer) bool {
+	return buf.Len() >= 4 && binary.BigEndian.Uint32(buf.Bytes()) == udpActionError
+}
+
+// parseURLData concatenates the URL data options (BEP 41) following an announce request.
+func parseURLData(options []byte) string {
+	var data []byte
+
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case udpOptionEndOfOptions:
+			return string(data)
+		case udpOptionNOP:
+			i++
+		default:
+			// Every other option has a length byte, so unknown ones can be skipped
+			if i+1 >= len(options) {
+				return string(data)
+			}
+			end := i + 2 + int(options[i+1])
+			if end > len(options) {
+				return string(data)
+			}
+			if options[i] == udpOptionURLData {
+				data = append(data, options[i+2:end]...)
+			}
+			i = end
+		}
+	}
+	return string(data)
+}
+
+func writeUint32(buf *bytes.Buffer, v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	buf.Write(b[:])
+}
+
+func writeUint64(buf *bytes.Buffer, v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	buf.Write(b[:])
+}
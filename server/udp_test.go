@@ -0,0 +1,83 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	cdb "github.com/kotoko/chihaya/database"
+)
+
+var parseURLDataTests = []struct {
+	options []byte
+	out     string
+}{
+	{[]byte{}, ""},
+	{[]byte{udpOptionEndOfOptions, udpOptionURLData, 1, 'x'}, ""},
+	{[]byte{udpOptionURLData, 4, '/', 'a', 'b', 'c'}, "/abc"},
+	{[]byte{udpOptionNOP, udpOptionURLData, 2, '/', 'a', udpOptionURLData, 2, 'b', 'c', udpOptionEndOfOptions}, "/abc"},
+	{[]byte{9, 2, 'x', 'y', udpOptionURLData, 2, '/', 'a'}, "/a"},
+	{[]byte{udpOptionURLData, 10, '/', 'a'}, ""},
+	{[]byte{udpOptionURLData}, ""},
+}
+
+func TestParseURLData(t *testing.T) {
+	for i, test := range parseURLDataTests {
+		if out := parseURLData(test.options); out != test.out {
+			t.Errorf("test %d: parseURLData(%v) = %q, want %q", i, test.options, out, test.out)
+		}
+	}
+}
+
+func TestUDPConnectionId(t *testing.T) {
+	h := newUDPHandler(nil, nil)
+	ip := net.ParseIP("10.0.0.1")
+	epoch := time.Now().Unix() / udpConnectionExpiry
+
+	if !h.validConnectionId(h.connectionId(ip, epoch), ip) {
+		t.Error("Current connection ID rejected")
+	}
+	if !h.validConnectionId(h.connectionId(ip, epoch-1), ip) {
+		t.Error("Previous connection ID rejected")
+	}
+	if h.validConnectionId(h.connectionId(ip, epoch-2), ip) {
+		t.Error("Expired connection ID accepted")
+	}
+	if h.validConnectionId(h.connectionId(ip, epoch), net.ParseIP("10.0.0.2")) {
+		t.Error("Connection ID accepted from a different address")
+	}
+}
+
+func TestUDPScrapeDisabled(t *testing.T) {
+	initTestDatabase(t)
+	h := newUDPHandler(testHandler, nil)
+	packet := make([]byte, 16+20)
+	var buf bytes.Buffer
+	h.scrape(packet, packet[12:16], &net.UDPAddr{IP: net.ParseIP("192.0.2.20"), Port: 6881}, &buf)
+	if !udpFailed(&buf) || !bytes.Contains(buf.Bytes(), []byte("disabled")) {
+		t.Errorf("UDP scrape answered while disabled: %q", buf.Bytes())
+	}
+}
+
+func TestUDPAnnounceIPv6Peers(t *testing.T) {
+	torrent := &cdb.Torrent{Seeders: make(map[string]*cdb.Peer), Leechers: make(map[string]*cdb.Peer)}
+	for i := 0; i < 10; i++ {
+		torrent.Seeders[fmt.Sprintf("v4-%d", i)] = &cdb.Peer{Seeding: true, Addr: make([]byte, 6)}
+	}
+	torrent.Seeders["dual"] = &cdb.Peer{Seeding: true, Addr: make([]byte, 6), Addr6: make([]byte, 18)}
+	peer := &cdb.Peer{}
+	torrent.Leechers["self"] = peer
+
+	var buf bytes.Buffer
+	w := &udpAnnounceWriter{&buf, make([]byte, 4), true}
+	w.announce(torrent, peer, 1, true)
+	if peers := buf.Len() - 20; peers != 18 {
+		t.Errorf("Wrote %d bytes of IPv6 peers, want the one that has an IPv6 address", peers)
+	}
+}
@@ -6,58 +6,33 @@ package server
 
 import (
 	"bytes"
-	"log"
-	"strconv"
-	"time"
+	"fmt"
+	"net"
+
+	"github.com/kotoko/chihaya/bencode"
 )
 
-func bencode(data interface{}, buf *bytes.Buffer) {
-	switch v := data.(type) {
-	case string:
-		buf.WriteString(strconv.Itoa(len(v)))
-		buf.WriteRune(':')
-		buf.WriteString(v)
-	case int:
-		buf.WriteRune('i')
-		buf.WriteString(strconv.Itoa(v))
-		buf.WriteRune('e')
-	case uint:
-		buf.WriteRune('i')
-		buf.WriteString(strconv.FormatUint(uint64(v), 10))
-		buf.WriteRune('e')
-	case int64:
-		buf.WriteRune('i')
-		buf.WriteString(strconv.FormatInt(v, 10))
-		buf.WriteRune('e')
-	case uint64:
-		buf.WriteRune('i')
-		buf.WriteString(strconv.FormatUint(v, 10))
-		buf.WriteRune('e')
-	case time.Duration:
-		// Assume seconds
-		buf.WriteRune('i')
-		buf.WriteString(strconv.FormatInt(int64(v/time.Second), 10))
-		buf.WriteRune('e')
-	case map[string]interface{}:
-		buf.WriteRune('d')
-		for key, val := range v {
-			buf.WriteString(strconv.Itoa(len(key)))
-			buf.WriteRune(':')
-			buf.WriteString(key)
-			bencode(val, buf)
-		}
-		buf.WriteRune('e')
-	case []string:
-		buf.WriteRune('l')
-		for _, val := range v {
-			bencode(val, buf)
-		}
-		buf.WriteRune('e')
-	default:
-		// Should handle []interface{} manually since Go can't do it implicitly (not currently necessary though)
-		log.Printf("%T\n", v)
-		panic("Tried to bencode an unsupported type!")
+// writeBencode writes a response, which can only fail to encode because of a bug.
+func writeBencode(response interface{}, buf *bytes.Buffer) {
+	if err := bencode.NewEncoder(buf).Encode(response); err != nil {
+		logger.Panic("Failed to bencode response", "type", fmt.Sprintf("%T", response), "err", err)
+	}
+}
+
+// compactAddr returns the compact form of an address (the IP in network byte order followed by the port),
+// which is 6 bytes long for IPv4 and 18 bytes long for IPv6. A nil IP gives a nil address.
+func compactAddr(ip net.IP, port uint64) []byte {
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
 	}
+	addr := make([]byte, len(ip)+2)
+	copy(addr, ip)
+	addr[len(ip)] = byte(port >> 8)
+	addr[len(ip)+1] = byte(port & 0xff)
+	return addr
 }
 
 // MinInt returns the smaller of the two integers provided.
@@ -0,0 +1,16 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Restarts the tracker without downtime, see server.Handoff
+var handoffSignal os.Signal = syscall.SIGUSR2